@@ -1,6 +1,12 @@
 package main
 
-// there are three classTypes:
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+// unless the policy declares its own classes, there are three classTypes:
 //
 //	l - lookups
 //	w - writes
@@ -8,31 +14,229 @@ package main
 var classTypes = []string{"l", "w", "q"}
 
 // Account is a data structure that stores everything we need to know
-// about a user account: its name and three leaky buckets for lookups,
-// writes and queries, modelling a rate-limited API that has three
-// separate quotas for reads/writes/queries per second
+// about a user account: its name and a leaky bucket for each class, e.g.
+// lookups, writes and queries, modelling a rate-limited API that has
+// separate quotas for reads/writes/queries per second. Each class's
+// bucket is created the first time it is used, and can be any Limiter,
+// depending on the algorithm its policy uses. Alongside its buckets, each
+// class can also have a ConcurrencyLimiter, capping the operations in flight.
 type Account struct {
-	Name    string             `json:"name"`
-	Buckets map[string]*Bucket `json:"buckets"`
+	Name    string                         `json:"name"`
+	Buckets map[string]Limiter             `json:"buckets"`
+	Leases  map[string]*ConcurrencyLimiter `json:"leases"`
+	mu      sync.RWMutex
 }
 
 // NewAccount creates a new account given the new account's name.
-func NewAccount(name string) Account {
-	buckets := map[string]*Bucket{}
-	for _, v := range classTypes {
-		bucket := Bucket{}
-		buckets[v] = &bucket
-	}
+func NewAccount(name string) *Account {
+	buckets := map[string]Limiter{}
+	leases := map[string]*ConcurrencyLimiter{}
 	acc := Account{
 		Name:    name,
 		Buckets: buckets,
+		Leases:  leases,
+	}
+	return &acc
+}
+
+// limiter returns the account's Limiter for a class, having applied the ClassPolicy
+// to it. If the class hasn't been used yet, a new Limiter is created. If the ClassPolicy
+// uses a different algorithm to the existing Limiter, it is replaced by a new one,
+// carrying over the existing Limiter's value.
+func (acc *Account) limiter(class string, cp ClassPolicy) (Limiter, error) {
+	acc.mu.RLock()
+	l, ok := acc.Buckets[class]
+	acc.mu.RUnlock()
+	if ok && l.State().Algorithm == cp.limiterAlgorithm() {
+		l.SetLimit(cp)
+		return l, nil
+	}
+
+	acc.mu.Lock()
+	defer acc.mu.Unlock()
+	// this is to solve a race between two goroutines trying to replace the same Limiter
+	l, ok = acc.Buckets[class]
+	if ok && l.State().Algorithm == cp.limiterAlgorithm() {
+		l.SetLimit(cp)
+		return l, nil
+	}
+	newLimiter, err := NewLimiter(cp)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		state := l.State()
+		if s, isSetter := newLimiter.(setter); isSetter && state.Capacity > 0 {
+			s.set(min(state.Value, cp.Capacity), cp.Capacity)
+		}
+	}
+	acc.Buckets[class] = newLimiter
+	return newLimiter, nil
+}
+
+// concurrency returns the account's ConcurrencyLimiter for a class, having applied
+// the ClassPolicy to it. If the class hasn't acquired a lease yet, a new
+// ConcurrencyLimiter is created.
+func (acc *Account) concurrency(class string, cp ClassPolicy) *ConcurrencyLimiter {
+	acc.mu.RLock()
+	cl, ok := acc.Leases[class]
+	acc.mu.RUnlock()
+	if !ok {
+		acc.mu.Lock()
+		// this is to solve a race between two goroutines trying to create the same ConcurrencyLimiter
+		cl, ok = acc.Leases[class]
+		if !ok {
+			cl = NewConcurrencyLimiter(cp)
+			acc.Leases[class] = cl
+		}
+		acc.mu.Unlock()
+	}
+	cl.SetLimit(cp)
+	return cl
+}
+
+// release frees a lease on the account's ConcurrencyLimiter for a class, returning
+// false if there is no such lease
+func (acc *Account) release(class string, id string) bool {
+	acc.mu.RLock()
+	cl, ok := acc.Leases[class]
+	acc.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	return cl.Release(id)
+}
+
+// state returns the State of the account's Limiter for a class, without
+// creating it if the class hasn't been used yet
+func (acc *Account) state(class string) (LimiterState, bool) {
+	acc.mu.RLock()
+	l, ok := acc.Buckets[class]
+	acc.mu.RUnlock()
+	if !ok {
+		return LimiterState{}, false
+	}
+	return l.State(), true
+}
+
+// refund adds inc back to the account's Limiter for a class, returning how much
+// was added and its State afterwards. Nothing is refunded if the class hasn't
+// been used yet.
+func (acc *Account) refund(class string, inc int) (int, LimiterState, bool) {
+	acc.mu.RLock()
+	l, ok := acc.Buckets[class]
+	acc.mu.RUnlock()
+	if !ok {
+		return 0, LimiterState{}, false
 	}
-	return acc
+	refunded := l.Refund(inc)
+	return refunded, l.State(), true
 }
 
-// reset sets each leaky bucket back to its full capacity
+// applyPolicy applies the policy to each of the account's limiters
+func (acc *Account) applyPolicy(p *Policy) {
+	acc.mu.RLock()
+	states := map[string]LimiterState{}
+	for class, l := range acc.Buckets {
+		states[class] = l.State()
+	}
+	acc.mu.RUnlock()
+
+	for class, state := range states {
+		cp, ok := p.lookup(acc.Name, class)
+		if !ok || cp.Capacity == 0 {
+			continue
+		}
+		// treat the limiter's own capacity as if a client had requested it
+		requested := state.Capacity
+		if len(state.Limits) > 0 {
+			requested = state.Limits[0].Capacity
+		}
+		resolved, err := p.resolve(acc.Name, class, requested)
+		if err != nil {
+			resolved, _ = p.resolve(acc.Name, class, cp.Capacity)
+		}
+		acc.limiter(class, resolved)
+	}
+
+	acc.mu.RLock()
+	leases := map[string]*ConcurrencyLimiter{}
+	for class, cl := range acc.Leases {
+		leases[class] = cl
+	}
+	acc.mu.RUnlock()
+	for class, cl := range leases {
+		cp, ok := p.lookup(acc.Name, class)
+		if !ok || cp.Concurrency == 0 {
+			continue
+		}
+		resolved, err := p.resolveConcurrency(acc.Name, class, cl.State().Capacity)
+		if err != nil {
+			resolved, _ = p.resolveConcurrency(acc.Name, class, cp.Concurrency)
+		}
+		cl.SetLimit(resolved)
+	}
+}
+
+// reset resets each of the account's limiters
 func (acc *Account) reset() {
+	acc.mu.RLock()
+	defer acc.mu.RUnlock()
 	for _, b := range acc.Buckets {
-		b.reset()
+		b.Reset()
 	}
 }
+
+// errNoBucket is the error when an account hasn't used a class yet
+var errNoBucket = errors.New("no such bucket")
+
+// set sets the value and capacity of the account's Limiter for a class, if it has
+// been used and its algorithm can be set. The capacity lasts until the next message
+// or policy reload applies a different one.
+func (acc *Account) set(class string, value int, capacity int) error {
+	acc.mu.RLock()
+	l, ok := acc.Buckets[class]
+	acc.mu.RUnlock()
+	if !ok {
+		return errNoBucket
+	}
+	s, ok := l.(setter)
+	if !ok {
+		return errors.New("limiter cannot be set")
+	}
+	return s.set(value, capacity)
+}
+
+// clearBuckets removes all of the account's limiters, so that each class starts afresh,
+// at its full capacity, the next time it is used. Its leases are kept, as they are
+// still held by clients.
+func (acc *Account) clearBuckets() {
+	acc.mu.Lock()
+	defer acc.mu.Unlock()
+	clear(acc.Buckets)
+}
+
+// MarshalJSON returns a JSON representation of the account's name and the
+// State of each of its limiters
+func (acc *Account) MarshalJSON() ([]byte, error) {
+	acc.mu.RLock()
+	defer acc.mu.RUnlock()
+	type Alias struct {
+		Name    string                  `json:"name"`
+		Buckets map[string]LimiterState `json:"buckets"`
+		Leases  map[string]LimiterState `json:"leases,omitempty"`
+	}
+	buckets := map[string]LimiterState{}
+	for class, l := range acc.Buckets {
+		buckets[class] = l.State()
+	}
+	leases := map[string]LimiterState{}
+	for class, cl := range acc.Leases {
+		leases[class] = cl.State()
+	}
+	return json.Marshal(Alias{
+		Name:    acc.Name,
+		Buckets: buckets,
+		Leases:  leases,
+	})
+}
@@ -1,23 +1,32 @@
 package main
 
-import "testing"
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// useBucket creates a fixed window bucket for an account's class, as a message would
+func useBucket(t *testing.T, acc *Account, class string, capacity int) *Bucket {
+	t.Helper()
+	l, err := acc.limiter(class, ClassPolicy{Algorithm: algorithmFixed, Capacity: capacity})
+	if err != nil {
+		t.Fatalf("Cannot create bucket: %v", err)
+	}
+	return l.(*Bucket)
+}
 
 func Test_account_new(t *testing.T) {
 	accName := "xyz"
 	acc := NewAccount(accName)
 
-	// ensure we have one bucket for each classType
-	numClassTypes := len(classTypes)
-	if len(acc.Buckets) != numClassTypes {
-		t.Errorf("Expected buckets to have %v length, got %v", numClassTypes, len(acc.Buckets))
+	// ensure buckets are only created when they are used
+	if len(acc.Buckets) != 0 {
+		t.Errorf("Expected buckets to have %v length, got %v", 0, len(acc.Buckets))
 	}
-
-	// check each key
-	for _, v := range classTypes {
-		_, ok := acc.Buckets[v]
-		if !ok {
-			t.Errorf("Expected buckets to have a key %v, but it is missing", v)
-		}
+	useBucket(t, acc, "search", 10)
+	if _, ok := acc.Buckets["search"]; !ok || len(acc.Buckets) != 1 {
+		t.Errorf("Expected buckets to only have a key %v, got %v", "search", acc.Buckets)
 	}
 
 	// check account name
@@ -29,17 +38,114 @@ func Test_account_new(t *testing.T) {
 func Test_account_reset(t *testing.T) {
 	accName := "zyx"
 	acc := NewAccount(accName)
-	acc.Buckets["l"].set(50, 100)
-	acc.Buckets["w"].set(25, 50)
-	acc.Buckets["q"].set(2, 5)
+	useBucket(t, acc, "l", 100).set(50, 100)
+	useBucket(t, acc, "w", 50).set(25, 50)
+	useBucket(t, acc, "q", 5).set(2, 5)
 	acc.reset()
-	if acc.Buckets["l"].Value() != 100 {
-		t.Errorf("Expected l bucket to have a value %v, but got %v", 100, acc.Buckets["l"].Value())
+	if acc.Buckets["l"].(*Bucket).Value() != 100 {
+		t.Errorf("Expected l bucket to have a value %v, but got %v", 100, acc.Buckets["l"].(*Bucket).Value())
+	}
+	if acc.Buckets["w"].(*Bucket).Value() != 50 {
+		t.Errorf("Expected w bucket to have a value %v, but got %v", 50, acc.Buckets["w"].(*Bucket).Value())
+	}
+	if acc.Buckets["q"].(*Bucket).Value() != 5 {
+		t.Errorf("Expected q bucket to have a value %v, but got %v", 5, acc.Buckets["q"].(*Bucket).Value())
+	}
+}
+
+func Test_account_limiter(t *testing.T) {
+	acc := NewAccount("bob")
+	l, err := acc.limiter("l", ClassPolicy{Algorithm: algorithmFixed, Capacity: 10})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	l.Allow(4)
+
+	// the same algorithm keeps the same limiter
+	l2, _ := acc.limiter("l", ClassPolicy{Algorithm: algorithmFixed, Capacity: 10})
+	if l2 != l {
+		t.Error("Expected the same limiter to be returned")
+	}
+
+	// a different algorithm replaces the limiter, carrying over its value
+	for _, algorithm := range []string{algorithmGCRA, algorithmToken, algorithmSliding} {
+		l, _ = acc.limiter("l", ClassPolicy{Algorithm: algorithm, Capacity: 10, Rate: 1, Window: Duration(time.Minute)})
+		state := acc.Buckets["l"].State()
+		if state.Algorithm != algorithm || state.Value != 6 {
+			t.Errorf("Expected %v limiter with value 6, got %+v", algorithm, state)
+		}
+	}
+
+	_, err = acc.limiter("w", ClassPolicy{Algorithm: "magic", Capacity: 10})
+	if err == nil {
+		t.Error("Expected error for unknown algorithm, got nil")
+	}
+}
+
+func Test_account_marshal_json(t *testing.T) {
+	acc := NewAccount("bob")
+	acc.limiter("l", ClassPolicy{Algorithm: algorithmFixed, Capacity: 10})
+	data, err := json.Marshal(acc)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	expected := `{"name":"bob","buckets":{"l":{"algorithm":"fixed","value":10,"capacity":10}}}`
+	if string(data) != expected {
+		t.Errorf("Expected JSON %v, got %v", expected, string(data))
+	}
+}
+
+func Test_account_leases(t *testing.T) {
+	acc := NewAccount("bob")
+	acc.concurrency("l", ClassPolicy{Capacity: 2}).Acquire()
+	if acc.release("w", "abc123") {
+		t.Error("Expected release for unused class to fail, got true")
+	}
+
+	// the policy applies to leases too
+	p := NewPolicy()
+	p.Mode = modeIgnore
+	p.Default["l"] = ClassPolicy{Concurrency: 5, TTL: Duration(time.Minute)}
+	acc.applyPolicy(p)
+	if acc.Leases["l"].ttl != time.Minute {
+		t.Errorf("Expected ttl to be %v, got %v", time.Minute, acc.Leases["l"].ttl)
+	}
+	data, err := json.Marshal(acc)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
 	}
-	if acc.Buckets["w"].Value() != 50 {
-		t.Errorf("Expected w bucket to have a value %v, but got %v", 50, acc.Buckets["w"].Value())
+	expected := `{"name":"bob","buckets":{},"leases":{"l":{"algorithm":"concurrency","value":4,"capacity":5}}}`
+	if string(data) != expected {
+		t.Errorf("Expected JSON %v, got %v", expected, string(data))
+	}
+}
+
+func Test_account_set(t *testing.T) {
+	acc := NewAccount("bob")
+	if err := acc.set("l", 5, 10); err != errNoBucket {
+		t.Errorf("Expected %v, got %v", errNoBucket, err)
+	}
+	useBucket(t, acc, "l", 100)
+	if err := acc.set("l", 5, 10); err != nil {
+		t.Errorf("Expected bucket to be set, got %v", err)
+	}
+	if state, _ := acc.state("l"); state.Value != 5 || state.Capacity != 10 {
+		t.Errorf("Expected bucket to be 5/10, got %v/%v", state.Value, state.Capacity)
+	}
+	if err := acc.set("l", 11, 10); err == nil {
+		t.Error("Expected value over capacity to error")
+	}
+}
+
+func Test_account_clear_buckets(t *testing.T) {
+	acc := NewAccount("bob")
+	useBucket(t, acc, "l", 100).dec(50, 100)
+	acc.concurrency("l", ClassPolicy{Capacity: 2}).Acquire()
+	acc.clearBuckets()
+	if len(acc.Buckets) != 0 {
+		t.Errorf("Expected buckets to be cleared, got %v", acc.Buckets)
 	}
-	if acc.Buckets["q"].Value() != 5 {
-		t.Errorf("Expected q bucket to have a value %v, but got %v", 5, acc.Buckets["q"].Value())
+	if len(acc.Leases) != 1 {
+		t.Errorf("Expected leases to be kept, got %v", acc.Leases)
 	}
 }
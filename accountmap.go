@@ -1,18 +1,20 @@
 package main
 
 import (
+	"slices"
+	"strings"
 	"sync"
 )
 
 // AccountMap models a map of Account structs and a Mutex to ensure thread-safety
 type AccountMap struct {
-	accounts map[string]Account
+	accounts map[string]*Account
 	mu       sync.RWMutex
 }
 
 // NewAccountMap creates a new AccountMap with an empty accounts map.
 func NewAccountMap() *AccountMap {
-	accounts := make(map[string]Account)
+	accounts := make(map[string]*Account)
 	am := AccountMap{
 		accounts: accounts,
 	}
@@ -22,7 +24,7 @@ func NewAccountMap() *AccountMap {
 // LoadOrStore fetches an Account from our map of accounts given its accountName. If
 // it doesn't exist, a new Account is created and added to the map. All the necessary
 // read and write locking is performed for thread-safety.
-func (am *AccountMap) LoadOrStore(accountName string) (Account, bool) {
+func (am *AccountMap) LoadOrStore(accountName string) (*Account, bool) {
 	newAccountCreated := false
 	am.mu.RLock()
 	acc, ok := am.accounts[accountName]
@@ -44,6 +46,45 @@ func (am *AccountMap) LoadOrStore(accountName string) (Account, bool) {
 	return acc, newAccountCreated
 }
 
+// Load fetches an Account from our map of accounts given its accountName, without
+// creating it if it doesn't exist.
+func (am *AccountMap) Load(accountName string) (*Account, bool) {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+	acc, ok := am.accounts[accountName]
+	return acc, ok
+}
+
+// Delete removes an Account from our map of accounts, returning false if it
+// doesn't exist. A later message for the account creates it afresh.
+func (am *AccountMap) Delete(accountName string) bool {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	if _, ok := am.accounts[accountName]; !ok {
+		return false
+	}
+	delete(am.accounts, accountName)
+	return true
+}
+
+// List returns, in order, up to limit of the account names that start with the
+// prefix and come after the name after, so that the accounts can be paged through.
+// more is true if there are further names to page through.
+func (am *AccountMap) List(prefix string, after string, limit int) (names []string, more bool) {
+	am.mu.RLock()
+	for name := range am.accounts {
+		if strings.HasPrefix(name, prefix) && name > after {
+			names = append(names, name)
+		}
+	}
+	am.mu.RUnlock()
+	slices.Sort(names)
+	if len(names) > limit {
+		return names[:limit], true
+	}
+	return names, false
+}
+
 // Reset iterates through our map of accounts, calling "reset" on each account,
 // which sets each bucket in each account back to their capacity.
 func (am *AccountMap) Reset() {
@@ -53,3 +94,14 @@ func (am *AccountMap) Reset() {
 	}
 	am.mu.RUnlock()
 }
+
+// ApplyPolicy iterates through our map of accounts, applying the policy to each
+// of their limiters. Each limiter's current value is kept, unless it exceeds
+// its new capacity.
+func (am *AccountMap) ApplyPolicy(p *Policy) {
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+	for _, acc := range am.accounts {
+		acc.applyPolicy(p)
+	}
+}
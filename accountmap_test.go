@@ -1,6 +1,9 @@
 package main
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func Test_account_map_new(t *testing.T) {
 	am := NewAccountMap()
@@ -32,31 +35,31 @@ func Test_account_map_LoadOrStore_add_missing(t *testing.T) {
 func Test_account_map_LoadOrStore_dedupe(t *testing.T) {
 	am := NewAccountMap()
 	am.LoadOrStore("bob")
-	am.accounts["bob"].Buckets["l"].dec(1, 100)
-	am.accounts["bob"].Buckets["w"].dec(1, 50)
-	am.accounts["bob"].Buckets["q"].dec(1, 5)
+	useBucket(t, am.accounts["bob"], "l", 100).dec(1, 100)
+	useBucket(t, am.accounts["bob"], "w", 50).dec(1, 50)
+	useBucket(t, am.accounts["bob"], "q", 5).dec(1, 5)
 	am.LoadOrStore("bob")
 	if len(am.accounts) != 1 {
 		t.Errorf("Expected accounts map to have length of 1, got %v", len(am.accounts))
 	}
 	// test we got the original account not a new one after fetching "bob" twice
-	if am.accounts["bob"].Buckets["l"].Capacity() != 100 {
-		t.Errorf("Expected account's bucket capacity to be 100, got %v", am.accounts["bob"].Buckets["l"].Capacity())
+	if am.accounts["bob"].Buckets["l"].(*Bucket).Capacity() != 100 {
+		t.Errorf("Expected account's bucket capacity to be 100, got %v", am.accounts["bob"].Buckets["l"].(*Bucket).Capacity())
 	}
-	if am.accounts["bob"].Buckets["w"].Capacity() != 50 {
-		t.Errorf("Expected account's bucket capacity to be 50, got %v", am.accounts["bob"].Buckets["w"].Capacity())
+	if am.accounts["bob"].Buckets["w"].(*Bucket).Capacity() != 50 {
+		t.Errorf("Expected account's bucket capacity to be 50, got %v", am.accounts["bob"].Buckets["w"].(*Bucket).Capacity())
 	}
-	if am.accounts["bob"].Buckets["q"].Capacity() != 5 {
-		t.Errorf("Expected account's bucket capacity to be 5, got %v", am.accounts["bob"].Buckets["q"].Capacity())
+	if am.accounts["bob"].Buckets["q"].(*Bucket).Capacity() != 5 {
+		t.Errorf("Expected account's bucket capacity to be 5, got %v", am.accounts["bob"].Buckets["q"].(*Bucket).Capacity())
 	}
-	if am.accounts["bob"].Buckets["l"].Value() != 99 {
-		t.Errorf("Expected account's bucket value to be 99, got %v", am.accounts["bob"].Buckets["l"].Value())
+	if am.accounts["bob"].Buckets["l"].(*Bucket).Value() != 99 {
+		t.Errorf("Expected account's bucket value to be 99, got %v", am.accounts["bob"].Buckets["l"].(*Bucket).Value())
 	}
-	if am.accounts["bob"].Buckets["w"].Value() != 49 {
-		t.Errorf("Expected account's bucket value to be 49, got %v", am.accounts["bob"].Buckets["w"].Value())
+	if am.accounts["bob"].Buckets["w"].(*Bucket).Value() != 49 {
+		t.Errorf("Expected account's bucket value to be 49, got %v", am.accounts["bob"].Buckets["w"].(*Bucket).Value())
 	}
-	if am.accounts["bob"].Buckets["q"].Value() != 4 {
-		t.Errorf("Expected account's bucket value to be 4, got %v", am.accounts["bob"].Buckets["q"].Value())
+	if am.accounts["bob"].Buckets["q"].(*Bucket).Value() != 4 {
+		t.Errorf("Expected account's bucket value to be 4, got %v", am.accounts["bob"].Buckets["q"].(*Bucket).Value())
 	}
 }
 
@@ -78,36 +81,118 @@ func Test_account_map_LoadOrStore_multi(t *testing.T) {
 func Test_account_map_reset(t *testing.T) {
 	am := NewAccountMap()
 	am.LoadOrStore("bob")
-	am.accounts["bob"].Buckets["l"].dec(1, 100)
-	am.accounts["bob"].Buckets["w"].dec(1, 50)
-	am.accounts["bob"].Buckets["q"].dec(1, 5)
+	useBucket(t, am.accounts["bob"], "l", 100).dec(1, 100)
+	useBucket(t, am.accounts["bob"], "w", 50).dec(1, 50)
+	useBucket(t, am.accounts["bob"], "q", 5).dec(1, 5)
 	am.LoadOrStore("rita")
-	am.accounts["rita"].Buckets["l"].dec(1, 100)
-	am.accounts["rita"].Buckets["w"].dec(1, 50)
-	am.accounts["rita"].Buckets["q"].dec(1, 5)
+	useBucket(t, am.accounts["rita"], "l", 100).dec(1, 100)
+	useBucket(t, am.accounts["rita"], "w", 50).dec(1, 50)
+	useBucket(t, am.accounts["rita"], "q", 5).dec(1, 5)
 	am.LoadOrStore("sue")
-	am.accounts["sue"].Buckets["l"].dec(1, 100)
-	am.accounts["sue"].Buckets["w"].dec(1, 50)
-	am.accounts["sue"].Buckets["q"].dec(1, 5)
+	useBucket(t, am.accounts["sue"], "l", 100).dec(1, 100)
+	useBucket(t, am.accounts["sue"], "w", 50).dec(1, 50)
+	useBucket(t, am.accounts["sue"], "q", 5).dec(1, 5)
 	am.Reset()
 	for accName, acc := range am.accounts {
-		if acc.Buckets["l"].Capacity() != 100 {
-			t.Errorf("Expected account %v to have %v capacity of %v, got %v", accName, "l", 100, acc.Buckets["l"].Capacity())
+		if acc.Buckets["l"].(*Bucket).Capacity() != 100 {
+			t.Errorf("Expected account %v to have %v capacity of %v, got %v", accName, "l", 100, acc.Buckets["l"].(*Bucket).Capacity())
 		}
-		if acc.Buckets["w"].Capacity() != 50 {
-			t.Errorf("Expected account %v to have %v capacity of %v, got %v", accName, "w", 50, acc.Buckets["w"].Capacity())
+		if acc.Buckets["w"].(*Bucket).Capacity() != 50 {
+			t.Errorf("Expected account %v to have %v capacity of %v, got %v", accName, "w", 50, acc.Buckets["w"].(*Bucket).Capacity())
 		}
-		if acc.Buckets["q"].Capacity() != 5 {
-			t.Errorf("Expected account %v to have %v capacity of %v, got %v", accName, "q", 5, acc.Buckets["q"].Capacity())
+		if acc.Buckets["q"].(*Bucket).Capacity() != 5 {
+			t.Errorf("Expected account %v to have %v capacity of %v, got %v", accName, "q", 5, acc.Buckets["q"].(*Bucket).Capacity())
 		}
-		if acc.Buckets["l"].Capacity() != acc.Buckets["l"].Value() {
-			t.Errorf("Expected account %v to have %v value same as its capacity, got %v", accName, "l", acc.Buckets["l"].Value())
+		if acc.Buckets["l"].(*Bucket).Capacity() != acc.Buckets["l"].(*Bucket).Value() {
+			t.Errorf("Expected account %v to have %v value same as its capacity, got %v", accName, "l", acc.Buckets["l"].(*Bucket).Value())
 		}
-		if acc.Buckets["w"].Capacity() != acc.Buckets["w"].Value() {
-			t.Errorf("Expected account %v to have %v value same as its capacity, got %v", accName, "w", acc.Buckets["w"].Value())
+		if acc.Buckets["w"].(*Bucket).Capacity() != acc.Buckets["w"].(*Bucket).Value() {
+			t.Errorf("Expected account %v to have %v value same as its capacity, got %v", accName, "w", acc.Buckets["w"].(*Bucket).Value())
 		}
-		if acc.Buckets["q"].Capacity() != acc.Buckets["q"].Value() {
-			t.Errorf("Expected account %v to have %v value same as its capacity, got %v", accName, "q", acc.Buckets["q"].Value())
+		if acc.Buckets["q"].(*Bucket).Capacity() != acc.Buckets["q"].(*Bucket).Value() {
+			t.Errorf("Expected account %v to have %v value same as its capacity, got %v", accName, "q", acc.Buckets["q"].(*Bucket).Value())
+		}
+	}
+}
+
+func Test_account_map_apply_policy(t *testing.T) {
+	am := NewAccountMap()
+	am.LoadOrStore("bob")
+	useBucket(t, am.accounts["bob"], "l", 100).dec(10, 100)
+	useBucket(t, am.accounts["bob"], "w", 50).dec(10, 50)
+	p := NewPolicy()
+	p.Mode = modeIgnore
+	p.Default["l"] = ClassPolicy{Capacity: 200}
+	p.Default["w"] = ClassPolicy{Capacity: 20}
+	p.Default["q"] = ClassPolicy{Capacity: 5}
+	am.ApplyPolicy(p)
+	acc := am.accounts["bob"]
+	if acc.Buckets["l"].(*Bucket).Capacity() != 200 || acc.Buckets["l"].(*Bucket).Value() != 90 {
+		t.Errorf("Expected l bucket to be 90/200, got %v/%v", acc.Buckets["l"].(*Bucket).Value(), acc.Buckets["l"].(*Bucket).Capacity())
+	}
+	if acc.Buckets["w"].(*Bucket).Capacity() != 20 || acc.Buckets["w"].(*Bucket).Value() != 20 {
+		t.Errorf("Expected w bucket to be 20/20, got %v/%v", acc.Buckets["w"].(*Bucket).Value(), acc.Buckets["w"].(*Bucket).Capacity())
+	}
+	// buckets are not created for unused classes
+	if _, ok := acc.Buckets["q"]; ok {
+		t.Error("Expected q bucket not to have been created")
+	}
+}
+
+func Test_account_map_Load(t *testing.T) {
+	am := NewAccountMap()
+	_, ok := am.Load("gb")
+	if ok {
+		t.Error("Expected missing account not to be found")
+	}
+	if len(am.accounts) != 0 {
+		t.Errorf("Expected account map to be %v length, got %v", 0, len(am.accounts))
+	}
+	stored, _ := am.LoadOrStore("gb")
+	acc, ok := am.Load("gb")
+	if !ok || acc != stored {
+		t.Error("Expected stored account to be found")
+	}
+}
+
+func Test_account_map_Delete(t *testing.T) {
+	am := NewAccountMap()
+	am.LoadOrStore("gb")
+	if !am.Delete("gb") {
+		t.Error("Expected stored account to be deleted")
+	}
+	if _, ok := am.Load("gb"); ok {
+		t.Error("Expected deleted account not to be found")
+	}
+	if am.Delete("gb") {
+		t.Error("Expected missing account not to be deleted")
+	}
+}
+
+func Test_account_map_List(t *testing.T) {
+	am := NewAccountMap()
+	for _, name := range []string{"team-b", "bob", "team-a", "team-c", "alice"} {
+		am.LoadOrStore(name)
+	}
+	tests := []struct {
+		prefix string
+		after  string
+		limit  int
+		names  string
+		more   bool
+	}{
+		{"", "", 10, "alice,bob,team-a,team-b,team-c", false},
+		{"", "", 2, "alice,bob", true},
+		{"", "bob", 2, "team-a,team-b", true},
+		{"", "team-b", 2, "team-c", false},
+		{"team-", "", 10, "team-a,team-b,team-c", false},
+		{"team-", "team-a", 1, "team-b", true},
+		{"carol", "", 10, "", false},
+	}
+	for _, test := range tests {
+		names, more := am.List(test.prefix, test.after, test.limit)
+		if strings.Join(names, ",") != test.names || more != test.more {
+			t.Errorf("Expected %q %v listing %q after %q, got %q %v", test.names, test.more, test.prefix, test.after, names, more)
 		}
 	}
 }
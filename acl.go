@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// forbiddenResponse is the reply to a message that the ACL doesn't permit, so that
+// it can be told apart from a message that was rate limited
+const forbiddenResponse = "f"
+
+// errForbidden is the error given to protocols that reply with errors
+var errForbidden = errors.New("forbidden by ACL")
+
+// ACLRule permits callers to use accounts. A rule applies to a caller that matches all
+// of its CIDR, TLS client Identity and signing KeyID that are set, permitting it to use
+// the Verbs on accounts matching any of the Accounts patterns, in which * matches any
+// characters. A rule without Verbs permits every verb. The CIDR is parsed into the
+// prefix when the rule is validated.
+type ACLRule struct {
+	CIDR     string   `json:"cidr,omitempty"`
+	Identity string   `json:"identity,omitempty"`
+	KeyID    string   `json:"keyId,omitempty"`
+	Accounts []string `json:"accounts"`
+	Verbs    []string `json:"verbs,omitempty"`
+	prefix   netip.Prefix
+}
+
+// validate checks that an ACLRule's CIDR can be parsed, keeping its prefix, and that
+// its verbs are known
+func (rule *ACLRule) validate() error {
+	if rule.CIDR != "" {
+		prefix, err := netip.ParsePrefix(rule.CIDR)
+		if err != nil {
+			return err
+		}
+		rule.prefix = prefix
+	}
+	if len(rule.Accounts) == 0 {
+		return errors.New("missing accounts")
+	}
+	for _, verb := range rule.Verbs {
+		if verb == verbBatch || !slices.Contains(verbs, verb) {
+			return fmt.Errorf("unknown verb %q", verb)
+		}
+	}
+	return nil
+}
+
+// applies returns whether an ACLRule applies to a Caller. A rule with a CIDR that
+// hasn't been validated doesn't apply to anyone.
+func (rule ACLRule) applies(caller Caller) bool {
+	if rule.CIDR != "" {
+		ip, ok := callerIP(caller.Addr)
+		if !ok || !rule.prefix.Contains(ip) {
+			return false
+		}
+	}
+	if rule.Identity != "" && rule.Identity != caller.Identity {
+		return false
+	}
+	if rule.KeyID != "" && rule.KeyID != caller.KeyID {
+		return false
+	}
+	return true
+}
+
+// permits returns whether an ACLRule permits a Message's verb and account
+func (rule ACLRule) permits(message *Message) bool {
+	if len(rule.Verbs) > 0 && !slices.Contains(rule.Verbs, message.verb) {
+		return false
+	}
+	return slices.ContainsFunc(rule.Accounts, func(pattern string) bool {
+		return globMatch(pattern, message.accountName)
+	})
+}
+
+// permits returns whether the policy's ACL lets a Caller send a Message. Without an
+// ACL, every Caller can send anything, otherwise a rule that applies to the Caller
+// must permit the Message.
+func (p *Policy) permits(caller Caller, message *Message) bool {
+	if len(p.ACL) == 0 {
+		return true
+	}
+	for _, rule := range p.ACL {
+		if rule.applies(caller) && rule.permits(message) {
+			return true
+		}
+	}
+	return false
+}
+
+// forbidden logs and counts a Message that the ACL doesn't permit
+func (s *Server) forbidden(protocol string, caller Caller, message *Message) Reply {
+	slog.Warn("Message forbidden by ACL", "protocol", protocol, "addr", caller.Addr, "identity", caller.Identity, "keyId", caller.KeyID,
+		"verb", message.verb, "account", message.accountName, "class", message.class)
+	s.met.messagesHandled.WithLabelValues(message.class, forbiddenResponse).Inc()
+	return Reply{Forbidden: true}
+}
+
+// callerIP is the IP address of a Caller's address, if it has one
+func callerIP(addr net.Addr) (netip.Addr, bool) {
+	var addrPort netip.AddrPort
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		addrPort = a.AddrPort()
+	case *net.TCPAddr:
+		addrPort = a.AddrPort()
+	default:
+		return netip.Addr{}, false
+	}
+	return addrPort.Addr().Unmap(), addrPort.IsValid()
+}
+
+// globMatch returns whether a name matches a pattern, in which * matches any characters
+func globMatch(pattern string, name string) bool {
+	first, rest, wildcard := strings.Cut(pattern, "*")
+	if !wildcard {
+		return pattern == name
+	}
+	if !strings.HasPrefix(name, first) {
+		return false
+	}
+	name = name[len(first):]
+	for {
+		// match the next literal part at its earliest, leaving the most for the rest
+		part, after, more := strings.Cut(rest, "*")
+		if !more {
+			return strings.HasSuffix(name, part) && len(name) >= len(part)
+		}
+		i := strings.Index(name, part)
+		if i < 0 {
+			return false
+		}
+		name = name[i+len(part):]
+		rest = after
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// aclServer creates a Server whose ACL lets 10.0.0.0/8 use the team-a accounts, the
+// billing TLS client use the billing account, and the k1 key only PEEK at anything
+func aclServer() *Server {
+	server := NewServer(8888, NewMetrics())
+	p := NewPolicy()
+	p.ACL = []ACLRule{
+		{CIDR: "10.0.0.0/8", Accounts: []string{"team-a-*"}},
+		{Identity: "billing", Accounts: []string{"billing"}},
+		{KeyID: "k1", Accounts: []string{"*"}, Verbs: []string{verbPeek}},
+	}
+	if err := p.validate(); err != nil {
+		panic(err)
+	}
+	server.SetPolicy(p)
+	return server
+}
+
+func Test_acl_glob_match(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"bob", "bob", true},
+		{"bob", "bobby", false},
+		{"*", "", true},
+		{"team-*", "team-a", true},
+		{"team-*", "tea", false},
+		{"*-prod", "api-prod", true},
+		{"*-prod", "api-prod-2", false},
+		{"a*b*c", "abc", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "axxcyyb", false},
+		{"a*a", "a", false},
+	}
+	for _, test := range tests {
+		if match := globMatch(test.pattern, test.name); match != test.match {
+			t.Errorf("Expected %v matching %v to be %v, got %v", test.pattern, test.name, test.match, match)
+		}
+	}
+}
+
+func Test_acl_permits(t *testing.T) {
+	p := aclServer().policy.Load()
+	inside := Caller{Addr: &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5000}}
+	outside := Caller{Addr: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5000}}
+	tests := []struct {
+		caller  Caller
+		verb    string
+		account string
+		permits bool
+	}{
+		{inside, verbAllow, "team-a-web", true},
+		{inside, verbAllow, "team-b-web", false},
+		{outside, verbAllow, "team-a-web", false},
+		{Caller{}, verbAllow, "team-a-web", false},
+		{Caller{Identity: "billing"}, verbAcquire, "billing", true},
+		{Caller{Identity: "billing"}, verbAllow, "team-a-web", false},
+		{Caller{KeyID: "k1"}, verbPeek, "anything", true},
+		{Caller{KeyID: "k1"}, verbAllow, "anything", false},
+	}
+	for _, test := range tests {
+		message := &Message{verb: test.verb, accountName: test.account, class: "l"}
+		if permits := p.permits(test.caller, message); permits != test.permits {
+			t.Errorf("Expected %+v %v %v to be permitted %v, got %v", test.caller, test.verb, test.account, test.permits, permits)
+		}
+	}
+
+	// a CIDR is only matched once the rule has been validated
+	rule := ACLRule{CIDR: "10.0.0.0/8", Accounts: []string{"*"}}
+	if rule.applies(inside) {
+		t.Error("Expected a rule that hasn't been validated not to apply")
+	}
+	if err := rule.validate(); err != nil || !rule.applies(inside) || rule.applies(outside) {
+		t.Errorf("Expected a validated rule to apply to %v only, got %v", "10.0.0.0/8", err)
+	}
+
+	// without an ACL, everything is permitted
+	if !NewPolicy().permits(Caller{}, &Message{verb: verbAllow, accountName: "bob", class: "l"}) {
+		t.Error("Expected everything to be permitted without an ACL")
+	}
+}
+
+func Test_acl_handle_message(t *testing.T) {
+	server := aclServer()
+	caller := Caller{Addr: &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5000}}
+	before := testutil.ToFloat64(server.met.messagesHandled.WithLabelValues("l", forbiddenResponse))
+
+	if reply := server.handleMessageFrom("UDP", caller, "team-a-web,l,10,1"); reply != "p" {
+		t.Errorf("Expected %v, got %v", "p", reply)
+	}
+	if reply := server.handleMessageFrom("UDP", caller, "team-b-web,l,10,1"); reply != forbiddenResponse {
+		t.Errorf("Expected %v, got %v", forbiddenResponse, reply)
+	}
+	// forbidden messages don't create accounts
+	if _, ok := server.accounts.Load("team-b-web"); ok {
+		t.Error("Expected a forbidden message not to create an account")
+	}
+	if reply := server.handleMessageFrom("UDP", caller, "v2 7 ALLOW team-b-web l 1 10"); reply != "v2 7 f" {
+		t.Errorf("Expected %v, got %v", "v2 7 f", reply)
+	}
+	if reply := server.handleMessageFrom("UDP", caller, "BATCH;team-a-web,l,1,10;team-b-web,l,1,10"); reply != "p;f" {
+		t.Errorf("Expected %v, got %v", "p;f", reply)
+	}
+	// none of an all-or-nothing batch is made if any of it is forbidden
+	if reply := server.handleMessageFrom("UDP", caller, "BATCH,all;team-a-web,l,1,10;team-b-web,l,1,10"); reply != "d;f" {
+		t.Errorf("Expected %v, got %v", "d;f", reply)
+	}
+	if reply := server.handleMessageFrom("UDP", caller, "PEEK,team-a-web,l"); reply != "8,10" {
+		t.Errorf("Expected %v, got %v", "8,10", reply)
+	}
+
+	after := testutil.ToFloat64(server.met.messagesHandled.WithLabelValues("l", forbiddenResponse))
+	if after != before+4 {
+		t.Errorf("Expected %v forbidden messages to be counted, got %v", 4, after-before)
+	}
+
+	// binary replies have a forbidden status
+	request := encodeRequest(1, &Message{verb: verbAllow, accountName: "team-b-web", class: "l", inc: 1, capacity: 10})
+	_, reply, err := decodeReply(server.handleBinary("UDP", caller, request))
+	if err != nil || !reply.Forbidden || reply.Permitted {
+		t.Errorf("Expected a forbidden reply, got %+v (%v)", reply, err)
+	}
+}
+
+func Test_acl_http(t *testing.T) {
+	server := aclServer()
+	// httptest requests come from 192.0.2.1, which isn't in the ACL
+	var httpErr httpError
+	response := httpDo(t, server, "POST", "/v1/allow", `{ "account": "team-a-web", "class": "l", "capacity": 10 }`, &httpErr)
+	if response.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status %v, got %v", http.StatusForbidden, response.StatusCode)
+	}
+
+	// whole accounts can't be read without PEEK permission either
+	server.handleMessageFrom("UDP", Caller{Addr: &net.UDPAddr{IP: net.ParseIP("10.1.2.3"), Port: 5000}}, "team-a-web,l,10,1")
+	response = httpDo(t, server, "GET", "/v1/accounts/team-a-web", "", &httpErr)
+	if response.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status %v, got %v", http.StatusForbidden, response.StatusCode)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultAdminPageSize is how many account names a page of the admin API's account
+// list has, unless the request asks for a different number, up to maxAdminPageSize
+const (
+	defaultAdminPageSize = 100
+	maxAdminPageSize     = 1000
+)
+
+// errUnauthorized is the error when an admin API request doesn't have the token
+var errUnauthorized = errors.New("missing or invalid bearer token")
+
+// adminAccounts is the JSON body of a page of the admin API's account list. If there
+// are more accounts, Next is the after parameter that fetches the next page.
+type adminAccounts struct {
+	Accounts []string `json:"accounts"`
+	Next     string   `json:"next,omitempty"`
+}
+
+// adminBucket is the JSON body of a request to set a bucket's value and capacity
+type adminBucket struct {
+	Value    int `json:"value"`
+	Capacity int `json:"capacity"`
+}
+
+// runAdminServer executes the admin API server, until the context is done, when
+// it stops accepting new requests and waits for those in flight to finish
+func (s *Server) runAdminServer(ctx context.Context) {
+	defer s.wg.Done()
+
+	addr := fmt.Sprintf(":%v", s.adminPort)
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           s.adminHandler(),
+		ReadHeaderTimeout: httpReadTimeout,
+		ReadTimeout:       httpReadTimeout,
+	}
+
+	go func() {
+		slog.Info("Admin API listening on " + addr)
+		if err := srv.ListenAndServe(); err != nil {
+			if errors.Is(err, http.ErrServerClosed) {
+				slog.Info("Admin server closed")
+				return
+			}
+			slog.Error("Admin server", "error", err)
+		}
+	}()
+
+	<-ctx.Done()
+	slog.Info("Closing admin server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+	srv.Shutdown(shutdownCtx)
+}
+
+// adminHandler routes the admin API's requests, each of which must have the token
+func (s *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/v1/accounts", s.adminList)
+	mux.HandleFunc("GET /admin/v1/accounts/{name}", s.adminAccount)
+	mux.HandleFunc("PUT /admin/v1/accounts/{name}/buckets/{class}", s.adminSet)
+	mux.HandleFunc("POST /admin/v1/accounts/{name}/reset", s.adminReset)
+	mux.HandleFunc("DELETE /admin/v1/accounts/{name}", s.adminDelete)
+	return s.adminAuth(mux)
+}
+
+// adminAuth replies with 401 Unauthorized to requests without the admin token as
+// their bearer token
+func (s *Server) adminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || s.adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) != 1 {
+			slog.Warn("Admin API request unauthorized", "addr", r.RemoteAddr, "method", r.Method, "path", r.URL.Path)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeError(w, http.StatusUnauthorized, errUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminList replies with a page of account names, in order, optionally only those
+// starting with the prefix parameter. The after parameter is the last name of the
+// previous page.
+func (s *Server) adminList(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := defaultAdminPageSize
+	if limitStr := query.Get("limit"); limitStr != "" {
+		l, err := strconv.Atoi(limitStr)
+		if err != nil || l < 1 || l > maxAdminPageSize {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", maxAdminPageSize))
+			return
+		}
+		limit = l
+	}
+	names, more := s.accounts.List(query.Get("prefix"), query.Get("after"), limit)
+	page := adminAccounts{Accounts: names}
+	if page.Accounts == nil {
+		page.Accounts = []string{}
+	}
+	if more {
+		page.Next = names[len(names)-1]
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// adminAccount replies with an account's buckets and leases, or 404 Not Found if
+// the account doesn't exist
+func (s *Server) adminAccount(w http.ResponseWriter, r *http.Request) {
+	acc, ok := s.accounts.Load(r.PathValue("name"))
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("no such account"))
+		return
+	}
+	writeJSON(w, http.StatusOK, acc)
+}
+
+// adminSet sets the value and capacity of an account's bucket, replying with the
+// account, or 404 Not Found if the account hasn't used the class
+func (s *Server) adminSet(w http.ResponseWriter, r *http.Request) {
+	var body adminBucket
+	if !readJSON(w, r, &body) {
+		return
+	}
+	name, class := r.PathValue("name"), r.PathValue("class")
+	acc, ok := s.accounts.Load(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("no such account"))
+		return
+	}
+	if err := acc.set(class, body.Value, body.Capacity); err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, errNoBucket) {
+			status = http.StatusNotFound
+		}
+		writeError(w, status, err)
+		return
+	}
+	slog.Info("Admin API set bucket", "addr", r.RemoteAddr, "account", name, "class", class, "value", body.Value, "capacity", body.Capacity)
+	writeJSON(w, http.StatusOK, acc)
+}
+
+// adminReset resets an account, so that each of its classes starts afresh at full
+// capacity, replying with 204 No Content, or 404 Not Found if it doesn't exist
+func (s *Server) adminReset(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	acc, ok := s.accounts.Load(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("no such account"))
+		return
+	}
+	acc.clearBuckets()
+	slog.Info("Admin API reset account", "addr", r.RemoteAddr, "account", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminDelete deletes an account, replying with 204 No Content, or 404 Not Found if
+// it doesn't exist
+func (s *Server) adminDelete(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if !s.accounts.Delete(name) {
+		writeError(w, http.StatusNotFound, errors.New("no such account"))
+		return
+	}
+	s.met.accountGauge.Dec()
+	slog.Info("Admin API deleted account", "addr", r.RemoteAddr, "account", name)
+	w.WriteHeader(http.StatusNoContent)
+}
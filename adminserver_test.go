@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// adminDo makes a request to the server's admin API with the token, decoding the
+// JSON response into v if it isn't nil
+func adminDo(t *testing.T, server *Server, token string, method string, path string, body string, v any) *http.Response {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	server.adminHandler().ServeHTTP(recorder, request)
+	response := recorder.Result()
+	if v != nil {
+		if err := json.NewDecoder(response.Body).Decode(v); err != nil {
+			t.Fatalf("Expected JSON response to %v %v, got %v", method, path, err)
+		}
+	}
+	return response
+}
+
+// adminServer creates a Server with the admin API turned on, and some accounts
+func adminServer(t *testing.T) *Server {
+	t.Helper()
+	server := NewServer(8888, NewMetrics())
+	if err := server.SetAdmin(9999, "s3cret"); err != nil {
+		t.Fatalf("Expected admin API to be turned on, got %v", err)
+	}
+	for _, message := range []string{"team-a,l,10,4", "team-b,l,10,1", "bob,w,5,1"} {
+		server.handleMessage("UDP", message)
+	}
+	return server
+}
+
+func Test_admin_auth(t *testing.T) {
+	server := adminServer(t)
+	for _, token := range []string{"", "wrong", "s3cret2"} {
+		response := adminDo(t, server, token, "GET", "/admin/v1/accounts", "", nil)
+		if response.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected status %v with token %q, got %v", http.StatusUnauthorized, token, response.StatusCode)
+		}
+		if response.Header.Get("WWW-Authenticate") == "" {
+			t.Error("Expected a WWW-Authenticate header")
+		}
+	}
+	if err := NewServer(8888, NewMetrics()).SetAdmin(9999, ""); err == nil {
+		t.Error("Expected the admin API to need a token")
+	}
+}
+
+func Test_admin_list(t *testing.T) {
+	server := adminServer(t)
+	var page adminAccounts
+	adminDo(t, server, "s3cret", "GET", "/admin/v1/accounts", "", &page)
+	if strings.Join(page.Accounts, ",") != "bob,team-a,team-b" || page.Next != "" {
+		t.Errorf("Expected every account, got %+v", page)
+	}
+
+	page = adminAccounts{}
+	adminDo(t, server, "s3cret", "GET", "/admin/v1/accounts?prefix=team-&limit=1", "", &page)
+	if strings.Join(page.Accounts, ",") != "team-a" || page.Next != "team-a" {
+		t.Errorf("Expected the first page of team accounts, got %+v", page)
+	}
+	next := page.Next
+	page = adminAccounts{}
+	adminDo(t, server, "s3cret", "GET", "/admin/v1/accounts?prefix=team-&limit=1&after="+next, "", &page)
+	if strings.Join(page.Accounts, ",") != "team-b" || page.Next != "" {
+		t.Errorf("Expected the second page of team accounts, got %+v", page)
+	}
+
+	response := adminDo(t, server, "s3cret", "GET", "/admin/v1/accounts?limit=0", "", nil)
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status %v, got %v", http.StatusBadRequest, response.StatusCode)
+	}
+}
+
+func Test_admin_account(t *testing.T) {
+	server := adminServer(t)
+	var acc struct {
+		Name    string                  `json:"name"`
+		Buckets map[string]LimiterState `json:"buckets"`
+	}
+	adminDo(t, server, "s3cret", "GET", "/admin/v1/accounts/team-a", "", &acc)
+	if acc.Name != "team-a" || acc.Buckets["l"].Value != 6 || acc.Buckets["l"].Capacity != 10 {
+		t.Errorf("Expected team-a with 6/10, got %+v", acc)
+	}
+	response := adminDo(t, server, "s3cret", "GET", "/admin/v1/accounts/carol", "", nil)
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status %v, got %v", http.StatusNotFound, response.StatusCode)
+	}
+}
+
+func Test_admin_set(t *testing.T) {
+	server := adminServer(t)
+	response := adminDo(t, server, "s3cret", "PUT", "/admin/v1/accounts/team-a/buckets/l", `{ "value": 0, "capacity": 10 }`, nil)
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("Expected status %v, got %v", http.StatusOK, response.StatusCode)
+	}
+	if reply := server.handleMessage("UDP", "team-a,l,10,1"); reply != "d" {
+		t.Errorf("Expected an emptied bucket to deny, got %v", reply)
+	}
+
+	tests := []struct {
+		path   string
+		body   string
+		status int
+	}{
+		{"/admin/v1/accounts/team-a/buckets/l", `{ "value": 11, "capacity": 10 }`, http.StatusBadRequest},
+		{"/admin/v1/accounts/team-a/buckets/l", `{ "value": "x" }`, http.StatusBadRequest},
+		{"/admin/v1/accounts/team-a/buckets/w", `{ "value": 1, "capacity": 10 }`, http.StatusNotFound},
+		{"/admin/v1/accounts/carol/buckets/l", `{ "value": 1, "capacity": 10 }`, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		response := adminDo(t, server, "s3cret", "PUT", test.path, test.body, nil)
+		if response.StatusCode != test.status {
+			t.Errorf("Expected status %v for %v %v, got %v", test.status, test.path, test.body, response.StatusCode)
+		}
+	}
+}
+
+func Test_admin_reset(t *testing.T) {
+	server := adminServer(t)
+	response := adminDo(t, server, "s3cret", "POST", "/admin/v1/accounts/team-a/reset", "", nil)
+	if response.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected status %v, got %v", http.StatusNoContent, response.StatusCode)
+	}
+	if reply := server.handleMessage("UDP", "PEEK,team-a,l"); reply != "0,0" {
+		t.Errorf("Expected a reset account to have no buckets, got %v", reply)
+	}
+	if reply := server.handleMessage("UDP", "team-a,l,10,1"); reply != "p" {
+		t.Errorf("Expected %v, got %v", "p", reply)
+	}
+	if reply := server.handleMessage("UDP", "PEEK,team-a,l"); reply != "9,10" {
+		t.Errorf("Expected a reset account to start at full capacity, got %v", reply)
+	}
+	response = adminDo(t, server, "s3cret", "POST", "/admin/v1/accounts/carol/reset", "", nil)
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status %v, got %v", http.StatusNotFound, response.StatusCode)
+	}
+}
+
+func Test_admin_delete(t *testing.T) {
+	server := adminServer(t)
+	before := testutil.ToFloat64(server.met.accountGauge)
+	response := adminDo(t, server, "s3cret", "DELETE", "/admin/v1/accounts/team-b", "", nil)
+	if response.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected status %v, got %v", http.StatusNoContent, response.StatusCode)
+	}
+	if after := testutil.ToFloat64(server.met.accountGauge); after != before-1 {
+		t.Errorf("Expected account gauge to be %v, got %v", before-1, after)
+	}
+	if _, ok := server.accounts.Load("team-b"); ok {
+		t.Error("Expected deleted account not to be found")
+	}
+	response = adminDo(t, server, "s3cret", "DELETE", "/admin/v1/accounts/team-b", "", nil)
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status %v, got %v", http.StatusNotFound, response.StatusCode)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// The binary protocol is a compact alternative to the text protocol for UDP clients.
+// Every frame starts with a magic byte, which can't start a text message, so the
+// two protocols are told apart by the first byte of each datagram. Integers are
+// unsigned varints (encoding/binary's Uvarint) in their shortest form, and strings are a varint length
+// followed by that many bytes.
+//
+// A request frame is:
+//
+//	magic    byte    0xB7
+//	version  byte    0x01
+//	length   varint  the number of bytes in the rest of the frame
+//	id       varint  request ID, chosen by the client and echoed in the reply
+//	verb     byte    1 ALLOW, 2 PEEK, 3 REFUND, 4 ACQUIRE, 5 RELEASE
+//	account  string
+//	class    string
+//	inc      varint  for ALLOW and REFUND, otherwise 0
+//	capacity varint  for ALLOW and ACQUIRE, or 0 to use the policy's capacity
+//	lease    string  for RELEASE, otherwise empty
+//
+// A reply frame is:
+//
+//	magic      byte    0xB7
+//	version    byte    0x01
+//	length     varint  the number of bytes in the rest of the frame
+//	id         varint  the request ID
+//	status     byte    0 denied, 1 permitted, 2 error, 3 forbidden by the ACL
+//	remaining  varint  the bucket's value
+//	capacity   varint  the bucket's capacity
+//	retryAfter varint  milliseconds until the request would be permitted, or 0
+//	lease      string  for ACQUIRE, otherwise empty
+const (
+	binaryMagic   = 0xB7
+	binaryVersion = 0x01
+)
+
+// maxFrameInt is the largest integer a frame can carry, so that it fits in an int
+// on 32-bit platforms too
+const maxFrameInt = 1<<31 - 1
+
+// binary reply statuses
+const (
+	statusDenied    = 0
+	statusPermitted = 1
+	statusError     = 2
+	statusForbidden = 3
+)
+
+// binaryVerbs maps the verb byte of a request frame to its verb
+var binaryVerbs = []string{"", verbAllow, verbPeek, verbRefund, verbAcquire, verbRelease}
+
+// errStatus is the error of a decoded reply with an error status
+var errStatus = errors.New("request errored")
+
+// isBinary returns whether a datagram is a binary frame, rather than a text message
+func isBinary(data []byte) bool {
+	return len(data) > 0 && data[0] == binaryMagic
+}
+
+// frameWriter builds the body of a frame
+type frameWriter []byte
+
+func (w *frameWriter) uvarint(v uint64) {
+	*w = binary.AppendUvarint(*w, v)
+}
+
+func (w *frameWriter) string(s string) {
+	w.uvarint(uint64(len(s)))
+	*w = append(*w, s...)
+}
+
+// frame wraps a body with the magic byte, version and length
+func frame(body []byte) []byte {
+	data := []byte{binaryMagic, binaryVersion}
+	data = binary.AppendUvarint(data, uint64(len(body)))
+	return append(data, body...)
+}
+
+// frameReader reads the body of a frame, remembering the first error
+type frameReader struct {
+	data []byte
+	err  error
+}
+
+func (r *frameReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	// each value has only one encoding, so that frames can be compared byte for byte
+	if n <= 0 || n != varintLen(v) {
+		r.err = errors.New("invalid varint in frame")
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// int reads a varint that must fit in an int
+func (r *frameReader) int() int {
+	v := r.uvarint()
+	if v > uint64(maxFrameInt) {
+		r.err = errors.New("integer in frame is too large")
+		return 0
+	}
+	return int(v)
+}
+
+func (r *frameReader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if len(r.data) == 0 {
+		r.err = errors.New("frame is too short")
+		return 0
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b
+}
+
+func (r *frameReader) string() string {
+	length := r.uvarint()
+	if r.err != nil {
+		return ""
+	}
+	if length > uint64(len(r.data)) {
+		r.err = errors.New("string in frame is too long")
+		return ""
+	}
+	s := string(r.data[:length])
+	r.data = r.data[length:]
+	return s
+}
+
+// varintLen is the number of bytes in the shortest encoding of v
+func varintLen(v uint64) int {
+	n := 1
+	for ; v >= 0x80; v >>= 7 {
+		n++
+	}
+	return n
+}
+
+// unframe checks the magic byte, version and length of a frame, returning a
+// reader for its body
+func unframe(data []byte) (*frameReader, error) {
+	if len(data) < 2 || data[0] != binaryMagic {
+		return nil, errors.New("frame must start with the magic byte")
+	}
+	if data[1] != binaryVersion {
+		return nil, errors.New("unsupported frame version")
+	}
+	r := frameReader{data: data[2:]}
+	length := r.uvarint()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if length != uint64(len(r.data)) {
+		return nil, errors.New("frame length doesn't match its contents")
+	}
+	return &r, nil
+}
+
+// encodeRequest encodes a Message as a request frame
+func encodeRequest(id uint64, message *Message) []byte {
+	var w frameWriter
+	w.uvarint(id)
+	verb := 0
+	for i, v := range binaryVerbs {
+		if v == message.verb {
+			verb = i
+		}
+	}
+	w = append(w, byte(verb))
+	w.string(message.accountName)
+	w.string(message.class)
+	w.uvarint(uint64(message.inc))
+	w.uvarint(uint64(message.capacity))
+	w.string(message.lease)
+	return frame(w)
+}
+
+// decodeRequest decodes a request frame, returning its request ID and Message.
+// The request ID is returned as long as the frame gets that far, so that an
+// error can be replied to. The Message's fields are checked by validate.
+func decodeRequest(data []byte) (uint64, *Message, error) {
+	r, err := unframe(data)
+	if err != nil {
+		return 0, nil, err
+	}
+	id := r.uvarint()
+	if r.err != nil {
+		return 0, nil, r.err
+	}
+	verb := int(r.byte())
+	message := Message{
+		accountName: r.string(),
+		class:       r.string(),
+		inc:         r.int(),
+		capacity:    r.int(),
+		lease:       r.string(),
+	}
+	if r.err != nil {
+		return id, nil, r.err
+	}
+	if len(r.data) != 0 {
+		return id, nil, errors.New("frame has trailing bytes")
+	}
+	if verb == 0 || verb >= len(binaryVerbs) {
+		return id, nil, errors.New("unknown verb in frame")
+	}
+	message.verb = binaryVerbs[verb]
+	return id, &message, nil
+}
+
+// encodeReply encodes a Reply as a reply frame
+func encodeReply(id uint64, reply Reply) []byte {
+	var w frameWriter
+	w.uvarint(id)
+	switch {
+	case reply.Err != nil:
+		w = append(w, statusError)
+	case reply.Forbidden:
+		w = append(w, statusForbidden)
+	case reply.Permitted:
+		w = append(w, statusPermitted)
+	default:
+		w = append(w, statusDenied)
+	}
+	w.uvarint(uint64(max(reply.Remaining, 0)))
+	w.uvarint(uint64(max(reply.Capacity, 0)))
+	// long windows can be longer than a frame can carry in milliseconds
+	w.uvarint(uint64(min(milliseconds(reply.RetryAfter), maxFrameInt)))
+	w.string(reply.Lease)
+	return frame(w)
+}
+
+// decodeReply decodes a reply frame, returning its request ID and Reply. A reply
+// with an error status has an Err of errStatus, and one with a forbidden status is Forbidden.
+func decodeReply(data []byte) (uint64, Reply, error) {
+	r, err := unframe(data)
+	if err != nil {
+		return 0, Reply{}, err
+	}
+	id := r.uvarint()
+	status := r.byte()
+	reply := Reply{
+		Decision: Decision{
+			Permitted: status == statusPermitted,
+			Remaining: r.int(),
+			Capacity:  r.int(),
+		},
+	}
+	reply.RetryAfter = time.Duration(r.int()) * time.Millisecond
+	reply.Lease = r.string()
+	if r.err != nil {
+		return 0, Reply{}, r.err
+	}
+	if len(r.data) != 0 {
+		return 0, Reply{}, errors.New("frame has trailing bytes")
+	}
+	if status > statusForbidden {
+		return 0, Reply{}, errors.New("unknown status in frame")
+	}
+	if status == statusError {
+		reply.Err = errStatus
+	}
+	reply.Forbidden = status == statusForbidden
+	return id, reply, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_binary_request_round_trip(t *testing.T) {
+	messages := []Message{
+		{verb: verbAllow, accountName: "gb", class: "l", inc: 1, capacity: 10},
+		{verb: verbPeek, accountName: "an account name that is much longer than the old 128 byte buffer would have allowed, which truncated it silently", class: "w"},
+		{verb: verbRelease, accountName: "gb", class: "q", lease: "abc123"},
+	}
+	for _, message := range messages {
+		data := encodeRequest(42, &message)
+		if !isBinary(data) {
+			t.Errorf("Expected frame to be detected as binary, got %v", data)
+		}
+		id, decoded, err := decodeRequest(data)
+		if err != nil {
+			t.Fatalf("Expected no error decoding request, got %v", err)
+		}
+		if id != 42 {
+			t.Errorf("Expected id to be %v, got %v", 42, id)
+		}
+		if !reflect.DeepEqual(*decoded, message) {
+			t.Errorf("Expected message to be %v, got %v", message, *decoded)
+		}
+	}
+}
+
+func Test_binary_request_invalid(t *testing.T) {
+	valid := encodeRequest(1, &Message{verb: verbAllow, accountName: "gb", class: "l", inc: 1})
+	invalid := [][]byte{
+		{},
+		[]byte("gb,l,10,1"),
+		{binaryMagic, 2, 0},
+		append(valid[:len(valid):len(valid)], 0),
+		valid[:len(valid)-1],
+		frame([]byte{1, 9, 2, 'g', 'b', 1, 'l', 1, 0, 0}),
+	}
+	for _, data := range invalid {
+		if _, _, err := decodeRequest(data); err == nil {
+			t.Errorf("Expected error decoding %v, got nil", data)
+		}
+	}
+}
+
+func Test_binary_reply_round_trip(t *testing.T) {
+	replies := []Reply{
+		{Decision: Decision{Permitted: true, Remaining: 9, Capacity: 10}},
+		{Decision: Decision{Remaining: 0, Capacity: 10, RetryAfter: 250 * time.Millisecond}},
+		{Decision: Decision{Permitted: true}, Lease: "abc123"},
+	}
+	for _, reply := range replies {
+		id, decoded, err := decodeReply(encodeReply(7, reply))
+		if err != nil {
+			t.Fatalf("Expected no error decoding reply, got %v", err)
+		}
+		if id != 7 {
+			t.Errorf("Expected id to be %v, got %v", 7, id)
+		}
+		if !reflect.DeepEqual(decoded, reply) {
+			t.Errorf("Expected reply to be %v, got %v", reply, decoded)
+		}
+	}
+	// retry-afters too long for a frame are capped, e.g. for a monthly limit
+	_, decoded, err := decodeReply(encodeReply(7, Reply{Decision: Decision{RetryAfter: 30 * 24 * time.Hour}}))
+	if err != nil || decoded.RetryAfter != maxFrameInt*time.Millisecond {
+		t.Errorf("Expected retry-after to be capped at %v, got %v (%v)", maxFrameInt*time.Millisecond, decoded.RetryAfter, err)
+	}
+	_, decoded, _ = decodeReply(encodeReply(7, Reply{Err: errors.New("no policy for account and class")}))
+	if decoded.Err != errStatus {
+		t.Errorf("Expected error status, got %v", decoded.Err)
+	}
+}
+
+func Test_binary_server(t *testing.T) {
+	met := NewMetrics()
+	server := NewServer(8888, met)
+	request := encodeRequest(3, &Message{verb: verbAllow, accountName: "gb", class: "l", inc: 1, capacity: 2})
+	id, reply, err := decodeReply(server.handleBinary("test", Caller{}, request))
+	if err != nil || id != 3 {
+		t.Fatalf("Expected reply to request %v, got %v (%v)", 3, id, err)
+	}
+	if !reply.Permitted || reply.Remaining != 1 || reply.Capacity != 2 {
+		t.Errorf("Expected permitted 1/2, got %v %v/%v", reply.Permitted, reply.Remaining, reply.Capacity)
+	}
+	// binary and text clients use the same buckets
+	if server.handleMessage("test", "PEEK,gb,l") != "1,2" {
+		t.Error("Expected text client to see the binary client's bucket")
+	}
+	request = encodeRequest(4, &Message{verb: verbAllow, accountName: "gb", class: "x", inc: 1, capacity: 2})
+	id, reply, _ = decodeReply(server.handleBinary("test", Caller{}, request))
+	if id != 4 || reply.Err != errStatus {
+		t.Errorf("Expected error reply to request %v, got %v %v", 4, id, reply.Err)
+	}
+}
+
+func Fuzz_binary_decode_request(f *testing.F) {
+	f.Add(encodeRequest(1, &Message{verb: verbAllow, accountName: "gb", class: "l", inc: 1, capacity: 10}))
+	f.Add(encodeRequest(1<<40, &Message{verb: verbRelease, accountName: "gb", class: "q", lease: "abc123"}))
+	f.Add([]byte{binaryMagic, binaryVersion, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		id, message, err := decodeRequest(data)
+		if err != nil {
+			return
+		}
+		// anything that decodes must encode back to the same frame
+		encoded := encodeRequest(id, message)
+		if string(encoded) != string(data) {
+			t.Errorf("Expected %v to encode back to itself, got %v", data, encoded)
+		}
+	})
+}
+
+func Fuzz_binary_decode_reply(f *testing.F) {
+	f.Add(encodeReply(1, Reply{Decision: Decision{Permitted: true, Remaining: 9, Capacity: 10}}))
+	f.Add(encodeReply(2, Reply{Decision: Decision{RetryAfter: time.Second}, Lease: "abc123"}))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		id, reply, err := decodeReply(data)
+		if err != nil || reply.Err != nil {
+			return
+		}
+		encoded := encodeReply(id, reply)
+		if string(encoded) != string(data) {
+			t.Errorf("Expected %v to encode back to itself, got %v", data, encoded)
+		}
+	})
+}
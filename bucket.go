@@ -10,12 +10,21 @@ import (
 // it's current size). It is "reset" periodically, which puts the value equal to the capacity.
 // When the Bucket is "dec"'d the Value is decremented by another number - in this operation,
 // there is an opportunity to first set or subsequently set the bucket's capacity too.
+// Bucket is the Limiter for the fixed window algorithm.
 type Bucket struct {
 	value    int
 	capacity int
 	mu       sync.RWMutex
 }
 
+// NewFixedWindow creates a full Bucket with the ClassPolicy's capacity
+func NewFixedWindow(cp ClassPolicy) Limiter {
+	return &Bucket{
+		value:    cp.Capacity,
+		capacity: cp.Capacity,
+	}
+}
+
 // dec decrements the Bucket's value by "by", or returns false if there isn't enough value left.
 // The return value indicates whether there was enough value left in the bucket
 // to decrement. Some scenarios:
@@ -45,6 +54,64 @@ func (b *Bucket) dec(by int, capacity int) bool {
 	return false
 }
 
+// Allow is "dec" using the bucket's own capacity. A fixed window doesn't
+// know when it will next be reset, so never has a RetryAfter, but its denials
+// reset unless n is more than its capacity.
+func (b *Bucket) Allow(n int) Decision {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.allowLocked(n)
+}
+
+// Peek returns the Decision that Allow would make, without changing the bucket
+func (b *Bucket) Peek(n int) Decision {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.decide(n)
+}
+
+// lock and unlock hold the bucket's lock for a transaction
+func (b *Bucket) lock()   { b.mu.Lock() }
+func (b *Bucket) unlock() { b.mu.Unlock() }
+
+// peekLocked is Peek, for when the lock is already held
+func (b *Bucket) peekLocked(n int) Decision {
+	return b.decide(n)
+}
+
+// allowLocked is Allow, for when the lock is already held
+func (b *Bucket) allowLocked(n int) Decision {
+	d := b.decide(n)
+	if d.Permitted {
+		b.value -= n
+		d.Remaining = b.value
+	}
+	return d
+}
+
+// decide works out whether there is enough value left in the bucket for n.
+// It must be called with the lock held.
+func (b *Bucket) decide(n int) Decision {
+	return Decision{
+		Permitted: n > 0 && b.value >= n,
+		Remaining: b.value,
+		Capacity:  b.capacity,
+		resets:    n <= b.capacity,
+	}
+}
+
+// Refund adds n back to the bucket's value, up to its capacity
+func (b *Bucket) Refund(n int) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n <= 0 {
+		return 0
+	}
+	refunded := min(n, b.capacity-b.value)
+	b.value += refunded
+	return refunded
+}
+
 // reset sets the Value of the bucket to its Capacity
 func (b *Bucket) reset() {
 	b.mu.Lock()
@@ -52,6 +119,11 @@ func (b *Bucket) reset() {
 	b.value = b.capacity
 }
 
+// Reset is "reset", which fixed windows need every refreshInterval
+func (b *Bucket) Reset() {
+	b.reset()
+}
+
 // set sets the value and capacity of the bucket
 func (b *Bucket) set(value int, capacity int) error {
 	if value < 0 || capacity < 0 {
@@ -67,6 +139,30 @@ func (b *Bucket) set(value int, capacity int) error {
 	return nil
 }
 
+// SetLimit changes the capacity of the bucket, keeping its current value
+// unless that exceeds the new capacity. A bucket that has never been used
+// is filled to its new capacity.
+func (b *Bucket) SetLimit(cp ClassPolicy) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.capacity == 0 {
+		b.value = cp.Capacity
+	}
+	b.capacity = cp.Capacity
+	b.value = min(b.value, b.capacity)
+}
+
+// State returns the bucket's value and capacity
+func (b *Bucket) State() LimiterState {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return LimiterState{
+		Algorithm: algorithmFixed,
+		Value:     b.value,
+		Capacity:  b.capacity,
+	}
+}
+
 // Value returns the unexported value attribute
 func (b *Bucket) Value() int {
 	b.mu.RLock()
@@ -83,15 +179,5 @@ func (b *Bucket) Capacity() int {
 
 // MarshalJSON returns a JSON representation of the bucket's capacity and value
 func (b *Bucket) MarshalJSON() ([]byte, error) {
-	b.mu.RLock()
-	defer b.mu.RUnlock()
-	type Alias struct {
-		Value    int `json:"value"`
-		Capacity int `json:"capacity"`
-	}
-
-	return json.Marshal(Alias{
-		Value:    b.value,
-		Capacity: b.capacity,
-	})
+	return json.Marshal(b.State())
 }
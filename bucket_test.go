@@ -95,3 +95,69 @@ func Test_bucket_reset(t *testing.T) {
 		t.Errorf("Expected bucket Value to be 10, got %d", bucket.Value())
 	}
 }
+
+func Test_bucket_set_limit(t *testing.T) {
+	bucket := &Bucket{}
+	bucket.set(5, 10)
+	bucket.SetLimit(ClassPolicy{Algorithm: algorithmFixed, Capacity: 20})
+	if bucket.Value() != 5 {
+		t.Errorf("Expected bucket Value to remain 5, got %d", bucket.Value())
+	}
+	if bucket.Capacity() != 20 {
+		t.Errorf("Expected bucket Capacity to be 20, got %d", bucket.Capacity())
+	}
+	bucket.SetLimit(ClassPolicy{Algorithm: algorithmFixed, Capacity: 3})
+	if bucket.Value() != 3 {
+		t.Errorf("Expected bucket Value to be 3, got %d", bucket.Value())
+	}
+}
+
+func Test_bucket_set_limit_unused(t *testing.T) {
+	bucket := &Bucket{}
+	bucket.SetLimit(ClassPolicy{Algorithm: algorithmFixed, Capacity: 20})
+	if bucket.Value() != 20 {
+		t.Errorf("Expected unused bucket Value to be filled to 20, got %d", bucket.Value())
+	}
+}
+
+func Test_bucket_allow(t *testing.T) {
+	bucket := NewFixedWindow(ClassPolicy{Algorithm: algorithmFixed, Capacity: 10})
+	d := bucket.Allow(4)
+	if !d.Permitted || d.Remaining != 6 || d.Capacity != 10 {
+		t.Errorf("Expected permitted decision with 6/10 remaining, got %+v", d)
+	}
+	d = bucket.Peek(7)
+	if d.Permitted || d.Remaining != 6 {
+		t.Errorf("Expected denied peek with 6 remaining, got %+v", d)
+	}
+	d = bucket.Allow(7)
+	if d.Permitted || d.Remaining != 6 {
+		t.Errorf("Expected denied decision with 6 remaining, got %+v", d)
+	}
+	bucket.Reset()
+	state := bucket.State()
+	if state.Algorithm != algorithmFixed || state.Value != 10 || state.Capacity != 10 {
+		t.Errorf("Expected state to be fixed 10/10, got %+v", state)
+	}
+}
+
+func Test_bucket_refund(t *testing.T) {
+	b := NewFixedWindow(ClassPolicy{Capacity: 10}).(*Bucket)
+	b.Allow(6)
+	if refunded := b.Refund(2); refunded != 2 {
+		t.Errorf("Expected refunded to be %v, got %v", 2, refunded)
+	}
+	if b.Value() != 6 {
+		t.Errorf("Expected bucket value to be %v, got %v", 6, b.Value())
+	}
+	// refunds are capped at the capacity
+	if refunded := b.Refund(100); refunded != 4 {
+		t.Errorf("Expected refunded to be %v, got %v", 4, refunded)
+	}
+	if b.Value() != 10 {
+		t.Errorf("Expected bucket value to be %v, got %v", 10, b.Value())
+	}
+	if refunded := b.Refund(-1); refunded != 0 {
+		t.Errorf("Expected refunded to be %v, got %v", 0, refunded)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/x509"
+	"net"
+)
+
+// Caller is who sent a message, as far as the listener it arrived on can tell. Addr
+// is the client's address, if it has one, Identity is the identity of its TLS
+// client certificate, if it presented one, and KeyID is the key that it signed
+// the message with, if it was signed.
+type Caller struct {
+	Addr     net.Addr
+	Identity string
+	KeyID    string
+}
+
+// certIdentity is the identity of a client certificate, which is its subject's common
+// name or, if it doesn't have one, its first DNS, email or URI subject alternative name
+func certIdentity(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.EmailAddresses) > 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return ""
+}
+
+// bindAccount replaces the account names in a Message with the Caller's identity,
+// if the server uses TLS client identities as account names, so that clients can
+// only use their own accounts
+func (s *Server) bindAccount(caller Caller, message *Message) {
+	if !s.identityAccounts || caller.Identity == "" {
+		return
+	}
+	message.accountName = caller.Identity
+	for _, request := range message.batch {
+		request.accountName = caller.Identity
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// the exit codes of the client commands, so that scripts can tell what happened
+const (
+	exitOK       = 0 // success, or a check that was permitted
+	exitDenied   = 1 // a check that was rate limited
+	exitUsage    = 2 // bad arguments
+	exitError    = 3 // the server couldn't be reached, or failed
+	exitNotFound = 4 // no such account
+	exitRefused  = 5 // forbidden by the ACL, rejected as unsigned or invalid, or a bad admin token
+)
+
+// defaultClientTimeout is how long a client command waits for each reply
+const defaultClientTimeout = 2 * time.Second
+
+// command is a goudpserver subcommand, which returns its exit code
+type command struct {
+	summary string
+	run     func(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) int
+}
+
+// commands are the goudpserver subcommands. Every command but serve talks to a
+// running server, over the text protocol or the admin API.
+var commands = map[string]command{
+	"serve":   {"run the server, configured by environment variables (the default)", runServe},
+	"check":   {"ask the server to allow a request, or peek at a bucket", runCheck},
+	"inspect": {"show an account's buckets and leases, using the admin API", runInspect},
+	"reset":   {"reset an account's buckets, using the admin API", runReset},
+	"list":    {"list the accounts, using the admin API", runList},
+	"bench":   {"measure the server's throughput and latency", runBench},
+}
+
+// runCommand runs the subcommand named by the first argument, or serve if there
+// isn't one, returning its exit code
+func runCommand(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 {
+		return runServe(ctx, args, stdout, stderr)
+	}
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		usage(stdout)
+		return exitOK
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "goudpserver: unknown command %q\n\n", args[0])
+		usage(stderr)
+		return exitUsage
+	}
+	return cmd.run(ctx, args[1:], stdout, stderr)
+}
+
+// usage writes the list of subcommands and exit codes
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: goudpserver <command> [flags] [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, name := range slices.Sorted(maps.Keys(commands)) {
+		fmt.Fprintf(tw, "  %s\t%s\n", name, commands[name].summary)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run 'goudpserver <command> -h' for a command's flags.")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Exit codes: 0 ok or permitted, 1 rate limited, 2 bad arguments, 3 server error,")
+	fmt.Fprintln(w, "4 account not found, 5 forbidden or refused")
+}
+
+// runServe runs the server until it is interrupted
+func runServe(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: goudpserver serve")
+		fmt.Fprintln(stderr, "The server is configured by environment variables, see the README.")
+	}
+	if code, ok := parseFlags(fs, args, 0); !ok {
+		return code
+	}
+	serve(ctx)
+	return exitOK
+}
+
+// runCheck sends an ALLOW, or a PEEK, for an account's bucket and prints the decision
+func runCheck(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("check", flag.ContinueOnError)
+	pc, tcp := protocolFlags(fs)
+	inc := fs.Int("inc", 1, "how much to take from the bucket")
+	capacity := fs.Int("capacity", 0, "the bucket's capacity (default from the policy)")
+	peek := fs.Bool("peek", false, "look at the bucket without taking from it")
+	jsonOutput := fs.Bool("json", false, "print JSON")
+	setUsage(fs, stderr, "check [flags] <account> <class>")
+	if code, ok := parseFlags(fs, args, 2); !ok {
+		return code
+	}
+	if *tcp {
+		pc.network = "tcp"
+	}
+	defer pc.Close()
+
+	account, class := fs.Arg(0), fs.Arg(1)
+	var result checkResult
+	var err error
+	if *peek {
+		result, err = pc.peek(account, class)
+	} else {
+		result, err = pc.allow(account, class, *inc, *capacity)
+	}
+	if err != nil {
+		return fail(stderr, "check", err)
+	}
+
+	if *jsonOutput {
+		printJSON(stdout, result)
+	} else {
+		switch {
+		case result.Forbidden:
+			fmt.Fprintf(stdout, "%s %s: forbidden by ACL\n", account, class)
+		case *peek:
+			fmt.Fprintf(stdout, "%s %s: %d of %d remaining\n", account, class, result.Remaining, result.Capacity)
+		case result.Permitted:
+			fmt.Fprintf(stdout, "%s %s: permitted, %d of %d remaining\n", account, class, result.Remaining, result.Capacity)
+		default:
+			fmt.Fprintf(stdout, "%s %s: denied, %d of %d remaining, retry after %dms\n", account, class, result.Remaining, result.Capacity, result.RetryAfterMs)
+		}
+	}
+	switch {
+	case result.Forbidden:
+		return exitRefused
+	case !*peek && !result.Permitted:
+		return exitDenied
+	}
+	return exitOK
+}
+
+// runInspect prints an account's buckets and leases
+func runInspect(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	ac := adminFlags(fs)
+	jsonOutput := fs.Bool("json", false, "print JSON")
+	setUsage(fs, stderr, "inspect [flags] <account>")
+	if code, ok := parseFlags(fs, args, 1); !ok {
+		return code
+	}
+
+	acc, err := ac.account(fs.Arg(0))
+	if err != nil {
+		return fail(stderr, "inspect", err)
+	}
+	if *jsonOutput {
+		printJSON(stdout, acc)
+		return exitOK
+	}
+
+	fmt.Fprintf(stdout, "account %s\n", acc.Name)
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tCLASS\tALGORITHM\tVALUE\tCAPACITY")
+	for _, class := range slices.Sorted(maps.Keys(acc.Buckets)) {
+		state := acc.Buckets[class]
+		fmt.Fprintf(tw, "bucket\t%s\t%s\t%d\t%d\n", class, state.Algorithm, state.Value, state.Capacity)
+		for _, limit := range state.Limits {
+			fmt.Fprintf(tw, "limit\t%s\t%s\t%d\t%d\n", class, limit.Algorithm, limit.Value, limit.Capacity)
+		}
+	}
+	for _, class := range slices.Sorted(maps.Keys(acc.Leases)) {
+		state := acc.Leases[class]
+		fmt.Fprintf(tw, "lease\t%s\t%s\t%d\t%d\n", class, state.Algorithm, state.Value, state.Capacity)
+	}
+	tw.Flush()
+	return exitOK
+}
+
+// runReset resets an account's buckets, so that each class starts afresh
+func runReset(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("reset", flag.ContinueOnError)
+	ac := adminFlags(fs)
+	jsonOutput := fs.Bool("json", false, "print JSON")
+	setUsage(fs, stderr, "reset [flags] <account>")
+	if code, ok := parseFlags(fs, args, 1); !ok {
+		return code
+	}
+
+	name := fs.Arg(0)
+	if err := ac.reset(name); err != nil {
+		return fail(stderr, "reset", err)
+	}
+	if *jsonOutput {
+		printJSON(stdout, map[string]any{"account": name, "reset": true})
+	} else {
+		fmt.Fprintf(stdout, "account %s reset\n", name)
+	}
+	return exitOK
+}
+
+// runList prints the account names, fetching every page from the admin API
+func runList(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	ac := adminFlags(fs)
+	prefix := fs.String("prefix", "", "only list the accounts starting with this")
+	after := fs.String("after", "", "only list the accounts after this one")
+	limit := fs.Int("limit", 0, "list at most this many accounts (default all)")
+	jsonOutput := fs.Bool("json", false, "print JSON")
+	setUsage(fs, stderr, "list [flags]")
+	if code, ok := parseFlags(fs, args, 0); !ok {
+		return code
+	}
+	if *limit < 0 {
+		fmt.Fprintln(stderr, "goudpserver list: -limit cannot be negative")
+		return exitUsage
+	}
+
+	listed := adminAccounts{Accounts: []string{}, Next: *after}
+	for {
+		pageSize := maxAdminPageSize
+		if *limit > 0 {
+			pageSize = min(*limit-len(listed.Accounts), maxAdminPageSize)
+		}
+		page, err := ac.list(*prefix, listed.Next, pageSize)
+		if err != nil {
+			return fail(stderr, "list", err)
+		}
+		listed.Accounts = append(listed.Accounts, page.Accounts...)
+		listed.Next = page.Next
+		if listed.Next == "" || len(listed.Accounts) == *limit {
+			break
+		}
+	}
+
+	if *jsonOutput {
+		printJSON(stdout, listed)
+		return exitOK
+	}
+	for _, name := range listed.Accounts {
+		fmt.Fprintln(stdout, name)
+	}
+	if listed.Next != "" {
+		fmt.Fprintf(stderr, "more accounts after %s\n", listed.Next)
+	}
+	return exitOK
+}
+
+// benchResult is the outcome of a benchmark
+type benchResult struct {
+	Requests   int     `json:"requests"`
+	Permitted  int     `json:"permitted"`
+	Denied     int     `json:"denied"`
+	Forbidden  int     `json:"forbidden"`
+	Errors     int     `json:"errors"`
+	DurationMs float64 `json:"durationMs"`
+	PerSecond  float64 `json:"perSecond"`
+	P50Ms      float64 `json:"p50Ms"`
+	P90Ms      float64 `json:"p90Ms"`
+	P99Ms      float64 `json:"p99Ms"`
+	MaxMs      float64 `json:"maxMs"`
+}
+
+// runBench sends ALLOW messages for an account's bucket from several connections at
+// once, printing the throughput, latencies and decisions
+func runBench(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	pc, tcp := protocolFlags(fs)
+	requests := fs.Int("n", 1000, "how many requests to send")
+	connections := fs.Int("c", 10, "how many connections to send them from at once")
+	inc := fs.Int("inc", 1, "how much each request takes from the bucket")
+	capacity := fs.Int("capacity", 0, "the bucket's capacity (default from the policy)")
+	jsonOutput := fs.Bool("json", false, "print JSON")
+	setUsage(fs, stderr, "bench [flags] <account> <class>")
+	if code, ok := parseFlags(fs, args, 2); !ok {
+		return code
+	}
+	if *tcp {
+		pc.network = "tcp"
+	}
+	if *requests < 1 || *connections < 1 {
+		fmt.Fprintln(stderr, "goudpserver bench: -n and -c must be at least 1")
+		return exitUsage
+	}
+
+	account, class := fs.Arg(0), fs.Arg(1)
+	latencies := make([]time.Duration, *requests)
+	var next atomic.Int64
+	var permitted, denied, forbidden, errored atomic.Int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for range min(*connections, *requests) {
+		client := *pc
+		wg.Go(func() {
+			defer client.Close()
+			for ctx.Err() == nil {
+				i := int(next.Add(1)) - 1
+				if i >= *requests {
+					return
+				}
+				sent := time.Now()
+				result, err := client.allow(account, class, *inc, *capacity)
+				latencies[i] = time.Since(sent)
+				switch {
+				case err != nil:
+					errored.Add(1)
+					// start again on a new connection, in case this one is broken
+					client.Close()
+					client.conn = nil
+				case result.Forbidden:
+					forbidden.Add(1)
+				case result.Permitted:
+					permitted.Add(1)
+				default:
+					denied.Add(1)
+				}
+			}
+		})
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	sent := min(int(next.Load()), *requests)
+	latencies = latencies[:sent]
+	slices.Sort(latencies)
+	result := benchResult{
+		Requests:   sent,
+		Permitted:  int(permitted.Load()),
+		Denied:     int(denied.Load()),
+		Forbidden:  int(forbidden.Load()),
+		Errors:     int(errored.Load()),
+		DurationMs: durationMs(elapsed),
+		PerSecond:  float64(sent) / elapsed.Seconds(),
+		P50Ms:      durationMs(percentile(latencies, 50)),
+		P90Ms:      durationMs(percentile(latencies, 90)),
+		P99Ms:      durationMs(percentile(latencies, 99)),
+		MaxMs:      durationMs(percentile(latencies, 100)),
+	}
+
+	if *jsonOutput {
+		printJSON(stdout, result)
+	} else {
+		fmt.Fprintf(stdout, "%d requests in %.1fms over %d connections, %.0f per second\n",
+			result.Requests, result.DurationMs, min(*connections, *requests), result.PerSecond)
+		fmt.Fprintf(stdout, "permitted %d, denied %d, forbidden %d, errors %d\n",
+			result.Permitted, result.Denied, result.Forbidden, result.Errors)
+		fmt.Fprintf(stdout, "latency p50 %.3fms, p90 %.3fms, p99 %.3fms, max %.3fms\n",
+			result.P50Ms, result.P90Ms, result.P99Ms, result.MaxMs)
+	}
+	if result.Errors > 0 {
+		return exitError
+	}
+	return exitOK
+}
+
+// protocolFlags adds the flags of the commands that use the text protocol, returning
+// the client that they configure and whether it should use TCP, which is only known
+// once the flags are parsed
+func protocolFlags(fs *flag.FlagSet) (*protocolClient, *bool) {
+	pc := &protocolClient{network: "udp"}
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = defaultPort
+	}
+	fs.StringVar(&pc.addr, "addr", "localhost:"+port, "the server's `host:port`")
+	tcp := fs.Bool("tcp", false, "use TCP instead of UDP")
+	fs.StringVar(&pc.keyID, "key-id", os.Getenv("SIGNING_KEY_ID"), "the key ID to sign messages with")
+	fs.StringVar(&pc.secret, "secret", os.Getenv("SIGNING_SECRET"), "the secret to sign messages with")
+	fs.DurationVar(&pc.timeout, "timeout", defaultClientTimeout, "how long to wait for each reply")
+	return pc, tcp
+}
+
+// adminFlags adds the flags of the commands that use the admin API, returning the
+// client that they configure
+func adminFlags(fs *flag.FlagSet) *adminClient {
+	ac := &adminClient{client: &http.Client{Timeout: defaultClientTimeout}}
+	adminURL := os.Getenv("ADMIN_URL")
+	if adminURL == "" && os.Getenv("ADMIN_PORT") != "" {
+		adminURL = "http://localhost:" + os.Getenv("ADMIN_PORT")
+	}
+	fs.StringVar(&ac.url, "admin", adminURL, "the admin API's `URL` (default $ADMIN_URL, or localhost:$ADMIN_PORT)")
+	fs.StringVar(&ac.token, "token", os.Getenv("ADMIN_TOKEN"), "the admin API's bearer token (default $ADMIN_TOKEN)")
+	fs.DurationVar(&ac.client.Timeout, "timeout", defaultClientTimeout, "how long to wait for each reply")
+	return ac
+}
+
+// setUsage sets a FlagSet's usage message, which is written when its flags are wrong
+func setUsage(fs *flag.FlagSet, w io.Writer, synopsis string) {
+	fs.SetOutput(w)
+	fs.Usage = func() {
+		fmt.Fprintln(w, "Usage: goudpserver "+synopsis)
+		fs.PrintDefaults()
+	}
+}
+
+// parseFlags parses a command's flags, checking that it has nargs arguments. If it
+// doesn't, or its flags are wrong, false is returned with the exit code.
+func parseFlags(fs *flag.FlagSet, args []string, nargs int) (int, bool) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK, false
+		}
+		return exitUsage, false
+	}
+	if fs.NArg() != nargs {
+		fmt.Fprintf(fs.Output(), "goudpserver %s: expected %d arguments, got %d\n", fs.Name(), nargs, fs.NArg())
+		fs.Usage()
+		return exitUsage, false
+	}
+	return exitOK, true
+}
+
+// fail prints a command's error, returning the exit code for it
+func fail(stderr io.Writer, name string, err error) int {
+	fmt.Fprintf(stderr, "goudpserver %s: %v\n", name, err)
+	switch {
+	case errors.Is(err, errNoAdmin):
+		return exitUsage
+	case errors.Is(err, errNotFound):
+		return exitNotFound
+	case errors.Is(err, errUnauthorized), errors.Is(err, errRejected):
+		return exitRefused
+	}
+	return exitError
+}
+
+// printJSON prints a value as indented JSON
+func printJSON(w io.Writer, v any) {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
+
+// percentile returns the pth percentile of sorted durations, or 0 if there are none
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := (len(sorted)*p + 99) / 100
+	return sorted[min(max(i-1, 0), len(sorted)-1)]
+}
+
+// durationMs converts a duration to fractional milliseconds
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
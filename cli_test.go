@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runUDPServer runs the server's UDP listener on a free port until the test ends,
+// returning its address
+func runUDPServer(t *testing.T, server *Server) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	server.wg.Add(1)
+	go server.runPacketServer(ctx, "UDP", conn)
+	t.Cleanup(func() {
+		cancel()
+		server.wg.Wait()
+	})
+	return conn.LocalAddr().String()
+}
+
+// runAdminServer runs the server's admin API until the test ends, returning its URL
+func runAdminServer(t *testing.T, server *Server) string {
+	t.Helper()
+	ts := httptest.NewServer(server.adminHandler())
+	t.Cleanup(ts.Close)
+	return ts.URL
+}
+
+// runCLI runs a subcommand, returning its exit code and output
+func runCLI(args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := runCommand(context.Background(), args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func Test_cli_usage(t *testing.T) {
+	code, stdout, _ := runCLI("help")
+	if code != exitOK || !strings.Contains(stdout, "inspect") {
+		t.Errorf("Expected usage, got %v %q", code, stdout)
+	}
+	if code, _, stderr := runCLI("nope"); code != exitUsage || !strings.Contains(stderr, "unknown command") {
+		t.Errorf("Expected an unknown command to exit %v, got %v %q", exitUsage, code, stderr)
+	}
+	if code, _, _ := runCLI("check", "gb"); code != exitUsage {
+		t.Errorf("Expected missing arguments to exit %v, got %v", exitUsage, code)
+	}
+	if code, _, _ := runCLI("check", "-nope", "gb", "l"); code != exitUsage {
+		t.Errorf("Expected an unknown flag to exit %v, got %v", exitUsage, code)
+	}
+	if code, _, _ := runCLI("list", "-admin", ""); code != exitUsage {
+		t.Errorf("Expected a missing admin API to exit %v, got %v", exitUsage, code)
+	}
+}
+
+func Test_cli_check(t *testing.T) {
+	server := signingServer(true)
+	addr := runUDPServer(t, server)
+	signed := []string{"-addr", addr, "-key-id", "k2", "-secret", "new secret"}
+
+	code, stdout, _ := runCLI(append([]string{"check", "-capacity", "1"}, append(signed, "gb", "l")...)...)
+	if code != exitOK || stdout != "gb l: permitted, 0 of 1 remaining\n" {
+		t.Errorf("Expected a permitted check, got %v %q", code, stdout)
+	}
+	code, stdout, _ = runCLI(append([]string{"check", "-capacity", "1", "-json"}, append(signed, "gb", "l")...)...)
+	var result checkResult
+	if err := json.Unmarshal([]byte(stdout), &result); err != nil || result.Permitted || result.Capacity != 1 {
+		t.Errorf("Expected a denied JSON check, got %q (%v)", stdout, err)
+	}
+	if code != exitDenied {
+		t.Errorf("Expected a denied check to exit %v, got %v", exitDenied, code)
+	}
+	code, stdout, _ = runCLI(append([]string{"check", "-peek"}, append(signed, "gb", "l")...)...)
+	if code != exitOK || stdout != "gb l: 0 of 1 remaining\n" {
+		t.Errorf("Expected a peek, got %v %q", code, stdout)
+	}
+	code, stdout, _ = runCLI(append([]string{"check", "-peek", "-tcp=false"}, append(signed, "gb", "l")...)...)
+	if code != exitOK || stdout != "gb l: 0 of 1 remaining\n" {
+		t.Errorf("Expected a peek over UDP, got %v %q", code, stdout)
+	}
+
+	// the server requires UDP messages to be signed
+	if code, _, stderr := runCLI("check", "-addr", addr, "gb", "l"); code != exitRefused {
+		t.Errorf("Expected an unsigned check to exit %v, got %v %q", exitRefused, code, stderr)
+	}
+}
+
+func Test_cli_check_forbidden(t *testing.T) {
+	server := aclServer()
+	addr := runUDPServer(t, server)
+	code, stdout, _ := runCLI("check", "-addr", addr, "-capacity", "10", "team-b-web", "l")
+	if code != exitRefused || !strings.Contains(stdout, "forbidden") {
+		t.Errorf("Expected a forbidden check to exit %v, got %v %q", exitRefused, code, stdout)
+	}
+}
+
+func Test_cli_admin(t *testing.T) {
+	server := adminServer(t)
+	admin := []string{"-admin", runAdminServer(t, server), "-token", "s3cret"}
+
+	code, stdout, _ := runCLI(append([]string{"list"}, admin...)...)
+	if code != exitOK || stdout != "bob\nteam-a\nteam-b\n" {
+		t.Errorf("Expected every account, got %v %q", code, stdout)
+	}
+	code, stdout, stderr := runCLI(append([]string{"list", "-prefix", "team-", "-limit", "1", "-json"}, admin...)...)
+	var page adminAccounts
+	if err := json.Unmarshal([]byte(stdout), &page); err != nil || strings.Join(page.Accounts, ",") != "team-a" || page.Next != "team-a" {
+		t.Errorf("Expected the first team account, got %v %q %q (%v)", code, stdout, stderr, err)
+	}
+
+	code, stdout, _ = runCLI(append([]string{"inspect"}, append(admin, "team-a")...)...)
+	if code != exitOK || !strings.Contains(stdout, "account team-a\n") || !strings.Contains(stdout, "bucket  l      fixed      6      10") {
+		t.Errorf("Expected team-a's buckets, got %v %q", code, stdout)
+	}
+	if code, _, _ := runCLI(append([]string{"inspect"}, append(admin, "carol")...)...); code != exitNotFound {
+		t.Errorf("Expected a missing account to exit %v, got %v", exitNotFound, code)
+	}
+
+	if code, _, _ := runCLI(append([]string{"reset"}, append(admin, "team-a")...)...); code != exitOK {
+		t.Errorf("Expected a reset to exit %v, got %v", exitOK, code)
+	}
+	if reply := server.handleMessage("UDP", "PEEK,team-a,l"); reply != "0,0" {
+		t.Errorf("Expected a reset account to have no buckets, got %v", reply)
+	}
+
+	if code, _, _ := runCLI("list", "-admin", admin[1], "-token", "wrong"); code != exitRefused {
+		t.Errorf("Expected a bad token to exit %v, got %v", exitRefused, code)
+	}
+}
+
+func Test_cli_bench(t *testing.T) {
+	server := NewServer(8888, NewMetrics())
+	addr := runUDPServer(t, server)
+	code, stdout, _ := runCLI("bench", "-addr", addr, "-n", "50", "-c", "5", "-capacity", "20", "-json", "gb", "l")
+	var result benchResult
+	if err := json.Unmarshal([]byte(stdout), &result); err != nil {
+		t.Fatalf("Expected JSON, got %q (%v)", stdout, err)
+	}
+	if code != exitOK || result.Requests != 50 || result.Errors != 0 || result.Permitted != 20 || result.Denied != 30 {
+		t.Errorf("Expected 50 requests, 20 permitted, got %v %+v", code, result)
+	}
+}
+
+func Test_cli_percentile(t *testing.T) {
+	latencies := []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	sorted := make([]time.Duration, len(latencies))
+	for i, l := range latencies {
+		sorted[i] = time.Duration(l)
+	}
+	tests := []struct {
+		p        int
+		expected time.Duration
+	}{
+		{0, 1}, {50, 5}, {90, 9}, {99, 10}, {100, 10},
+	}
+	for _, test := range tests {
+		if d := percentile(sorted, test.p); d != test.expected {
+			t.Errorf("Expected p%v to be %v, got %v", test.p, test.expected, d)
+		}
+	}
+	if d := percentile(nil, 50); d != 0 {
+		t.Errorf("Expected %v, got %v", 0, d)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reasons for a client command failing, which decide its exit code
+var (
+	errRejected = errors.New("message rejected by server")
+	errNotFound = errors.New("not found")
+	errNoAdmin  = errors.New("no admin API, set -admin, ADMIN_URL or ADMIN_PORT")
+)
+
+// protocolClient sends version 2 text messages to a running server over UDP or TCP,
+// signing them if it has a key, so that the command-line client can use the same
+// protocol as any other client
+type protocolClient struct {
+	network string
+	addr    string
+	keyID   string
+	secret  string
+	timeout time.Duration
+	conn    net.Conn
+	reader  *bufio.Reader
+	nextID  int
+}
+
+// dial connects to the server. UDP "connections" only remember the server's address.
+func (pc *protocolClient) dial() error {
+	conn, err := net.DialTimeout(pc.network, pc.addr, pc.timeout)
+	if err != nil {
+		return err
+	}
+	pc.conn = conn
+	pc.reader = bufio.NewReader(conn)
+	return nil
+}
+
+// Close closes the connection to the server
+func (pc *protocolClient) Close() error {
+	if pc.conn == nil {
+		return nil
+	}
+	return pc.conn.Close()
+}
+
+// roundTrip sends a verb and its fields, separated by spaces, in a version 2 message,
+// returning the fields of the reply. UDP replies to earlier requests, which arrived
+// after they timed out, are skipped by their request ID.
+func (pc *protocolClient) roundTrip(fields ...string) ([]string, error) {
+	if pc.conn == nil {
+		if err := pc.dial(); err != nil {
+			return nil, err
+		}
+	}
+	pc.nextID++
+	id := strconv.Itoa(pc.nextID)
+	message := version2Prefix + id + " " + strings.Join(fields, " ")
+	if pc.secret != "" {
+		message = signMessage(pc.keyID, pc.secret, time.Now(), rand.Text(), message)
+	}
+
+	pc.conn.SetDeadline(time.Now().Add(pc.timeout))
+	if pc.network == "tcp" {
+		message += "\n"
+	}
+	if _, err := pc.conn.Write([]byte(message)); err != nil {
+		return nil, err
+	}
+	buffer := make([]byte, maxDatagram)
+	for {
+		var reply string
+		if pc.network == "tcp" {
+			line, err := pc.reader.ReadString('\n')
+			if err != nil {
+				return nil, err
+			}
+			reply = line
+		} else {
+			n, err := pc.conn.Read(buffer)
+			if err != nil {
+				return nil, err
+			}
+			reply = string(buffer[:n])
+		}
+
+		replyFields := strings.Fields(reply)
+		switch {
+		case len(replyFields) == 1 && replyFields[0] == denyResponse:
+			// messages that fail authentication are denied before their envelope is read
+			return nil, errRejected
+		case len(replyFields) >= 3 && replyFields[0]+" " == version2Prefix && replyFields[1] == id:
+			return replyFields[2:], nil
+		case pc.network == "tcp":
+			return nil, fmt.Errorf("unexpected reply %q", strings.TrimSpace(reply))
+		}
+	}
+}
+
+// checkResult is the outcome of a check, whether it was an ALLOW or a PEEK
+type checkResult struct {
+	Account      string `json:"account"`
+	Class        string `json:"class"`
+	Permitted    bool   `json:"permitted"`
+	Forbidden    bool   `json:"forbidden,omitempty"`
+	Remaining    int    `json:"remaining"`
+	Capacity     int    `json:"capacity"`
+	RetryAfterMs int64  `json:"retryAfterMs,omitempty"`
+}
+
+// allow asks the server to take inc from an account's bucket. A capacity of 0 leaves
+// it to the policy.
+func (pc *protocolClient) allow(account string, class string, inc int, capacity int) (checkResult, error) {
+	fields := []string{verbAllow, account, class, strconv.Itoa(inc)}
+	if capacity > 0 {
+		fields = append(fields, strconv.Itoa(capacity))
+	}
+	reply, err := pc.roundTrip(fields...)
+	if err != nil {
+		return checkResult{}, err
+	}
+	result := checkResult{Account: account, Class: class}
+	switch {
+	case len(reply) == 1 && reply[0] == forbiddenResponse:
+		result.Forbidden = true
+		return result, nil
+	case len(reply) != 4:
+		// invalid messages are denied without a rich reply
+		return result, errRejected
+	}
+	result.Permitted = reply[0] == permitResponse
+	result.Remaining, _ = strconv.Atoi(reply[1])
+	result.Capacity, _ = strconv.Atoi(reply[2])
+	result.RetryAfterMs, _ = strconv.ParseInt(reply[3], 10, 64)
+	return result, nil
+}
+
+// peek asks the server for an account's bucket, without changing it
+func (pc *protocolClient) peek(account string, class string) (checkResult, error) {
+	reply, err := pc.roundTrip(verbPeek, account, class)
+	if err != nil {
+		return checkResult{}, err
+	}
+	result := checkResult{Account: account, Class: class}
+	switch {
+	case len(reply) == 1 && reply[0] == forbiddenResponse:
+		result.Forbidden = true
+		return result, nil
+	case len(reply) != 2:
+		return result, errRejected
+	}
+	result.Remaining, _ = strconv.Atoi(reply[0])
+	result.Capacity, _ = strconv.Atoi(reply[1])
+	result.Permitted = result.Remaining > 0
+	return result, nil
+}
+
+// adminClient makes requests to a running server's admin API
+type adminClient struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+// do makes a request to the admin API, decoding its JSON response into v if it isn't
+// nil. Error responses are returned as errors, wrapping errNotFound for a 404 and
+// errUnauthorized for a 401.
+func (ac *adminClient) do(method string, path string, body any, v any) error {
+	if ac.url == "" {
+		return errNoAdmin
+	}
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = strings.NewReader(string(data))
+	}
+	request, err := http.NewRequest(method, strings.TrimSuffix(ac.url, "/")+path, reader)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", "Bearer "+ac.token)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	response, err := ac.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		var httpErr httpError
+		json.NewDecoder(response.Body).Decode(&httpErr)
+		switch response.StatusCode {
+		case http.StatusNotFound:
+			return fmt.Errorf("%w: %s", errNotFound, httpErr.Error)
+		case http.StatusUnauthorized:
+			return errUnauthorized
+		}
+		return fmt.Errorf("admin API replied %v: %s", response.Status, httpErr.Error)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(v)
+}
+
+// account fetches an account's buckets and leases
+func (ac *adminClient) account(name string) (adminAccount, error) {
+	var acc adminAccount
+	err := ac.do("GET", "/admin/v1/accounts/"+url.PathEscape(name), nil, &acc)
+	return acc, err
+}
+
+// list fetches a page of account names
+func (ac *adminClient) list(prefix string, after string, limit int) (adminAccounts, error) {
+	query := url.Values{}
+	query.Set("prefix", prefix)
+	query.Set("after", after)
+	query.Set("limit", strconv.Itoa(limit))
+	var page adminAccounts
+	err := ac.do("GET", "/admin/v1/accounts?"+query.Encode(), nil, &page)
+	return page, err
+}
+
+// reset resets an account, so that each of its classes starts afresh
+func (ac *adminClient) reset(name string) error {
+	return ac.do("POST", "/admin/v1/accounts/"+url.PathEscape(name)+"/reset", nil, nil)
+}
+
+// adminAccount is the JSON body of an account, as the admin API describes it
+type adminAccount struct {
+	Name    string                  `json:"name"`
+	Buckets map[string]LimiterState `json:"buckets"`
+	Leases  map[string]LimiterState `json:"leases,omitempty"`
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// algorithmConcurrency is reported by a ConcurrencyLimiter. Rather than limiting the
+// rate of requests, it limits how many operations an account has in flight at once.
+const algorithmConcurrency = "concurrency"
+
+// defaultLeaseTTL is how long a lease lasts if its ClassPolicy doesn't say
+const defaultLeaseTTL = 30 * time.Second
+
+// ConcurrencyLimiter limits the number of operations in flight to its capacity. Each
+// operation acquires a lease, which it releases when it is finished. So that a client
+// that dies without releasing its leases doesn't use up the capacity forever, leases
+// expire after their ttl.
+type ConcurrencyLimiter struct {
+	leases   map[string]time.Time
+	capacity int
+	ttl      time.Duration
+	mu       sync.Mutex
+}
+
+// NewConcurrencyLimiter creates a ConcurrencyLimiter with no leases, with the
+// ClassPolicy's capacity and TTL
+func NewConcurrencyLimiter(cp ClassPolicy) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		leases:   map[string]time.Time{},
+		capacity: cp.Capacity,
+		ttl:      leaseTTL(cp),
+	}
+}
+
+// leaseTTL is how long a ClassPolicy's leases last, which defaults to the defaultLeaseTTL
+func leaseTTL(cp ClassPolicy) time.Duration {
+	if cp.TTL <= 0 {
+		return defaultLeaseTTL
+	}
+	return time.Duration(cp.TTL)
+}
+
+// Acquire returns the ID of a new lease, or false if the capacity is all in use
+func (cl *ConcurrencyLimiter) Acquire() (string, bool) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	now := time.Now()
+	cl.expire(now)
+	if len(cl.leases) >= cl.capacity {
+		return "", false
+	}
+	id := newLeaseID()
+	cl.leases[id] = now.Add(cl.ttl)
+	return id, true
+}
+
+// Release frees a lease, returning false if it doesn't exist or has already expired
+func (cl *ConcurrencyLimiter) Release(id string) bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.expire(time.Now())
+	if _, ok := cl.leases[id]; !ok {
+		return false
+	}
+	delete(cl.leases, id)
+	return true
+}
+
+// expire removes the leases that have expired. It must be called with the lock held.
+func (cl *ConcurrencyLimiter) expire(now time.Time) {
+	for id, expires := range cl.leases {
+		if !now.Before(expires) {
+			delete(cl.leases, id)
+		}
+	}
+}
+
+// SetLimit changes the capacity and TTL. Leases that are already held keep the
+// expiry they were given, even if that takes them over the new capacity.
+func (cl *ConcurrencyLimiter) SetLimit(cp ClassPolicy) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.capacity = cp.Capacity
+	cl.ttl = leaseTTL(cp)
+}
+
+// State returns the number of leases that could be acquired now, and the capacity
+func (cl *ConcurrencyLimiter) State() LimiterState {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.expire(time.Now())
+	return LimiterState{
+		Algorithm: algorithmConcurrency,
+		Value:     max(cl.capacity-len(cl.leases), 0),
+		Capacity:  cl.capacity,
+	}
+}
+
+// newLeaseID returns a random lease ID
+func newLeaseID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_concurrency_acquire_release(t *testing.T) {
+	cl := NewConcurrencyLimiter(ClassPolicy{Capacity: 2})
+	if cl.ttl != defaultLeaseTTL {
+		t.Errorf("Expected ttl to be %v, got %v", defaultLeaseTTL, cl.ttl)
+	}
+	first, ok := cl.Acquire()
+	if !ok {
+		t.Error("Expected first acquire to be permitted, got false")
+	}
+	second, ok := cl.Acquire()
+	if !ok || second == first {
+		t.Errorf("Expected second acquire to be permitted with a new lease, got %v %v", second, ok)
+	}
+	if _, ok := cl.Acquire(); ok {
+		t.Error("Expected acquire beyond capacity to be denied, got true")
+	}
+	if state := cl.State(); state.Value != 0 || state.Capacity != 2 {
+		t.Errorf("Expected state to be 0/2, got %v/%v", state.Value, state.Capacity)
+	}
+
+	// releasing a lease makes room for another
+	if !cl.Release(first) {
+		t.Error("Expected release to succeed, got false")
+	}
+	if cl.Release(first) {
+		t.Error("Expected second release of the same lease to fail, got true")
+	}
+	if _, ok := cl.Acquire(); !ok {
+		t.Error("Expected acquire after release to be permitted, got false")
+	}
+}
+
+func Test_concurrency_expire(t *testing.T) {
+	cl := NewConcurrencyLimiter(ClassPolicy{Capacity: 1, TTL: Duration(time.Minute)})
+	lease, _ := cl.Acquire()
+	if _, ok := cl.Acquire(); ok {
+		t.Error("Expected acquire beyond capacity to be denied, got true")
+	}
+
+	// a lease that isn't released expires after its ttl
+	cl.leases[lease] = time.Now().Add(-time.Second)
+	if _, ok := cl.Acquire(); !ok {
+		t.Error("Expected acquire after expiry to be permitted, got false")
+	}
+	if cl.Release(lease) {
+		t.Error("Expected release of an expired lease to fail, got true")
+	}
+}
+
+func Test_concurrency_set_limit(t *testing.T) {
+	cl := NewConcurrencyLimiter(ClassPolicy{Capacity: 1})
+	cl.Acquire()
+	cl.SetLimit(ClassPolicy{Capacity: 2, TTL: Duration(time.Minute)})
+	if cl.ttl != time.Minute {
+		t.Errorf("Expected ttl to be %v, got %v", time.Minute, cl.ttl)
+	}
+	if _, ok := cl.Acquire(); !ok {
+		t.Error("Expected acquire after raising the capacity to be permitted, got false")
+	}
+	cl.SetLimit(ClassPolicy{Capacity: 1})
+	if state := cl.State(); state.Value != 0 || state.Capacity != 1 {
+		t.Errorf("Expected state to be 0/1, got %v/%v", state.Value, state.Capacity)
+	}
+	// without a TTL, the TTL goes back to the default, as for a new ConcurrencyLimiter
+	if cl.ttl != defaultLeaseTTL {
+		t.Errorf("Expected ttl to be %v, got %v", defaultLeaseTTL, cl.ttl)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// GCRA is a Limiter using the generic cell rate algorithm. It permits rate requests
+// per second with bursts of up to capacity, without keeping a count at all. Instead,
+// it keeps the theoretical arrival time (tat) of the next request, which each request
+// moves 1/rate seconds into the future. A request is permitted as long as that doesn't
+// take the tat more than capacity requests' worth of time ahead of now.
+type GCRA struct {
+	tat      time.Time
+	capacity int
+	rate     float64
+	mu       sync.RWMutex
+}
+
+// NewGCRA creates a GCRA with the ClassPolicy's capacity and rate, which
+// will permit a full burst straight away
+func NewGCRA(cp ClassPolicy) Limiter {
+	return &GCRA{
+		capacity: cp.Capacity,
+		rate:     cp.Rate,
+	}
+}
+
+// Allow moves the tat on by n requests, if that is permitted
+func (g *GCRA) Allow(n int) Decision {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.allowLocked(n)
+}
+
+// Peek returns the Decision that Allow would make, without moving the tat
+func (g *GCRA) Peek(n int) Decision {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.peekLocked(n)
+}
+
+// lock and unlock hold the GCRA's lock for a transaction
+func (g *GCRA) lock()   { g.mu.Lock() }
+func (g *GCRA) unlock() { g.mu.Unlock() }
+
+// peekLocked is Peek, for when the lock is already held
+func (g *GCRA) peekLocked(n int) Decision {
+	d, _ := g.decide(n, time.Now())
+	return d
+}
+
+// allowLocked is Allow, for when the lock is already held
+func (g *GCRA) allowLocked(n int) Decision {
+	now := time.Now()
+	d, tat := g.decide(n, now)
+	if d.Permitted {
+		g.tat = tat
+		d.Remaining = g.remaining(now)
+		d.ResetAfter = max(g.tat.Sub(now), 0)
+	}
+	return d
+}
+
+// decide works out whether n requests are permitted now, returning the tat
+// after them. It must be called with the lock held.
+func (g *GCRA) decide(n int, now time.Time) (Decision, time.Time) {
+	d := Decision{
+		Remaining:  g.remaining(now),
+		Capacity:   g.capacity,
+		ResetAfter: max(g.tat.Sub(now), 0),
+	}
+	if n <= 0 || n > g.capacity || g.rate <= 0 {
+		return d, g.tat
+	}
+	tat := g.tat
+	if tat.Before(now) {
+		tat = now
+	}
+	tat = tat.Add(interval(n, g.rate))
+	allowAt := tat.Add(-interval(g.capacity, g.rate))
+	if now.Before(allowAt) {
+		d.RetryAfter = allowAt.Sub(now)
+		return d, g.tat
+	}
+	d.Permitted = true
+	return d, tat
+}
+
+// remaining is the number of requests that would be permitted now, calculated
+// from how far the tat is ahead of now. It must be called with the lock held.
+func (g *GCRA) remaining(now time.Time) int {
+	ahead := g.tat.Sub(now)
+	if ahead <= 0 || g.rate <= 0 {
+		return g.capacity
+	}
+	return max(g.capacity-int(math.Ceil(ahead.Seconds()*g.rate)), 0)
+}
+
+// Refund moves the tat back by n requests, but not into the past
+func (g *GCRA) Refund(n int) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if n <= 0 || g.rate <= 0 {
+		return 0
+	}
+	now := time.Now()
+	before := g.remaining(now)
+	g.tat = g.tat.Add(-interval(n, g.rate))
+	if g.tat.Before(now) {
+		g.tat = now
+	}
+	return g.remaining(now) - before
+}
+
+// Reset does nothing, as the tat moves into the past by itself
+func (g *GCRA) Reset() {}
+
+// set moves the tat so that value requests would be permitted now
+func (g *GCRA) set(value int, capacity int) error {
+	if value < 0 || capacity < 0 {
+		return errors.New("cannot accept negative value or capacity")
+	}
+	if value > capacity {
+		return errors.New("value cannot exceed capacity")
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.capacity = capacity
+	g.tat = time.Now()
+	if g.rate > 0 {
+		g.tat = g.tat.Add(interval(capacity-value, g.rate))
+	}
+	return nil
+}
+
+// SetLimit changes the capacity and rate, moving the tat so that the number
+// of requests that would be permitted now stays the same, unless that exceeds
+// the new capacity
+func (g *GCRA) SetLimit(cp ClassPolicy) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if cp.Capacity == g.capacity && cp.Rate == g.rate {
+		return
+	}
+	now := time.Now()
+	value := min(g.remaining(now), cp.Capacity)
+	g.capacity = cp.Capacity
+	g.rate = cp.Rate
+	g.tat = now
+	if g.rate > 0 {
+		g.tat = now.Add(interval(g.capacity-value, g.rate))
+	}
+}
+
+// State returns the number of requests that would be permitted now, and the capacity
+func (g *GCRA) State() LimiterState {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return LimiterState{
+		Algorithm: algorithmGCRA,
+		Value:     g.remaining(time.Now()),
+		Capacity:  g.capacity,
+	}
+}
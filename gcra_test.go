@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_gcra_allow(t *testing.T) {
+	g := NewGCRA(ClassPolicy{Algorithm: algorithmGCRA, Capacity: 10, Rate: 10}).(*GCRA)
+	// a burst of 10 is permitted, then denied
+	for i := 0; i < 10; i++ {
+		if d := g.Allow(1); !d.Permitted {
+			t.Errorf("Expected allow %d to be permitted, got false", i)
+		}
+	}
+	d := g.Allow(1)
+	if d.Permitted {
+		t.Error("Expected allow beyond burst to be denied, got true")
+	}
+	if d.RetryAfter <= 0 || d.RetryAfter > 100*time.Millisecond {
+		t.Errorf("Expected RetryAfter to be up to 100ms, got %v", d.RetryAfter)
+	}
+	if d.Remaining != 0 {
+		t.Errorf("Expected Remaining to be 0, got %d", d.Remaining)
+	}
+	if d.ResetAfter <= 900*time.Millisecond || d.ResetAfter > time.Second {
+		t.Errorf("Expected ResetAfter to be up to 1s, got %v", d.ResetAfter)
+	}
+
+	// GCRA limiters are not reset
+	g.Reset()
+	if d := g.Allow(1); d.Permitted {
+		t.Error("Expected allow after reset to be denied, got true")
+	}
+
+	// half a second later, 5 requests are permitted
+	g.tat = g.tat.Add(-500 * time.Millisecond)
+	if d := g.Peek(5); !d.Permitted {
+		t.Error("Expected peek after waiting to be permitted, got false")
+	}
+	if d := g.Allow(5); !d.Permitted {
+		t.Error("Expected allow after waiting to be permitted, got false")
+	}
+	if d := g.Allow(1); d.Permitted {
+		t.Error("Expected allow beyond waiting to be denied, got true")
+	}
+
+	// asking for more than the capacity is never permitted
+	g.tat = g.tat.Add(-time.Hour)
+	if d := g.Allow(11); d.Permitted {
+		t.Error("Expected allow beyond capacity to be denied, got true")
+	}
+	if g.State().Value != 10 {
+		t.Errorf("Expected Value to be 10, got %d", g.State().Value)
+	}
+}
+
+func Test_gcra_set(t *testing.T) {
+	g := NewGCRA(ClassPolicy{Algorithm: algorithmGCRA, Capacity: 10, Rate: 1}).(*GCRA)
+	if err := g.set(6, 10); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if g.State().Value != 6 {
+		t.Errorf("Expected Value to be 6, got %d", g.State().Value)
+	}
+	// changing the rate keeps the number of requests permitted now
+	g.SetLimit(ClassPolicy{Algorithm: algorithmGCRA, Capacity: 10, Rate: 100})
+	if g.State().Value != 6 {
+		t.Errorf("Expected Value to be 6, got %d", g.State().Value)
+	}
+	if g.set(11, 10) == nil {
+		t.Error("Expected error for setting value more than capacity, got nil")
+	}
+}
+
+func Test_gcra_refund(t *testing.T) {
+	g := NewGCRA(ClassPolicy{Algorithm: algorithmGCRA, Capacity: 10, Rate: 1}).(*GCRA)
+	g.Allow(10)
+	if refunded := g.Refund(3); refunded != 3 {
+		t.Errorf("Expected refunded to be %v, got %v", 3, refunded)
+	}
+	if g.State().Value != 3 {
+		t.Errorf("Expected value to be %v, got %v", 3, g.State().Value)
+	}
+	// the tat doesn't move into the past
+	if refunded := g.Refund(100); refunded != 7 {
+		t.Errorf("Expected refunded to be %v, got %v", 7, refunded)
+	}
+	if g.tat.After(time.Now()) {
+		t.Errorf("Expected tat not to be in the future, got %v", g.tat)
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"slices"
+	"time"
+
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// rateLimitService implements Envoy's RateLimitService, so that Envoy can ask the
+// server for decisions using the descriptors of its rate limit actions
+type rateLimitService struct {
+	rlsv3.UnimplementedRateLimitServiceServer
+	s *Server
+}
+
+// runGRPCServer executes the Envoy rate limit gRPC server, until the context is
+// done, when it stops accepting new requests and waits for those in flight to finish
+func (s *Server) runGRPCServer(ctx context.Context) {
+	defer s.wg.Done()
+
+	addr := fmt.Sprintf(":%v", s.grpcPort)
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		slog.Error("gRPC listen error", "error", err)
+		return
+	}
+	srv := s.grpcServer()
+
+	go func() {
+		slog.Info("gRPC rate limit service listening on " + addr)
+		if err := srv.Serve(listener); err != nil {
+			slog.Error("gRPC server", "error", err)
+		}
+	}()
+
+	<-ctx.Done()
+	slog.Info("Closing gRPC server")
+	srv.GracefulStop()
+}
+
+// grpcServer creates a gRPC server with the rate limit service registered
+func (s *Server) grpcServer() *grpc.Server {
+	srv := grpc.NewServer()
+	rlsv3.RegisterRateLimitServiceServer(srv, &rateLimitService{s: s})
+	return srv
+}
+
+// grpcUnits is how long each unit of a descriptor's limit is. Months and years
+// aren't supported, as they don't have a fixed length.
+var grpcUnits = map[typev3.RateLimitUnit]time.Duration{
+	typev3.RateLimitUnit_SECOND: time.Second,
+	typev3.RateLimitUnit_MINUTE: time.Minute,
+	typev3.RateLimitUnit_HOUR:   time.Hour,
+	typev3.RateLimitUnit_DAY:    24 * time.Hour,
+}
+
+// grpcReplyUnits is the unit of a descriptor's status for each of the grpcUnits
+var grpcReplyUnits = map[typev3.RateLimitUnit]rlsv3.RateLimitResponse_RateLimit_Unit{
+	typev3.RateLimitUnit_SECOND: rlsv3.RateLimitResponse_RateLimit_SECOND,
+	typev3.RateLimitUnit_MINUTE: rlsv3.RateLimitResponse_RateLimit_MINUTE,
+	typev3.RateLimitUnit_HOUR:   rlsv3.RateLimitResponse_RateLimit_HOUR,
+	typev3.RateLimitUnit_DAY:    rlsv3.RateLimitResponse_RateLimit_DAY,
+}
+
+// errGRPCUnit is the error for a descriptor's limit whose unit isn't in grpcUnits
+var errGRPCUnit = errors.New("unsupported rate limit unit")
+
+// grpcLimit uses a descriptor's limit, if it has one, as a Message's capacity. Limits
+// per unit longer than a second are also the Message's rate, so that a class the policy
+// trusts clients with permits requests_per_unit every unit, rather than every second.
+func grpcLimit(message *Message, limit *ratelimitv3.RateLimitDescriptor_RateLimitOverride) error {
+	if limit == nil {
+		return nil
+	}
+	unit, ok := grpcUnits[limit.GetUnit()]
+	if !ok {
+		return errGRPCUnit
+	}
+	message.capacity = int(min(limit.GetRequestsPerUnit(), maxFrameInt))
+	if unit > time.Second {
+		message.rate = float64(message.capacity) / unit.Seconds()
+	}
+	return nil
+}
+
+// grpcUnit is the unit of the limit a descriptor is decided by, so that Envoy can
+// report it. A descriptor's own limit has its own unit. Otherwise the ClassPolicy's
+// limit is per SECOND if it permits its capacity every second, and can't be given a
+// unit if it doesn't, e.g. a slower token bucket or stacked limits, so ok is false.
+func grpcUnit(cp ClassPolicy, limit *ratelimitv3.RateLimitDescriptor_RateLimitOverride) (rlsv3.RateLimitResponse_RateLimit_Unit, bool) {
+	if limit != nil {
+		unit, ok := grpcReplyUnits[limit.GetUnit()]
+		return unit, ok
+	}
+	perSecond := false
+	switch cp.limiterAlgorithm() {
+	case algorithmFixed:
+		perSecond = true
+	case algorithmToken, algorithmGCRA:
+		perSecond = cp.Rate == float64(cp.Capacity)
+	case algorithmSliding:
+		perSecond = time.Duration(cp.Window) == refreshInterval
+	}
+	return rlsv3.RateLimitResponse_RateLimit_SECOND, perSecond
+}
+
+// ShouldRateLimit decides the request's descriptors together, using the policy's
+// Descriptors to find the account and class of each. Descriptors that no rule matches
+// aren't limited. Like an all-or-nothing BATCH, either every descriptor is within its
+// limit and is taken from its account, or the request as a whole is over the limit and
+// nothing is taken. Descriptors with negative hits refund their account instead, but only
+// if the request is within its limits, and those with a hits addend of 0 peek at it. If any descriptor is invalid, has no policy, or
+// is forbidden by the ACL, none are decided and no accounts are created.
+func (rls *rateLimitService) ShouldRateLimit(ctx context.Context, req *rlsv3.RateLimitRequest) (*rlsv3.RateLimitResponse, error) {
+	s := rls.s
+	s.met.messagesProcessed.WithLabelValues("GRPC").Inc()
+	policy := s.policy.Load()
+	caller := Caller{}
+	if p, ok := peer.FromContext(ctx); ok {
+		caller.Addr = p.Addr
+	}
+
+	// hits defaults to 1, but can be overridden by the request and each descriptor
+	hits := uint64(max(req.GetHitsAddend(), 1))
+
+	// map every descriptor to a Message first, so that nothing is decided unless
+	// the whole request is valid and permitted by the ACL
+	messages := make([]*Message, len(req.GetDescriptors()))
+	cps := make([]ClassPolicy, len(req.GetDescriptors()))
+	for i, descriptor := range req.GetDescriptors() {
+		entries := map[string]string{}
+		for _, entry := range descriptor.GetEntries() {
+			if _, ok := entries[entry.GetKey()]; !ok {
+				entries[entry.GetKey()] = entry.GetValue()
+			}
+		}
+		accountName, class, ok := policy.descriptor(req.GetDomain(), entries)
+		if !ok {
+			continue
+		}
+
+		n := hits
+		if descriptor.GetHitsAddend() != nil {
+			n = descriptor.GetHitsAddend().GetValue()
+		}
+		message := &Message{
+			verb:        verbAllow,
+			accountName: accountName,
+			class:       class,
+			inc:         int(min(n, maxFrameInt)),
+		}
+		switch {
+		case n == 0:
+			// a hits addend of 0 checks the descriptor's limit without taking from it
+			message.verb = verbPeek
+		case descriptor.GetIsNegativeHits():
+			message.verb = verbRefund
+		}
+		if err := grpcLimit(message, descriptor.GetLimit()); err != nil {
+			s.errored("GRPC", err)
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if err := message.validate(policy.Classes); err != nil {
+			s.errored("GRPC", err)
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if !policy.permits(caller, message) {
+			s.forbidden("GRPC", caller, message)
+			return nil, status.Error(codes.PermissionDenied, errForbidden.Error())
+		}
+		// check the policy allows every descriptor before any account is created
+		if message.verb == verbRefund && !policy.refunds() {
+			s.errored("GRPC", errRefundsOff)
+			return nil, status.Error(codes.InvalidArgument, errRefundsOff.Error())
+		}
+		cp, err := policy.resolveMessage(message)
+		if err != nil && message.verb == verbAllow {
+			s.errored("GRPC", err)
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		// peeks and refunds don't need a rate limit, but their status reports it if there is one
+		if err == nil {
+			cps[i] = cp
+		}
+		messages[i] = message
+	}
+
+	// find the limiter of every descriptor before any is decided, so that none are
+	// decided unless they all can be
+	var requests []txRequest
+	for i, message := range messages {
+		if message == nil || message.verb != verbAllow {
+			continue
+		}
+		limiter, err := s.accountLimiter(message, cps[i])
+		if err != nil {
+			s.errored("GRPC", err)
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		requests = append(requests, txRequest{
+			key:     message.accountName + "\x00" + message.class,
+			limiter: limiter,
+			n:       message.inc,
+		})
+	}
+	decisions := transact(requests)
+	overLimit := slices.ContainsFunc(decisions, func(d Decision) bool { return !d.Permitted })
+
+	resp := &rlsv3.RateLimitResponse{OverallCode: rlsv3.RateLimitResponse_OK}
+	for i, message := range messages {
+		if message == nil {
+			resp.Statuses = append(resp.Statuses, &rlsv3.RateLimitResponse_DescriptorStatus{
+				Code: rlsv3.RateLimitResponse_OK,
+			})
+			continue
+		}
+		var reply Reply
+		switch message.verb {
+		case verbPeek:
+			reply = s.handlePeek("GRPC", policy, message)
+		case verbRefund:
+			// like the rest of the request, refunds only happen if it is within its limits
+			if !overLimit {
+				reply = s.handleRefund("GRPC", policy, message)
+			}
+		default:
+			reply.Decision = decisions[0]
+			decisions = decisions[1:]
+			s.decided("GRPC", message, &reply.Decision)
+		}
+
+		code := rlsv3.RateLimitResponse_OK
+		if message.verb == verbAllow && !reply.Permitted {
+			code = rlsv3.RateLimitResponse_OVER_LIMIT
+			resp.OverallCode = rlsv3.RateLimitResponse_OVER_LIMIT
+		}
+		descriptorStatus := &rlsv3.RateLimitResponse_DescriptorStatus{
+			Code:           code,
+			LimitRemaining: uint32(min(uint64(max(reply.Remaining, 0)), math.MaxUint32)),
+		}
+		if unit, ok := grpcUnit(cps[i], req.GetDescriptors()[i].GetLimit()); ok {
+			descriptorStatus.CurrentLimit = &rlsv3.RateLimitResponse_RateLimit{
+				Name:            message.class,
+				RequestsPerUnit: uint32(min(uint64(max(reply.Capacity, 0)), math.MaxUint32)),
+				Unit:            unit,
+			}
+		}
+		if reply.RetryAfter > 0 {
+			descriptorStatus.DurationUntilReset = durationpb.New(reply.RetryAfter)
+		}
+		resp.Statuses = append(resp.Statuses, descriptorStatus)
+	}
+	return resp, nil
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// grpcClient serves the server's rate limit service in-process, returning a client for it
+func grpcClient(t *testing.T, server *Server) rlsv3.RateLimitServiceClient {
+	t.Helper()
+	listener := bufconn.Listen(1024 * 1024)
+	srv := server.grpcServer()
+	go srv.Serve(listener)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Cannot create gRPC client: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return rlsv3.NewRateLimitServiceClient(conn)
+}
+
+// grpcDescriptor makes a descriptor from pairs of keys and values
+func grpcDescriptor(pairs ...string) *ratelimitv3.RateLimitDescriptor {
+	descriptor := &ratelimitv3.RateLimitDescriptor{}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		descriptor.Entries = append(descriptor.Entries, &ratelimitv3.RateLimitDescriptor_Entry{Key: pairs[i], Value: pairs[i+1]})
+	}
+	return descriptor
+}
+
+// grpcTestServer creates a Server whose policy maps api_key descriptors to accounts
+// and gives the l class a capacity of 2
+func grpcTestServer() *Server {
+	server := NewServer(8888, NewMetrics())
+	p := NewPolicy()
+	p.Default["l"] = ClassPolicy{Algorithm: algorithmFixed, Capacity: 2}
+	p.Descriptors = []DescriptorRule{
+		{Domain: "edge", AccountKey: "api_key", Class: "l"},
+		{AccountKey: "api_key", ClassKey: "class"},
+	}
+	server.SetPolicy(p)
+	return server
+}
+
+func Test_grpc_should_rate_limit(t *testing.T) {
+	server := grpcTestServer()
+	client := grpcClient(t, server)
+	req := &rlsv3.RateLimitRequest{
+		Domain:      "edge",
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{grpcDescriptor("api_key", "gb")},
+	}
+	for i := 1; i <= 2; i++ {
+		resp, err := client.ShouldRateLimit(context.Background(), req)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if resp.OverallCode != rlsv3.RateLimitResponse_OK {
+			t.Errorf("Expected request %v to be OK, got %v", i, resp.OverallCode)
+		}
+		if len(resp.Statuses) != 1 || resp.Statuses[0].LimitRemaining != uint32(2-i) || resp.Statuses[0].CurrentLimit.RequestsPerUnit != 2 {
+			t.Errorf("Expected %v of %v remaining, got %v", 2-i, 2, resp.Statuses)
+		}
+		if unit := resp.Statuses[0].CurrentLimit.GetUnit(); unit != rlsv3.RateLimitResponse_RateLimit_SECOND {
+			t.Errorf("Expected the limit to be per %v, got %v", rlsv3.RateLimitResponse_RateLimit_SECOND, unit)
+		}
+	}
+
+	resp, err := client.ShouldRateLimit(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if resp.OverallCode != rlsv3.RateLimitResponse_OVER_LIMIT || resp.Statuses[0].Code != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("Expected OVER_LIMIT, got %v", resp)
+	}
+
+	// the gRPC service and the text protocol share buckets
+	if server.handleMessage("test", "PEEK,gb,l") != "0,2" {
+		t.Error("Expected the text protocol to see the gRPC service's bucket")
+	}
+}
+
+func Test_grpc_descriptors(t *testing.T) {
+	server := grpcTestServer()
+	client := grpcClient(t, server)
+
+	// unmatched descriptors aren't limited, and each descriptor is decided independently
+	resp, err := client.ShouldRateLimit(context.Background(), &rlsv3.RateLimitRequest{
+		Domain: "internal",
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{
+			grpcDescriptor("path", "/"),
+			grpcDescriptor("api_key", "gb", "class", "l"),
+		},
+		HitsAddend: 2,
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(resp.Statuses) != 2 {
+		t.Fatalf("Expected %v statuses, got %v", 2, resp.Statuses)
+	}
+	if resp.Statuses[0].Code != rlsv3.RateLimitResponse_OK || resp.Statuses[0].CurrentLimit != nil {
+		t.Errorf("Expected an unmatched descriptor to be OK without a limit, got %v", resp.Statuses[0])
+	}
+	if resp.Statuses[1].Code != rlsv3.RateLimitResponse_OK || resp.Statuses[1].LimitRemaining != 0 {
+		t.Errorf("Expected the l descriptor to use both hits, got %v", resp.Statuses[1])
+	}
+	if resp.OverallCode != rlsv3.RateLimitResponse_OK {
+		t.Errorf("Expected OK, got %v", resp.OverallCode)
+	}
+
+	// a descriptor's own hits override the request's, and negative hits refund
+	refund := grpcDescriptor("api_key", "gb", "class", "l")
+	refund.HitsAddend = wrapperspb.UInt64(1)
+	refund.IsNegativeHits = true
+	resp, err = client.ShouldRateLimit(context.Background(), &rlsv3.RateLimitRequest{
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{refund},
+	})
+	if err != nil || resp.Statuses[0].LimitRemaining != 1 {
+		t.Errorf("Expected the refund to leave %v remaining, got %v (%v)", 1, resp, err)
+	}
+
+	// a hits addend of 0 checks the limit without taking from it
+	check := grpcDescriptor("api_key", "gb", "class", "l")
+	check.HitsAddend = wrapperspb.UInt64(0)
+	for i := 0; i < 2; i++ {
+		resp, err = client.ShouldRateLimit(context.Background(), &rlsv3.RateLimitRequest{
+			Descriptors: []*ratelimitv3.RateLimitDescriptor{check},
+		})
+		if err != nil || resp.OverallCode != rlsv3.RateLimitResponse_OK || resp.Statuses[0].LimitRemaining != 1 {
+			t.Errorf("Expected the check to leave %v remaining, got %v (%v)", 1, resp, err)
+		}
+	}
+
+	// a descriptor's limit is used as the capacity, if the policy trusts it
+	limited := grpcDescriptor("api_key", "rita", "class", "w")
+	limited.Limit = &ratelimitv3.RateLimitDescriptor_RateLimitOverride{RequestsPerUnit: 10, Unit: typev3.RateLimitUnit_SECOND}
+	resp, err = client.ShouldRateLimit(context.Background(), &rlsv3.RateLimitRequest{
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{limited},
+	})
+	if err != nil || resp.Statuses[0].CurrentLimit.RequestsPerUnit != 10 || resp.Statuses[0].LimitRemaining != 9 {
+		t.Errorf("Expected 9 of 10 remaining, got %v (%v)", resp, err)
+	}
+
+	// classes that aren't in the policy are invalid arguments
+	_, err = client.ShouldRateLimit(context.Background(), &rlsv3.RateLimitRequest{
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{grpcDescriptor("api_key", "gb", "class", "x")},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected %v, got %v", codes.InvalidArgument, err)
+	}
+}
+
+func Test_grpc_all_or_nothing(t *testing.T) {
+	server := grpcTestServer()
+	p := server.policy.Load()
+	p.Mode = modeIgnore
+	p.Default["w"] = ClassPolicy{Algorithm: algorithmFixed, Capacity: 1}
+	client := grpcClient(t, server)
+	server.handleMessage("test", "gb,w,1,1")
+
+	// nothing is taken from l when w is over its limit
+	resp, err := client.ShouldRateLimit(context.Background(), &rlsv3.RateLimitRequest{
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{
+			grpcDescriptor("api_key", "gb", "class", "l"),
+			grpcDescriptor("api_key", "gb", "class", "w"),
+		},
+	})
+	if err != nil || resp.OverallCode != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("Expected OVER_LIMIT, got %v (%v)", resp, err)
+	}
+	if reply := server.handleMessage("test", "PEEK,gb,l"); reply != "2,2" {
+		t.Errorf("Expected nothing to be taken from l, got %v", reply)
+	}
+
+	// nor when a descriptor has no policy, or refunds are turned off
+	for _, descriptor := range []*ratelimitv3.RateLimitDescriptor{
+		grpcDescriptor("api_key", "gb", "class", "q"),
+		{Entries: grpcDescriptor("api_key", "gb", "class", "w").Entries, IsNegativeHits: true},
+	} {
+		_, err := client.ShouldRateLimit(context.Background(), &rlsv3.RateLimitRequest{
+			Descriptors: []*ratelimitv3.RateLimitDescriptor{grpcDescriptor("api_key", "gb", "class", "l"), descriptor},
+		})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected %v, got %v", codes.InvalidArgument, err)
+		}
+		if reply := server.handleMessage("test", "PEEK,gb,l"); reply != "2,2" {
+			t.Errorf("Expected nothing to be taken from l, got %v", reply)
+		}
+	}
+
+	// nor are accounts created for descriptors before one without a policy
+	_, err = client.ShouldRateLimit(context.Background(), &rlsv3.RateLimitRequest{
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{
+			grpcDescriptor("api_key", "rita", "class", "l"),
+			grpcDescriptor("api_key", "rita", "class", "q"),
+		},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected %v, got %v", codes.InvalidArgument, err)
+	}
+	if _, ok := server.accounts.Load("rita"); ok {
+		t.Error("Expected no account to be created for an invalid request")
+	}
+
+	// and refunds are only made when the request is within its limits
+	refunds := true
+	p.Refunds = &refunds
+	server.handleMessage("test", "ALLOW,gb,l,1")
+	resp, err = client.ShouldRateLimit(context.Background(), &rlsv3.RateLimitRequest{
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{
+			grpcDescriptor("api_key", "gb", "class", "w"),
+			{Entries: grpcDescriptor("api_key", "gb", "class", "l").Entries, IsNegativeHits: true},
+		},
+	})
+	if err != nil || resp.OverallCode != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("Expected OVER_LIMIT, got %v (%v)", resp, err)
+	}
+	if reply := server.handleMessage("test", "PEEK,gb,l"); reply != "1,2" {
+		t.Errorf("Expected nothing to be refunded to l, got %v", reply)
+	}
+}
+
+func Test_grpc_limit_unit(t *testing.T) {
+	server := grpcTestServer()
+	client := grpcClient(t, server)
+	hourly := grpcDescriptor("api_key", "rita", "class", "w")
+	hourly.Limit = &ratelimitv3.RateLimitDescriptor_RateLimitOverride{RequestsPerUnit: 2, Unit: typev3.RateLimitUnit_HOUR}
+	req := &rlsv3.RateLimitRequest{Descriptors: []*ratelimitv3.RateLimitDescriptor{hourly}}
+
+	// 2 per hour are permitted, and the next is half an hour away, not a second
+	for i := 0; i < 2; i++ {
+		if resp, err := client.ShouldRateLimit(context.Background(), req); err != nil || resp.OverallCode != rlsv3.RateLimitResponse_OK {
+			t.Errorf("Expected request %v to be OK, got %v (%v)", i, resp, err)
+		}
+	}
+	resp, err := client.ShouldRateLimit(context.Background(), req)
+	if err != nil || resp.OverallCode != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Fatalf("Expected OVER_LIMIT, got %v (%v)", resp, err)
+	}
+	if reset := resp.Statuses[0].DurationUntilReset.AsDuration(); reset < 29*time.Minute || reset > 30*time.Minute {
+		t.Errorf("Expected the next request in 30m, got %v", reset)
+	}
+	if limit := resp.Statuses[0].CurrentLimit; limit.GetUnit() != rlsv3.RateLimitResponse_RateLimit_HOUR || limit.GetRequestsPerUnit() != 2 {
+		t.Errorf("Expected a limit of %v per hour, got %v", 2, limit)
+	}
+
+	// units without a fixed length are invalid arguments
+	for _, unit := range []typev3.RateLimitUnit{typev3.RateLimitUnit_UNKNOWN, typev3.RateLimitUnit_MONTH, typev3.RateLimitUnit_YEAR} {
+		hourly.Limit.Unit = unit
+		if _, err := client.ShouldRateLimit(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("Expected %v for %v, got %v", codes.InvalidArgument, unit, err)
+		}
+	}
+}
+
+func Test_grpc_unit(t *testing.T) {
+	perSecond := []ClassPolicy{
+		{Algorithm: algorithmFixed, Capacity: 10},
+		{Algorithm: algorithmToken, Capacity: 10, Rate: 10},
+		{Algorithm: algorithmSliding, Capacity: 10, Window: Duration(time.Second)},
+	}
+	for _, cp := range perSecond {
+		if unit, ok := grpcUnit(cp, nil); !ok || unit != rlsv3.RateLimitResponse_RateLimit_SECOND {
+			t.Errorf("Expected %+v to be per second, got %v %v", cp, unit, ok)
+		}
+	}
+	// limits that aren't per second can't be given a unit
+	others := []ClassPolicy{
+		{Algorithm: algorithmToken, Capacity: 10, Rate: 1},
+		{Algorithm: algorithmSliding, Capacity: 10, Window: Duration(time.Minute)},
+		{Algorithm: algorithmFixed, Capacity: 10, Limits: []ClassPolicy{{Algorithm: algorithmSliding, Capacity: 100, Window: Duration(time.Minute)}}},
+	}
+	for _, cp := range others {
+		if _, ok := grpcUnit(cp, nil); ok {
+			t.Errorf("Expected %+v not to have a unit, got true", cp)
+		}
+	}
+	// a descriptor's own limit has its own unit
+	limit := &ratelimitv3.RateLimitDescriptor_RateLimitOverride{RequestsPerUnit: 5, Unit: typev3.RateLimitUnit_DAY}
+	if unit, ok := grpcUnit(others[0], limit); !ok || unit != rlsv3.RateLimitResponse_RateLimit_DAY {
+		t.Errorf("Expected the descriptor's limit to be per day, got %v %v", unit, ok)
+	}
+}
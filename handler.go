@@ -0,0 +1,357 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// responses
+const permitResponse = "p"
+const denyResponse = "d"
+
+// Reply is the outcome of handling a Message, before it is formatted for the
+// protocol the message arrived on. For PEEK and REFUND messages, the Decision's
+// Remaining is the bucket's value. A BATCH message has a Reply for each of its
+// requests. A Message that the ACL doesn't permit is Forbidden.
+type Reply struct {
+	Decision
+	Lease     string
+	Err       error
+	Forbidden bool
+	Batch     []Reply
+}
+
+// response formats a Decision as a reply to the client. By default, this is a single
+// permit or deny character, but clients can ask for a rich response of
+// <p|d>,<remaining>,<capacity>,<retryAfterMilliseconds>
+func response(d Decision, rich bool) string {
+	reply := denyResponse
+	if d.Permitted {
+		reply = permitResponse
+	}
+	if !rich {
+		return reply
+	}
+	return fmt.Sprintf("%s,%d,%d,%d", reply, d.Remaining, d.Capacity, milliseconds(d.RetryAfter))
+}
+
+// milliseconds rounds a duration up to a whole number of milliseconds
+func milliseconds(d time.Duration) int64 {
+	return int64((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+// text formats the Reply to a Message as a text response. PEEK and REFUND messages
+// that fail are denied, rather than replying with an empty bucket.
+func (r Reply) text(message *Message) string {
+	if r.Forbidden {
+		return forbiddenResponse
+	}
+	switch message.verb {
+	case verbPeek, verbRefund:
+		if r.Err != nil {
+			return denyResponse
+		}
+		return fmt.Sprintf("%d,%d", r.Remaining, r.Capacity)
+	case verbAcquire:
+		if r.Permitted {
+			return permitResponse + "," + r.Lease
+		}
+		return denyResponse
+	case verbRelease:
+		if r.Permitted {
+			return permitResponse
+		}
+		return denyResponse
+	case verbBatch:
+		replies := make([]string, len(r.Batch))
+		for i, reply := range r.Batch {
+			replies[i] = reply.text(message.batch[i])
+		}
+		return strings.Join(replies, ";")
+	}
+	return response(r.Decision, message.rich)
+}
+
+// handleMessage is run as a goroutine to handle a single incoming message from a
+// caller that can't be identified
+func (s *Server) handleMessage(protocol string, str string) string {
+	return s.handleMessageFrom(protocol, Caller{}, str)
+}
+
+// handleMessageFrom handles a single incoming message from a Caller
+func (s *Server) handleMessageFrom(protocol string, caller Caller, str string) string {
+	s.met.messagesProcessed.WithLabelValues(protocol).Inc()
+
+	// unwrap signed messages, checking their signature
+	policy := s.policy.Load()
+	str, err := s.authenticate(protocol, policy, &caller, str)
+	if err != nil {
+		s.errored(protocol, err)
+		return denyResponse
+	}
+
+	// unwrap version 2 messages, so that the reply can be wrapped in the same way
+	version, id, body, err := parseEnvelope(str)
+	if err != nil {
+		s.errored(protocol, err)
+		return formatReply(version, id, denyResponse)
+	}
+
+	// parse the incoming message, using the classes declared by the policy
+	message, err := parseMessage(body, policy.Classes)
+	if err != nil {
+		s.errored(protocol, err)
+		return formatReply(version, id, denyResponse)
+	}
+	// version 2 messages always get rich responses, including each request in a batch
+	message.rich = message.rich || version == version2
+	for _, request := range message.batch {
+		request.rich = message.rich
+	}
+	s.bindAccount(caller, message)
+	return formatReply(version, id, s.handle(protocol, caller, policy, message).text(message))
+}
+
+// handleBinary handles a binary request frame from a Caller, returning a binary reply
+// frame. Binary frames can't be signed, so they are rejected if the policy requires
+// messages to be signed.
+func (s *Server) handleBinary(protocol string, caller Caller, data []byte) []byte {
+	s.met.messagesProcessed.WithLabelValues(protocol).Inc()
+	id, message, err := decodeRequest(data)
+	if err != nil {
+		s.errored(protocol, err)
+		return encodeReply(id, Reply{Err: err})
+	}
+	policy := s.policy.Load()
+	if policy.Signing.requires(protocol) {
+		s.errored(protocol, errUnsigned)
+		return encodeReply(id, Reply{Err: errUnsigned})
+	}
+	if err := message.validate(policy.Classes); err != nil {
+		s.errored(protocol, err)
+		return encodeReply(id, Reply{Err: err})
+	}
+	return encodeReply(id, s.handle(protocol, caller, policy, message))
+}
+
+// handle passes a Message from a Caller to the handler for its verb, if the ACL permits
+// it. The ACL is checked before any account is created, so that callers can't create
+// accounts they aren't permitted to use.
+func (s *Server) handle(protocol string, caller Caller, policy *Policy, message *Message) Reply {
+	if message.verb != verbBatch && !policy.permits(caller, message) {
+		return s.forbidden(protocol, caller, message)
+	}
+	var reply Reply
+	switch message.verb {
+	case verbPeek:
+		reply = s.handlePeek(protocol, policy, message)
+	case verbRefund:
+		reply = s.handleRefund(protocol, policy, message)
+	case verbAcquire:
+		reply = s.handleAcquire(protocol, policy, message)
+	case verbRelease:
+		reply = s.handleRelease(protocol, message)
+	case verbBatch:
+		reply = s.handleBatch(protocol, caller, policy, message)
+	default:
+		reply = s.handleAllow(protocol, policy, message)
+	}
+	if reply.Err != nil {
+		s.errored(protocol, reply.Err)
+	}
+	return reply
+}
+
+// errored counts and logs an error handling a message
+func (s *Server) errored(protocol string, err error) {
+	s.met.messagesErrored.WithLabelValues(err.Error()).Inc()
+	slog.Error("Error handling message", "protocol", protocol, "error", err)
+}
+
+// limiter finds the Limiter that an ALLOW message uses, creating its account if it
+// doesn't exist yet
+func (s *Server) limiter(policy *Policy, message *Message) (Limiter, error) {
+	// decide the bucket's capacity and algorithm according to the quota policy
+	cp, err := policy.resolveMessage(message)
+	if err != nil {
+		return nil, err
+	}
+	return s.accountLimiter(message, cp)
+}
+
+// accountLimiter finds the Limiter for a message's account and class, given its
+// resolved ClassPolicy, creating its account if it doesn't exist yet
+func (s *Server) accountLimiter(message *Message, cp ClassPolicy) (Limiter, error) {
+	// locate the account in the sync map (or create a new one if it's not there already)
+	acc, newAccountCreated := s.accounts.LoadOrStore(message.accountName)
+	if newAccountCreated {
+		s.met.accountGauge.Inc()
+	}
+
+	// get the class's limiter, using the algorithm chosen by the policy
+	return acc.limiter(message.class, cp)
+}
+
+// handleAllow removes inc from an account's bucket, if there is enough left
+func (s *Server) handleAllow(protocol string, policy *Policy, message *Message) Reply {
+	limiter, err := s.limiter(policy, message)
+	if err != nil {
+		return Reply{Err: err}
+	}
+
+	// get a decision on whether there is enough Value left in the bucket to decrement it by "inc"
+	decision := limiter.Allow(message.inc)
+	s.decided(protocol, message, &decision)
+	return Reply{Decision: decision}
+}
+
+// decided fills in when a fixed window denial can be retried, then logs and counts the Decision
+func (s *Server) decided(protocol string, message *Message, decision *Decision) {
+	permitted := decision.Permitted
+	if !permitted && decision.RetryAfter == 0 && decision.resets {
+		decision.RetryAfter = s.untilReset()
+	}
+
+	// permit or deny reply
+	slog.Info("Message", "protocol", protocol, "verb", message.verb, "account", message.accountName, "class", message.class, "inc", message.inc, "permitted", permitted, "retryAfter", decision.RetryAfter)
+	if permitted {
+		s.met.messagesHandled.WithLabelValues(message.class, permitResponse).Inc()
+	} else {
+		s.met.messagesHandled.WithLabelValues(message.class, denyResponse).Inc()
+	}
+}
+
+// handleBatch handles each of a BATCH message's requests in turn. In all-or-nothing
+// mode, the requests are made as a single transaction, so either every request
+// is permitted, or nothing is removed from any bucket and every request is denied.
+// If the ACL forbids any of an all-or-nothing batch's requests, none are made.
+func (s *Server) handleBatch(protocol string, caller Caller, policy *Policy, message *Message) Reply {
+	reply := Reply{Batch: make([]Reply, len(message.batch))}
+	if !message.all {
+		for i, request := range message.batch {
+			reply.Batch[i] = s.handle(protocol, caller, policy, request)
+		}
+		return reply
+	}
+
+	forbidden := false
+	for i, request := range message.batch {
+		if !policy.permits(caller, request) {
+			reply.Batch[i] = s.forbidden(protocol, caller, request)
+			forbidden = true
+		}
+	}
+	if forbidden {
+		return reply
+	}
+
+	// resolve every request's policy before any account is created, so that
+	// nothing happens unless the whole batch can
+	cps := make([]ClassPolicy, len(message.batch))
+	for i, request := range message.batch {
+		cp, err := policy.resolveMessage(request)
+		if err != nil {
+			s.errored(protocol, err)
+			reply.Batch[i] = Reply{Err: err}
+			return reply
+		}
+		cps[i] = cp
+	}
+
+	requests := make([]txRequest, len(message.batch))
+	for i, request := range message.batch {
+		limiter, err := s.accountLimiter(request, cps[i])
+		if err != nil {
+			s.errored(protocol, err)
+			reply.Batch[i] = Reply{Err: err}
+			return reply
+		}
+		requests[i] = txRequest{
+			key:     request.accountName + "\x00" + request.class,
+			limiter: limiter,
+			n:       request.inc,
+		}
+	}
+	decisions := transact(requests)
+	for i := range decisions {
+		s.decided(protocol, message.batch[i], &decisions[i])
+		reply.Batch[i].Decision = decisions[i]
+	}
+	return reply
+}
+
+// handlePeek replies with the value and capacity of an account's bucket, as
+// <value>,<capacity>, without changing it. Accounts and buckets that don't
+// exist yet aren't created: they are reported as being full, if the policy
+// says what their capacity will be, or "0,0" otherwise.
+func (s *Server) handlePeek(protocol string, policy *Policy, message *Message) Reply {
+	var state LimiterState
+	acc, ok := s.accounts.Load(message.accountName)
+	if ok {
+		state, ok = acc.state(message.class)
+	}
+	if !ok && policy.Mode != modeTrust {
+		if cp, found := policy.lookup(message.accountName, message.class); found {
+			state.Value = cp.Capacity
+			state.Capacity = cp.Capacity
+		}
+	}
+	slog.Info("Message", "protocol", protocol, "verb", message.verb, "account", message.accountName, "class", message.class, "value", state.Value)
+	return Reply{Decision: Decision{Remaining: state.Value, Capacity: state.Capacity}}
+}
+
+// handleRefund adds tokens back to an account's bucket, up to its capacity, and
+// replies with its value and capacity afterwards, as <value>,<capacity>. Accounts
+// and buckets that don't exist yet aren't created, as there is nothing to refund.
+// Refunds are denied unless the policy lets clients make them.
+func (s *Server) handleRefund(protocol string, policy *Policy, message *Message) Reply {
+	if !policy.refunds() {
+		return Reply{Err: errRefundsOff}
+	}
+	var refunded int
+	var state LimiterState
+	acc, ok := s.accounts.Load(message.accountName)
+	if ok {
+		refunded, state, _ = acc.refund(message.class, message.inc)
+	}
+	s.met.messagesRefunded.WithLabelValues(message.class).Add(float64(refunded))
+	slog.Info("Message", "protocol", protocol, "verb", message.verb, "account", message.accountName, "class", message.class, "refunded", refunded)
+	return Reply{Decision: Decision{Remaining: state.Value, Capacity: state.Capacity}}
+}
+
+// handleAcquire acquires a lease on an account's ConcurrencyLimiter for a class,
+// replying with p,<lease> if there is capacity for another operation in flight,
+// or d if not
+func (s *Server) handleAcquire(protocol string, policy *Policy, message *Message) Reply {
+	cp, err := policy.resolveConcurrency(message.accountName, message.class, message.capacity)
+	if err != nil {
+		return Reply{Err: err}
+	}
+	acc, newAccountCreated := s.accounts.LoadOrStore(message.accountName)
+	if newAccountCreated {
+		s.met.accountGauge.Inc()
+	}
+	lease, permitted := acc.concurrency(message.class, cp).Acquire()
+	slog.Info("Message", "protocol", protocol, "verb", message.verb, "account", message.accountName, "class", message.class, "permitted", permitted)
+	if !permitted {
+		s.met.messagesHandled.WithLabelValues(message.class, denyResponse).Inc()
+		return Reply{}
+	}
+	s.met.messagesHandled.WithLabelValues(message.class, permitResponse).Inc()
+	return Reply{Decision: Decision{Permitted: true}, Lease: lease}
+}
+
+// handleRelease releases a lease, replying with p if it was released, or d if
+// there was no such lease, e.g. because it had already expired. Accounts that
+// don't exist yet aren't created, as they can't have any leases.
+func (s *Server) handleRelease(protocol string, message *Message) Reply {
+	released := false
+	acc, ok := s.accounts.Load(message.accountName)
+	if ok {
+		released = acc.release(message.class, message.lease)
+	}
+	slog.Info("Message", "protocol", protocol, "verb", message.verb, "account", message.accountName, "class", message.class, "released", released)
+	return Reply{Decision: Decision{Permitted: released}}
+}
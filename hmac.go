@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A signed message wraps any text message, so that the server can tell that it came
+// from a client that knows a shared secret:
+//
+//	s1 <keyID> <timestamp> <nonce> <signature> <message>
+//
+// where the timestamp is in unix seconds, the nonce is chosen by the client and must
+// be different for every message, and the signature is the hex HMAC-SHA256, keyed by
+// the secret with the keyID, of
+//
+//	<keyID> <timestamp> <nonce> <message>
+//
+// Messages whose timestamp is more than the window away from the server's clock are
+// rejected, as are messages that reuse a nonce within the window, so that a signed
+// message can't be replayed.
+const signedPrefix = "s1 "
+
+// defaultSigningWindow is how far a signed message's timestamp can be from the server's
+// clock, if the policy doesn't say
+const defaultSigningWindow = 30 * time.Second
+
+// maxNonce is the length of the longest nonce
+const maxNonce = 64
+
+// signedProtocols are the protocols whose messages must be signed when the policy
+// requires it. Stream connections are harder to spoof, and can use TLS instead.
+var signedProtocols = []string{"UDP"}
+
+// reasons for rejecting a message, which are distinct in the messagesErrored metric
+var (
+	errUnsigned       = errors.New("message must be signed")
+	errMalformedSign  = errors.New("malformed signed message")
+	errUnknownKey     = errors.New("unknown signing key")
+	errBadSignature   = errors.New("bad signature")
+	errStaleTimestamp = errors.New("timestamp outside signing window")
+	errReplayedNonce  = errors.New("replayed nonce")
+)
+
+// SigningPolicy is the shared secrets that clients sign their messages with, by key
+// ID, so that a secret can be rotated by adding a new key, moving the clients over to
+// it, then removing the old one. If Required is true, unsigned messages are rejected
+// from the signedProtocols.
+type SigningPolicy struct {
+	Required bool              `json:"required,omitempty"`
+	Window   Duration          `json:"window,omitempty"`
+	Keys     map[string]string `json:"keys"`
+}
+
+// validate checks that the key IDs can be written in a signed message, and that
+// there is a key if signing is required
+func (sp *SigningPolicy) validate() error {
+	if sp.Window < 0 {
+		return errors.New("window cannot be negative")
+	}
+	if sp.Required && len(sp.Keys) == 0 {
+		return errors.New("signing is required, but there are no keys")
+	}
+	for keyID, secret := range sp.Keys {
+		if keyID == "" || strings.ContainsAny(keyID, " \t\r\n") {
+			return errors.New("invalid key ID " + strconv.Quote(keyID))
+		}
+		if secret == "" {
+			return errors.New("key " + strconv.Quote(keyID) + " has no secret")
+		}
+	}
+	return nil
+}
+
+// requires returns whether messages from a protocol must be signed. A nil
+// SigningPolicy doesn't require anything.
+func (sp *SigningPolicy) requires(protocol string) bool {
+	return sp != nil && sp.Required && slices.Contains(signedProtocols, protocol)
+}
+
+// window is how far a signed message's timestamp can be from the server's clock
+func (sp *SigningPolicy) window() time.Duration {
+	if sp.Window > 0 {
+		return time.Duration(sp.Window)
+	}
+	return defaultSigningWindow
+}
+
+// signature is the hex HMAC-SHA256 of a message's key ID, timestamp, nonce and message
+func signature(secret string, keyID string, timestamp string, nonce string, message string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(keyID + " " + timestamp + " " + nonce + " " + message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signMessage wraps a message in a signed message, as a client would
+func signMessage(keyID string, secret string, timestamp time.Time, nonce string, message string) string {
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	return signedPrefix + keyID + " " + ts + " " + nonce + " " + signature(secret, keyID, ts, nonce, message) + " " + message
+}
+
+// authenticate unwraps a signed message, returning the message inside it and setting
+// the Caller's KeyID. Unsigned messages are returned unchanged, unless the policy
+// requires them to be signed.
+func (s *Server) authenticate(protocol string, policy *Policy, caller *Caller, str string) (string, error) {
+	if !strings.HasPrefix(str, signedPrefix) {
+		if policy.Signing.requires(protocol) {
+			return "", errUnsigned
+		}
+		return str, nil
+	}
+
+	fields := strings.SplitN(str[len(signedPrefix):], " ", 5)
+	if len(fields) != 5 || len(fields[2]) == 0 || len(fields[2]) > maxNonce {
+		return "", errMalformedSign
+	}
+	keyID, ts, nonce, sig, message := fields[0], fields[1], fields[2], fields[3], fields[4]
+	if policy.Signing == nil {
+		return "", errUnknownKey
+	}
+	secret, ok := policy.Signing.Keys[keyID]
+	if !ok {
+		return "", errUnknownKey
+	}
+	if !hmac.Equal([]byte(sig), []byte(signature(secret, keyID, ts, nonce, message))) {
+		return "", errBadSignature
+	}
+
+	// only messages with a good signature get this far, so that nonces can't be used
+	// up by anyone who doesn't know the secret
+	seconds, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "", errMalformedSign
+	}
+	now := time.Now()
+	window := policy.Signing.window()
+	timestamp := time.Unix(seconds, 0)
+	if timestamp.Before(now.Add(-window)) || timestamp.After(now.Add(window)) {
+		return "", errStaleTimestamp
+	}
+	if !s.nonces.add(keyID+" "+nonce, timestamp.Add(window), now) {
+		return "", errReplayedNonce
+	}
+	caller.KeyID = keyID
+	return message, nil
+}
+
+// nonceCache remembers the nonces of signed messages until their timestamp falls
+// outside the signing window, after which the message would be rejected anyway
+type nonceCache struct {
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+// add remembers a nonce until it expires, returning false if it has already been seen
+func (nc *nonceCache) add(nonce string, expires time.Time, now time.Time) bool {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if nc.seen == nil {
+		nc.seen = map[string]time.Time{}
+	}
+
+	// forget the expired nonces every so often, so that the cache doesn't grow forever
+	if now.Sub(nc.lastSweep) > refreshInterval {
+		for n, e := range nc.seen {
+			if !now.Before(e) {
+				delete(nc.seen, n)
+			}
+		}
+		nc.lastSweep = now
+	}
+
+	if e, ok := nc.seen[nonce]; ok && now.Before(e) {
+		return false
+	}
+	nc.seen[nonce] = expires
+	return true
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// signingServer creates a Server whose policy has two signing keys
+func signingServer(required bool) *Server {
+	server := NewServer(8888, NewMetrics())
+	p := NewPolicy()
+	p.Signing = &SigningPolicy{
+		Required: required,
+		Keys:     map[string]string{"k1": "old secret", "k2": "new secret"},
+	}
+	server.SetPolicy(p)
+	return server
+}
+
+func Test_hmac_signed(t *testing.T) {
+	server := signingServer(true)
+	now := time.Now()
+
+	// either key can sign messages, so that secrets can be rotated
+	if reply := server.handleMessage("UDP", signMessage("k1", "old secret", now, "n1", "gb,l,10,1")); reply != "p" {
+		t.Errorf("Expected %v, got %v", "p", reply)
+	}
+	if reply := server.handleMessage("UDP", signMessage("k2", "new secret", now, "n1", "v2 7 ALLOW gb l 1 10")); reply != "v2 7 p 8 10 0" {
+		t.Errorf("Expected %v, got %v", "v2 7 p 8 10 0", reply)
+	}
+
+	// the Caller knows which key signed the message
+	caller := Caller{}
+	message, err := server.authenticate("UDP", server.policy.Load(), &caller, signMessage("k2", "new secret", now, "n2", "PEEK,gb,l"))
+	if err != nil || message != "PEEK,gb,l" || caller.KeyID != "k2" {
+		t.Errorf("Expected PEEK,gb,l signed by k2, got %v %v (%v)", message, caller.KeyID, err)
+	}
+
+	// unsigned messages are only rejected from UDP
+	if reply := server.handleMessage("UDP", "gb,l,10,1"); reply != "d" {
+		t.Errorf("Expected an unsigned UDP message to be rejected, got %v", reply)
+	}
+	if reply := server.handleMessage("TCP", "gb,l,10,1"); reply != "p" {
+		t.Errorf("Expected an unsigned TCP message to be permitted, got %v", reply)
+	}
+	_, reply, _ := decodeReply(server.handleBinary("UDP", Caller{}, encodeRequest(1, &Message{verb: verbAllow, accountName: "gb", class: "l", inc: 1, capacity: 10})))
+	if reply.Err == nil {
+		t.Error("Expected an unsigned binary UDP frame to be rejected")
+	}
+}
+
+func Test_hmac_rejected(t *testing.T) {
+	server := signingServer(false)
+	now := time.Now()
+	valid := signMessage("k1", "old secret", now, "n1", "gb,l,10,1")
+	tests := []struct {
+		message string
+		reason  error
+	}{
+		{"s1 k1 " + "gb,l,10,1", errMalformedSign},
+		{signMessage("k3", "old secret", now, "n1", "gb,l,10,1"), errUnknownKey},
+		{signMessage("k1", "wrong secret", now, "n1", "gb,l,10,1"), errBadSignature},
+		{valid[:len(valid)-1] + "2", errBadSignature},
+		{signMessage("k1", "old secret", now.Add(-time.Minute), "n1", "gb,l,10,1"), errStaleTimestamp},
+		{signMessage("k1", "old secret", now.Add(time.Minute), "n1", "gb,l,10,1"), errStaleTimestamp},
+		{valid, nil},
+		{valid, errReplayedNonce},
+	}
+	for _, test := range tests {
+		_, err := server.authenticate("UDP", server.policy.Load(), &Caller{}, test.message)
+		if err != test.reason {
+			t.Errorf("Expected %v for %q, got %v", test.reason, test.message, err)
+		}
+		if test.reason == nil {
+			continue
+		}
+		// each reason is counted separately
+		before := testutil.ToFloat64(server.met.messagesErrored.WithLabelValues(test.reason.Error()))
+		server.handleMessage("UDP", test.message)
+		after := testutil.ToFloat64(server.met.messagesErrored.WithLabelValues(test.reason.Error()))
+		if after != before+1 {
+			t.Errorf("Expected %v to be counted, got %v", test.reason, after-before)
+		}
+	}
+
+	// unsigned messages are fine, as signing isn't required
+	if reply := server.handleMessage("UDP", "gb,l,10,1"); reply != "p" {
+		t.Errorf("Expected %v, got %v", "p", reply)
+	}
+}
+
+func Test_hmac_nonce_cache(t *testing.T) {
+	var nc nonceCache
+	now := time.Now()
+	if !nc.add("a", now.Add(time.Second), now) {
+		t.Error("Expected a new nonce to be added")
+	}
+	if nc.add("a", now.Add(time.Second), now) {
+		t.Error("Expected a seen nonce not to be added")
+	}
+	// expired nonces are forgotten
+	later := now.Add(2 * time.Second)
+	if !nc.add("b", later.Add(time.Second), later) || len(nc.seen) != 1 {
+		t.Errorf("Expected expired nonces to be forgotten, got %v", nc.seen)
+	}
+}
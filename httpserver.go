@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// httpShutdownTimeout is how long in-flight HTTP requests have to finish on shutdown
+const httpShutdownTimeout = 5 * time.Second
+
+// httpReadTimeout is how long a client has to send a request's headers and body, as
+// long as the TCP and RESP listeners wait for an idle connection, so that slow
+// clients can't hold connections open
+const httpReadTimeout = 30 * time.Second
+
+// httpRequest is the JSON body of a request to the HTTP API. The inc defaults to 1
+// and the capacity, if it is left out, comes from the policy.
+type httpRequest struct {
+	Account  string `json:"account"`
+	Class    string `json:"class"`
+	Inc      int    `json:"inc,omitempty"`
+	Capacity int    `json:"capacity,omitempty"`
+}
+
+// httpBatchRequest is the JSON body of a batch request to the HTTP API
+type httpBatchRequest struct {
+	All      bool          `json:"all,omitempty"`
+	Requests []httpRequest `json:"requests"`
+}
+
+// httpDecision is the JSON body of a decision made by the HTTP API. Requests in a
+// batch that couldn't be decided, e.g. because the policy has no limit for their
+// class, have an Error.
+type httpDecision struct {
+	Permitted    bool   `json:"permitted"`
+	Forbidden    bool   `json:"forbidden,omitempty"`
+	Error        string `json:"error,omitempty"`
+	Remaining    int    `json:"remaining"`
+	Capacity     int    `json:"capacity"`
+	RetryAfterMs int64  `json:"retryAfterMs"`
+}
+
+// httpBucket is the JSON body describing a bucket
+type httpBucket struct {
+	Account  string `json:"account"`
+	Class    string `json:"class"`
+	Value    int    `json:"value"`
+	Capacity int    `json:"capacity"`
+}
+
+// httpLease is the JSON body describing a lease
+type httpLease struct {
+	Account string `json:"account"`
+	Class   string `json:"class"`
+	Lease   string `json:"lease"`
+}
+
+// httpError is the JSON body of an error
+type httpError struct {
+	Error string `json:"error"`
+}
+
+// runHTTPServer executes the HTTP API server, until the context is done, when
+// it stops accepting new requests and waits for those in flight to finish
+func (s *Server) runHTTPServer(ctx context.Context) {
+	defer s.wg.Done()
+
+	addr := fmt.Sprintf(":%v", s.httpPort)
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           s.httpHandler(),
+		ReadHeaderTimeout: httpReadTimeout,
+		ReadTimeout:       httpReadTimeout,
+	}
+
+	go func() {
+		slog.Info("HTTP API listening on " + addr)
+		if err := srv.ListenAndServe(); err != nil {
+			if errors.Is(err, http.ErrServerClosed) {
+				slog.Info("HTTP server closed")
+				return
+			}
+			slog.Error("HTTP server", "error", err)
+		}
+	}()
+
+	<-ctx.Done()
+	slog.Info("Closing HTTP server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+	srv.Shutdown(shutdownCtx)
+}
+
+// httpHandler routes the HTTP API's requests
+func (s *Server) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/allow", s.httpAllow)
+	mux.HandleFunc("POST /v1/refund", s.httpRefund)
+	mux.HandleFunc("POST /v1/batch", s.httpBatch)
+	mux.HandleFunc("POST /v1/leases", s.httpAcquire)
+	mux.HandleFunc("DELETE /v1/leases/{name}/{class}/{lease}", s.httpRelease)
+	mux.HandleFunc("GET /v1/accounts/{name}", s.httpAccount)
+	mux.HandleFunc("GET /v1/accounts/{name}/{class}", s.httpPeek)
+	return mux
+}
+
+// httpAllow removes inc from a bucket, replying with 429 Too Many Requests if it is denied
+func (s *Server) httpAllow(w http.ResponseWriter, r *http.Request) {
+	var body httpRequest
+	if !readJSON(w, r, &body) {
+		return
+	}
+	reply, ok := s.httpHandle(w, r, body.message(verbAllow))
+	if !ok {
+		return
+	}
+	writeDecision(w, reply.Decision)
+}
+
+// httpRefund adds inc back to a bucket, replying with its value and capacity
+func (s *Server) httpRefund(w http.ResponseWriter, r *http.Request) {
+	var body httpRequest
+	if !readJSON(w, r, &body) {
+		return
+	}
+	message := body.message(verbRefund)
+	reply, ok := s.httpHandle(w, r, message)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, httpBucket{
+		Account:  message.accountName,
+		Class:    message.class,
+		Value:    reply.Remaining,
+		Capacity: reply.Capacity,
+	})
+}
+
+// httpBatch makes several decisions at once. An all-or-nothing batch that is
+// denied gets a 429 Too Many Requests, a 403 Forbidden if the ACL forbids it, or a
+// 400 Bad Request if any of its requests couldn't be decided.
+func (s *Server) httpBatch(w http.ResponseWriter, r *http.Request) {
+	var body httpBatchRequest
+	if !readJSON(w, r, &body) {
+		return
+	}
+	if len(body.Requests) == 0 || len(body.Requests) > maxBatch {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("batch must contain between 1 and %d requests", maxBatch))
+		return
+	}
+	message := &Message{verb: verbBatch, all: body.All}
+	for _, request := range body.Requests {
+		message.batch = append(message.batch, request.message(verbAllow))
+	}
+	reply, ok := s.httpHandle(w, r, message)
+	if !ok {
+		return
+	}
+	decisions := make([]httpDecision, len(reply.Batch))
+	status := http.StatusOK
+	var retryAfter time.Duration
+	for i, d := range reply.Batch {
+		decisions[i] = newHTTPDecision(d.Decision)
+		decisions[i].Forbidden = d.Forbidden
+		if d.Err != nil {
+			decisions[i].Error = d.Err.Error()
+		}
+		switch {
+		case !body.All:
+		case d.Forbidden:
+			status = http.StatusForbidden
+		case d.Err != nil && status != http.StatusForbidden:
+			status = http.StatusBadRequest
+		case !d.Permitted && (status == http.StatusOK || status == http.StatusTooManyRequests):
+			status = http.StatusTooManyRequests
+			retryAfter = d.RetryAfter
+		}
+	}
+	if status == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+	}
+	writeJSON(w, status, map[string][]httpDecision{"decisions": decisions})
+}
+
+// httpAcquire acquires a lease, replying with 201 Created and the lease, or with
+// 429 Too Many Requests if there are already capacity leases
+func (s *Server) httpAcquire(w http.ResponseWriter, r *http.Request) {
+	var body httpRequest
+	if !readJSON(w, r, &body) {
+		return
+	}
+	message := body.message(verbAcquire)
+	reply, ok := s.httpHandle(w, r, message)
+	if !ok {
+		return
+	}
+	if !reply.Permitted {
+		writeError(w, http.StatusTooManyRequests, errors.New("too many leases"))
+		return
+	}
+	writeJSON(w, http.StatusCreated, httpLease{
+		Account: message.accountName,
+		Class:   message.class,
+		Lease:   reply.Lease,
+	})
+}
+
+// httpRelease releases a lease, replying with 204 No Content, or 404 Not Found
+// if there is no such lease
+func (s *Server) httpRelease(w http.ResponseWriter, r *http.Request) {
+	message := &Message{
+		verb:        verbRelease,
+		accountName: r.PathValue("name"),
+		class:       r.PathValue("class"),
+		lease:       r.PathValue("lease"),
+	}
+	reply, ok := s.httpHandle(w, r, message)
+	if !ok {
+		return
+	}
+	if !reply.Permitted {
+		writeError(w, http.StatusNotFound, errors.New("no such lease"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// httpPeek replies with a bucket's value and capacity, without changing it
+func (s *Server) httpPeek(w http.ResponseWriter, r *http.Request) {
+	message := &Message{
+		verb:        verbPeek,
+		accountName: r.PathValue("name"),
+		class:       r.PathValue("class"),
+	}
+	reply, ok := s.httpHandle(w, r, message)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, httpBucket{
+		Account:  message.accountName,
+		Class:    message.class,
+		Value:    reply.Remaining,
+		Capacity: reply.Capacity,
+	})
+}
+
+// httpAccount replies with an account's buckets and leases, or 404 Not Found if
+// the account doesn't exist. Reading a whole account needs the ACL to permit PEEK
+// on it, or the reply is a 403 Forbidden.
+func (s *Server) httpAccount(w http.ResponseWriter, r *http.Request) {
+	message := &Message{verb: verbPeek, accountName: r.PathValue("name")}
+	caller := httpCaller(r)
+	if !s.policy.Load().permits(caller, message) {
+		s.forbidden("HTTP", caller, message)
+		writeError(w, http.StatusForbidden, errForbidden)
+		return
+	}
+	acc, ok := s.accounts.Load(message.accountName)
+	if !ok {
+		writeError(w, http.StatusNotFound, errors.New("no such account"))
+		return
+	}
+	writeJSON(w, http.StatusOK, acc)
+}
+
+// httpHandle validates a Message and handles it in the same way as a message from
+// any other protocol. If the Message is invalid, or handling it errors, a 400 Bad
+// Request is written and false is returned, or a 403 Forbidden if the ACL forbids it.
+func (s *Server) httpHandle(w http.ResponseWriter, r *http.Request, message *Message) (Reply, bool) {
+	timer := prometheus.NewTimer(s.met.httpRequestDuration)
+	defer timer.ObserveDuration()
+	s.met.messagesProcessed.WithLabelValues("HTTP").Inc()
+
+	policy := s.policy.Load()
+	requests := []*Message{message}
+	if message.verb == verbBatch {
+		requests = message.batch
+	}
+	for _, request := range requests {
+		if err := request.validate(policy.Classes); err != nil {
+			s.errored("HTTP", err)
+			writeError(w, http.StatusBadRequest, err)
+			return Reply{}, false
+		}
+	}
+	reply := s.handle("HTTP", httpCaller(r), policy, message)
+	if reply.Forbidden {
+		writeError(w, http.StatusForbidden, errForbidden)
+		return reply, false
+	}
+	if reply.Err != nil {
+		writeError(w, http.StatusBadRequest, reply.Err)
+		return reply, false
+	}
+	return reply, true
+}
+
+// httpCaller identifies the Caller that made a request by its address
+func httpCaller(r *http.Request) Caller {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return Caller{}
+	}
+	return Caller{Addr: net.TCPAddrFromAddrPort(addrPort)}
+}
+
+// message turns the body of a request into a Message with the verb
+func (hr httpRequest) message(verb string) *Message {
+	inc := hr.Inc
+	if inc == 0 && (verb == verbAllow || verb == verbRefund) {
+		inc = 1
+	}
+	return &Message{
+		verb:        verb,
+		accountName: hr.Account,
+		class:       hr.Class,
+		inc:         inc,
+		capacity:    hr.Capacity,
+	}
+}
+
+// newHTTPDecision converts a Decision to JSON
+func newHTTPDecision(d Decision) httpDecision {
+	return httpDecision{
+		Permitted:    d.Permitted,
+		Remaining:    d.Remaining,
+		Capacity:     d.Capacity,
+		RetryAfterMs: milliseconds(d.RetryAfter),
+	}
+}
+
+// writeDecision writes a Decision, which is a 429 Too Many Requests with a
+// Retry-After header if it isn't permitted
+func writeDecision(w http.ResponseWriter, d Decision) {
+	if !d.Permitted {
+		w.Header().Set("Retry-After", retryAfterSeconds(d.RetryAfter))
+		writeJSON(w, http.StatusTooManyRequests, newHTTPDecision(d))
+		return
+	}
+	writeJSON(w, http.StatusOK, newHTTPDecision(d))
+}
+
+// retryAfterSeconds is the value of a Retry-After header, which is in whole
+// seconds, rounded up, and at least 1
+func retryAfterSeconds(d time.Duration) string {
+	return strconv.Itoa(max(int(math.Ceil(d.Seconds())), 1))
+}
+
+// readJSON decodes a JSON request body, writing a 400 Bad Request and returning
+// false if it can't be
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxDatagram))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
+
+// writeError writes an error as JSON
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, httpError{Error: err.Error()})
+}
+
+// writeJSON writes a JSON response
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("HTTP failed to send response", "error", err)
+	}
+}
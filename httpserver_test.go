@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// httpDo makes a request to the server's HTTP API, returning the response and
+// decoding its JSON body into v, if there is one
+func httpDo(t *testing.T, server *Server, method string, path string, body string, v any) *http.Response {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	server.httpHandler().ServeHTTP(recorder, httptest.NewRequest(method, path, strings.NewReader(body)))
+	response := recorder.Result()
+	if v != nil {
+		if err := json.NewDecoder(response.Body).Decode(v); err != nil {
+			t.Fatalf("Expected JSON response to %v %v, got %v", method, path, err)
+		}
+	}
+	return response
+}
+
+func Test_http_allow(t *testing.T) {
+	met := NewMetrics()
+	server := NewServer(8888, met)
+	var decision httpDecision
+	response := httpDo(t, server, "POST", "/v1/allow", `{ "account": "gb", "class": "l", "capacity": 2 }`, &decision)
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("Expected status %v, got %v", http.StatusOK, response.StatusCode)
+	}
+	if !decision.Permitted || decision.Remaining != 1 || decision.Capacity != 2 {
+		t.Errorf("Expected permitted 1/2, got %v", decision)
+	}
+	httpDo(t, server, "POST", "/v1/allow", `{ "account": "gb", "class": "l", "capacity": 2 }`, nil)
+
+	// denials are 429s with a Retry-After
+	response = httpDo(t, server, "POST", "/v1/allow", `{ "account": "gb", "class": "l", "inc": 1, "capacity": 2 }`, &decision)
+	if response.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected status %v, got %v", http.StatusTooManyRequests, response.StatusCode)
+	}
+	if response.Header.Get("Retry-After") != "1" {
+		t.Errorf("Expected Retry-After to be %v, got %v", "1", response.Header.Get("Retry-After"))
+	}
+	if decision.Permitted {
+		t.Error("Expected decision to be denied, got permitted")
+	}
+
+	// the HTTP API and the text protocol share buckets
+	if server.handleMessage("test", "PEEK,gb,l") != "0,2" {
+		t.Error("Expected the text protocol to see the HTTP API's bucket")
+	}
+
+	// invalid requests are 400s
+	for _, body := range []string{`gibberish`, `{ "account": "gb", "class": "x", "capacity": 2 }`, `{ "account": "gb", "class": "l" }`, `{ "account": "gb", "class": "l", "bucket": 2 }`} {
+		var httpErr httpError
+		response = httpDo(t, server, "POST", "/v1/allow", body, &httpErr)
+		if response.StatusCode != http.StatusBadRequest || httpErr.Error == "" {
+			t.Errorf("Expected status %v with an error for %v, got %v %v", http.StatusBadRequest, body, response.StatusCode, httpErr)
+		}
+	}
+}
+
+func Test_http_accounts(t *testing.T) {
+	met := NewMetrics()
+	server := NewServer(8888, met)
+	response := httpDo(t, server, "GET", "/v1/accounts/gb", "", nil)
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status %v, got %v", http.StatusNotFound, response.StatusCode)
+	}
+	server.handleMessage("test", "gb,l,10,3")
+
+	var bucket httpBucket
+	httpDo(t, server, "GET", "/v1/accounts/gb/l", "", &bucket)
+	if bucket.Value != 7 || bucket.Capacity != 10 {
+		t.Errorf("Expected bucket to be 7/10, got %v", bucket)
+	}
+	httpDo(t, server, "POST", "/v1/refund", `{ "account": "gb", "class": "l", "inc": 2 }`, &bucket)
+	if bucket.Value != 9 || bucket.Capacity != 10 {
+		t.Errorf("Expected refunded bucket to be 9/10, got %v", bucket)
+	}
+
+	var account map[string]any
+	response = httpDo(t, server, "GET", "/v1/accounts/gb", "", &account)
+	if response.StatusCode != http.StatusOK || account["name"] != "gb" {
+		t.Errorf("Expected account gb, got %v %v", response.StatusCode, account)
+	}
+}
+
+func Test_http_batch(t *testing.T) {
+	met := NewMetrics()
+	server := NewServer(8888, met)
+	var batch map[string][]httpDecision
+	body := `{ "all": true, "requests": [ { "account": "gb", "class": "w", "capacity": 1 }, { "account": "gb", "class": "q", "capacity": 1 } ] }`
+	response := httpDo(t, server, "POST", "/v1/batch", body, &batch)
+	if response.StatusCode != http.StatusOK || len(batch["decisions"]) != 2 || !batch["decisions"][1].Permitted {
+		t.Errorf("Expected batch to be permitted, got %v %v", response.StatusCode, batch)
+	}
+	response = httpDo(t, server, "POST", "/v1/batch", body, &batch)
+	if response.StatusCode != http.StatusTooManyRequests || batch["decisions"][0].Permitted {
+		t.Errorf("Expected batch to be denied, got %v %v", response.StatusCode, batch)
+	}
+	response = httpDo(t, server, "POST", "/v1/batch", `{ "requests": [] }`, nil)
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status %v, got %v", http.StatusBadRequest, response.StatusCode)
+	}
+}
+
+func Test_http_batch_errors(t *testing.T) {
+	server := NewServer(8888, NewMetrics())
+	p := NewPolicy()
+	p.Mode = modeIgnore
+	p.Default["l"] = ClassPolicy{Capacity: 2}
+	server.SetPolicy(p)
+
+	// a request that can't be decided has an error, rather than being denied
+	var batch map[string][]httpDecision
+	body := `{ "requests": [ { "account": "gb", "class": "l" }, { "account": "gb", "class": "w" } ] }`
+	response := httpDo(t, server, "POST", "/v1/batch", body, &batch)
+	if response.StatusCode != http.StatusOK || !batch["decisions"][0].Permitted || batch["decisions"][1].Error == "" {
+		t.Errorf("Expected the second request to have an error, got %v %v", response.StatusCode, batch)
+	}
+
+	// which fails an all-or-nothing batch as a bad request, without taking anything
+	batch = nil
+	body = `{ "all": true, "requests": [ { "account": "gb", "class": "l" }, { "account": "gb", "class": "w" } ] }`
+	response = httpDo(t, server, "POST", "/v1/batch", body, &batch)
+	if response.StatusCode != http.StatusBadRequest || response.Header.Get("Retry-After") != "" || batch["decisions"][1].Error == "" {
+		t.Errorf("Expected status %v with an error, got %v %v", http.StatusBadRequest, response.StatusCode, batch)
+	}
+	if reply := server.handleMessage("test", "PEEK,gb,l"); reply != "1,2" {
+		t.Errorf("Expected nothing to be taken from l, got %v", reply)
+	}
+}
+
+func Test_http_leases(t *testing.T) {
+	met := NewMetrics()
+	server := NewServer(8888, met)
+	var lease httpLease
+	response := httpDo(t, server, "POST", "/v1/leases", `{ "account": "gb", "class": "l", "capacity": 1 }`, &lease)
+	if response.StatusCode != http.StatusCreated || lease.Lease == "" {
+		t.Errorf("Expected lease to be created, got %v %v", response.StatusCode, lease)
+	}
+	response = httpDo(t, server, "POST", "/v1/leases", `{ "account": "gb", "class": "l", "capacity": 1 }`, nil)
+	if response.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected status %v, got %v", http.StatusTooManyRequests, response.StatusCode)
+	}
+	response = httpDo(t, server, "DELETE", "/v1/leases/gb/l/"+lease.Lease, "", nil)
+	if response.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected status %v, got %v", http.StatusNoContent, response.StatusCode)
+	}
+	response = httpDo(t, server, "DELETE", "/v1/leases/gb/l/"+lease.Lease, "", nil)
+	if response.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected status %v, got %v", http.StatusNotFound, response.StatusCode)
+	}
+
+	// with a policy, the capacity is optional
+	policy := NewPolicy()
+	policy.Mode = modeIgnore
+	policy.Default["w"] = ClassPolicy{Concurrency: 1}
+	server.SetPolicy(policy)
+	response = httpDo(t, server, "POST", "/v1/leases", `{ "account": "gb", "class": "w" }`, nil)
+	if response.StatusCode != http.StatusCreated {
+		t.Errorf("Expected status %v, got %v", http.StatusCreated, response.StatusCode)
+	}
+}
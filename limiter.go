@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Limiter is implemented by each rate limiting algorithm, so that an Account
+// can use a different algorithm for each class. Implementations must be safe
+// for concurrent use.
+type Limiter interface {
+	// Allow removes n from the limiter, if there is enough left
+	Allow(n int) Decision
+	// Peek returns the Decision that Allow would make, without removing anything
+	Peek(n int) Decision
+	// Refund adds n back to the limiter, up to its capacity, returning how much was added
+	Refund(n int) int
+	// Reset is called every refreshInterval, for limiters that need topping up
+	Reset()
+	// State returns a snapshot of the limiter, suitable for JSON
+	State() LimiterState
+	// SetLimit changes the limiter's capacity, rate and window, keeping its
+	// current value unless that exceeds the new capacity
+	SetLimit(cp ClassPolicy)
+}
+
+// Decision is the result of asking a Limiter for n. RetryAfter is how long
+// to wait until n would be permitted, or zero if that isn't known, and ResetAfter
+// is how long until the limiter is full again, if it refills by itself. A denial
+// that resets is lifted when the fixed windows are next reset.
+type Decision struct {
+	Permitted  bool
+	Remaining  int
+	Capacity   int
+	RetryAfter time.Duration
+	ResetAfter time.Duration
+	resets     bool
+}
+
+// LimiterState is a snapshot of a Limiter's value and capacity. A Limiter made
+// up of other limiters includes their State too.
+type LimiterState struct {
+	Algorithm string         `json:"algorithm"`
+	Value     int            `json:"value"`
+	Capacity  int            `json:"capacity"`
+	Limits    []LimiterState `json:"limits,omitempty"`
+}
+
+// LimiterFactory creates a new, full, Limiter for a ClassPolicy
+type LimiterFactory func(cp ClassPolicy) Limiter
+
+// limiterFactories is the registry of algorithms that a ClassPolicy can choose
+var limiterFactories = map[string]LimiterFactory{
+	algorithmFixed:   NewFixedWindow,
+	algorithmToken:   NewTokenBucket,
+	algorithmGCRA:    NewGCRA,
+	algorithmSliding: NewSlidingWindow,
+}
+
+// RegisterLimiter adds an algorithm to the registry, so that it can be
+// chosen by name in the policy. It must be called before the policy is loaded.
+func RegisterLimiter(algorithm string, factory LimiterFactory) {
+	limiterFactories[algorithm] = factory
+}
+
+// NewLimiter creates a Limiter using the ClassPolicy's algorithm, or a
+// StackedLimiter if the ClassPolicy has stacked Limits
+func NewLimiter(cp ClassPolicy) (Limiter, error) {
+	if len(cp.Limits) > 0 {
+		sl, err := NewStackedLimiter(cp)
+		if err != nil {
+			return nil, err
+		}
+		return sl, nil
+	}
+	factory, ok := limiterFactories[cp.Algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unknown algorithm %q", cp.Algorithm)
+	}
+	return factory(cp), nil
+}
+
+// setter is implemented by limiters whose value can be set directly
+type setter interface {
+	set(value int, capacity int) error
+}
+
+// interval is the time it takes to accrue n tokens at rate tokens per second
+func interval(n int, rate float64) time.Duration {
+	return time.Duration(float64(n) / rate * float64(time.Second))
+}
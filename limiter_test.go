@@ -0,0 +1,67 @@
+package main
+
+import "testing"
+
+// countingLimiter is a custom Limiter that permits everything, counting the requests
+type countingLimiter struct {
+	Bucket
+	requests int
+}
+
+func (cl *countingLimiter) Allow(n int) Decision {
+	cl.requests += n
+	return Decision{Permitted: true}
+}
+
+func Test_limiter_new(t *testing.T) {
+	for algorithm := range limiterFactories {
+		l, err := NewLimiter(ClassPolicy{Algorithm: algorithm, Capacity: 10, Rate: 10})
+		if err != nil {
+			t.Errorf("Expected no error creating %v limiter, got %v", algorithm, err)
+			continue
+		}
+		state := l.State()
+		if state.Algorithm != algorithm {
+			t.Errorf("Expected %v limiter to report its algorithm, got %v", algorithm, state.Algorithm)
+		}
+		// new limiters start full
+		if state.Value != 10 || state.Capacity != 10 {
+			t.Errorf("Expected %v limiter to be 10/10, got %v/%v", algorithm, state.Value, state.Capacity)
+		}
+		if !l.Allow(10).Permitted {
+			t.Errorf("Expected %v limiter to permit its capacity", algorithm)
+		}
+		if l.Allow(1).Permitted {
+			t.Errorf("Expected %v limiter to deny beyond its capacity", algorithm)
+		}
+	}
+}
+
+func Test_limiter_new_unknown(t *testing.T) {
+	_, err := NewLimiter(ClassPolicy{Algorithm: "magic", Capacity: 10})
+	if err == nil {
+		t.Error("Expected error creating unknown limiter, got nil")
+	}
+}
+
+func Test_limiter_register(t *testing.T) {
+	RegisterLimiter("counting", func(cp ClassPolicy) Limiter {
+		return &countingLimiter{}
+	})
+	defer delete(limiterFactories, "counting")
+
+	p, err := LoadPolicy(writePolicyFile(t, `{ "default": { "l": { "algorithm": "counting", "capacity": 1 } } }`))
+	if err != nil {
+		t.Fatalf("Expected no error loading policy with registered algorithm, got %v", err)
+	}
+	cp, _ := p.resolve("bob", "l", 1)
+	l, err := NewLimiter(cp)
+	if err != nil {
+		t.Fatalf("Expected no error creating registered limiter, got %v", err)
+	}
+	l.Allow(5)
+	l.Allow(5)
+	if l.(*countingLimiter).requests != 10 {
+		t.Errorf("Expected registered limiter to have counted %v, got %v", 10, l.(*countingLimiter).requests)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"io/fs"
 	"log/slog"
 	"os"
 	"os/signal"
@@ -19,7 +20,16 @@ func main() {
 		os.Interrupt,    // Ctrl+C
 		syscall.SIGTERM, // kill
 	)
-	defer stop()
+
+	// run the subcommand, which is serve by default
+	code := runCommand(ctx, os.Args[1:], os.Stdout, os.Stderr)
+	stop()
+	os.Exit(code)
+}
+
+// serve configures the server from environment variables and runs it until the
+// context is done
+func serve(ctx context.Context) {
 
 	// look for override of default port using environment variable
 	portStr := os.Getenv("PORT")
@@ -38,8 +48,98 @@ func main() {
 	// initialise metrics
 	met := NewMetrics()
 
-	// run the server
+	// load the quota policy file, if there is one
 	server := NewServer(port, met)
+	policyFile := os.Getenv("POLICY_FILE")
+	if policyFile != "" {
+		if err := server.LoadPolicyFile(policyFile); err != nil {
+			slog.Error("Cannot load POLICY_FILE", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("Loaded policy", "file", policyFile)
+	}
+
+	// turn on the HTTP API, if it has a port
+	httpPortStr := os.Getenv("HTTP_PORT")
+	if httpPortStr != "" {
+		httpPort, err := strconv.Atoi(httpPortStr)
+		if err != nil {
+			slog.Error("Cannot parse HTTP_PORT environment variable as integer", "error", err)
+			os.Exit(1)
+		}
+		server.SetHTTPPort(httpPort)
+	}
+
+	// turn on the Envoy rate limit gRPC service, if it has a port
+	grpcPortStr := os.Getenv("GRPC_PORT")
+	if grpcPortStr != "" {
+		grpcPort, err := strconv.Atoi(grpcPortStr)
+		if err != nil {
+			slog.Error("Cannot parse GRPC_PORT environment variable as integer", "error", err)
+			os.Exit(1)
+		}
+		server.SetGRPCPort(grpcPort)
+	}
+
+	// turn on the Redis protocol listener, if it has a port
+	respPortStr := os.Getenv("RESP_PORT")
+	if respPortStr != "" {
+		respPort, err := strconv.Atoi(respPortStr)
+		if err != nil {
+			slog.Error("Cannot parse RESP_PORT environment variable as integer", "error", err)
+			os.Exit(1)
+		}
+		server.SetRESPPort(respPort)
+	}
+
+	// turn on the admin API, if it has a port, which needs a token
+	adminPortStr := os.Getenv("ADMIN_PORT")
+	if adminPortStr != "" {
+		adminPort, err := strconv.Atoi(adminPortStr)
+		if err != nil {
+			slog.Error("Cannot parse ADMIN_PORT environment variable as integer", "error", err)
+			os.Exit(1)
+		}
+		if err := server.SetAdmin(adminPort, os.Getenv("ADMIN_TOKEN")); err != nil {
+			slog.Error("Cannot turn on the admin API without the ADMIN_TOKEN environment variable", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	// turn on the unix socket listeners, if they have paths
+	unixPath := os.Getenv("UNIX_SOCKET")
+	unixgramPath := os.Getenv("UNIXGRAM_SOCKET")
+	if unixPath != "" || unixgramPath != "" {
+		mode := defaultSocketMode
+		modeStr := os.Getenv("UNIX_SOCKET_MODE")
+		if modeStr != "" {
+			m, err := strconv.ParseUint(modeStr, 8, 32)
+			if err != nil || m > 0777 {
+				slog.Error("Cannot parse UNIX_SOCKET_MODE environment variable as octal permissions", "value", modeStr)
+				os.Exit(1)
+			}
+			mode = fs.FileMode(m)
+		}
+		server.SetUnixSockets(unixPath, unixgramPath, mode)
+	}
+
+	// turn on TLS for the TCP listener, if it has a certificate
+	certFile := os.Getenv("TLS_CERT_FILE")
+	identityAccounts := os.Getenv("TLS_IDENTITY_ACCOUNTS") == "true"
+	if identityAccounts && certFile == "" {
+		slog.Error("TLS_IDENTITY_ACCOUNTS needs TLS_CERT_FILE and TLS_CLIENT_CA_FILE")
+		os.Exit(1)
+	}
+	if certFile != "" {
+		err := server.SetTLS(certFile, os.Getenv("TLS_KEY_FILE"), os.Getenv("TLS_CLIENT_CA_FILE"), identityAccounts)
+		if err != nil {
+			slog.Error("Cannot load TLS files", "error", err)
+			os.Exit(1)
+		}
+		slog.Info("TCP listener uses TLS", "cert", certFile)
+	}
+
+	// run the server
 	server.Run(ctx)
 	slog.Info("shutdown complete")
 }
@@ -9,13 +9,17 @@ import (
 
 // metrics collects together all the prometheus metrics in one place
 type metrics struct {
-	accountGauge       prometheus.Gauge
-	messagesProcessed  *prometheus.CounterVec
-	messagesErrored    *prometheus.CounterVec
-	messagesHandled    *prometheus.CounterVec
-	udpRequestDuration prometheus.Histogram
-	tcpRequestDuration prometheus.Histogram
-	socketsGauge       prometheus.Gauge
+	accountGauge        prometheus.Gauge
+	messagesProcessed   *prometheus.CounterVec
+	messagesErrored     *prometheus.CounterVec
+	messagesHandled     *prometheus.CounterVec
+	messagesRefunded    *prometheus.CounterVec
+	udpRequestDuration  prometheus.Histogram
+	tcpRequestDuration  prometheus.Histogram
+	httpRequestDuration prometheus.Histogram
+	respRequestDuration prometheus.Histogram
+	socketsGauge        prometheus.Gauge
+	policyReloads       *prometheus.CounterVec
 }
 
 var (
@@ -48,6 +52,18 @@ func NewMetrics() *metrics {
 			Name:      "handled",
 			Help:      "Total number of messages handled",
 		}, []string{"class", "permitted"})
+		m.messagesRefunded = promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "goudpserver",
+			Subsystem: "messages",
+			Name:      "refunded",
+			Help:      "Total volume refunded to buckets",
+		}, []string{"class"})
+		m.policyReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "goudpserver",
+			Subsystem: "policy",
+			Name:      "reloads",
+			Help:      "Total number of policy reloads",
+		}, []string{"result"})
 		m.accountGauge = prometheus.NewGauge(prometheus.GaugeOpts{
 			Namespace: "goudpserver",
 			Subsystem: "account_map",
@@ -72,6 +88,24 @@ func NewMetrics() *metrics {
 				Buckets:   []float64{0.0001, 0.0002, 0.0003, 0.0004, 0.0005},
 			},
 		)
+		m.httpRequestDuration = prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Namespace: "goudpserver",
+				Subsystem: "http_server",
+				Name:      "request_duration_seconds",
+				Help:      "Time spent processing an HTTP API request.",
+				Buckets:   []float64{0.0001, 0.0002, 0.0003, 0.0004, 0.0005},
+			},
+		)
+		m.respRequestDuration = prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Namespace: "goudpserver",
+				Subsystem: "resp_server",
+				Name:      "request_duration_seconds",
+				Help:      "Time spent processing a RESP command.",
+				Buckets:   []float64{0.0001, 0.0002, 0.0003, 0.0004, 0.0005},
+			},
+		)
 		m.socketsGauge = prometheus.NewGauge(prometheus.GaugeOpts{
 			Namespace: "goudpserver",
 			Subsystem: "tcp_server",
@@ -82,6 +116,8 @@ func NewMetrics() *metrics {
 			m.accountGauge,
 			m.udpRequestDuration,
 			m.tcpRequestDuration,
+			m.httpRequestDuration,
+			m.respRequestDuration,
 			m.socketsGauge)
 	})
 
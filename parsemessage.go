@@ -2,29 +2,86 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"slices"
 	"strconv"
 	"strings"
 )
 
+// message flags
+const richFlag = "r"
+const allFlag = "all"
+
+// message verbs. A message that doesn't start with a verb asks to remove
+// inc from a bucket, so account names can't be the same as a verb.
+const verbAllow = "ALLOW"
+const verbPeek = "PEEK"
+const verbRefund = "REFUND"
+const verbAcquire = "ACQUIRE"
+const verbRelease = "RELEASE"
+const verbBatch = "BATCH"
+
+// verbs is every verb a message can start with
+var verbs = []string{verbAllow, verbPeek, verbRefund, verbAcquire, verbRelease, verbBatch}
+
+// maxBatch is the most requests a BATCH message can carry
+const maxBatch = 100
+
+// protocol versions. Version 2 messages are wrapped in an envelope with a request ID.
+const (
+	version1 = 1
+	version2 = 2
+)
+
+const version2Prefix = "v2 "
+
 // Message is a parsed incoming message
 type Message struct {
+	verb        string
 	accountName string
 	class       string
 	capacity    int
+	rate        float64
 	inc         int
+	lease       string
+	rich        bool
+	all         bool
+	batch       []*Message
 }
 
 // parseMessage takes an incoming UDP message string and parses it looking for
-// <accountName>,<class>,<capacity>,<inc>\n
-// where accountName that uniquely identifies each client, class is l/w/q,
-// capacity is the bucket capacity for that class/accountName and inc is
-// the amount that is being asked to be removed from the bucket value.
-func parseMessage(str string) (*Message, error) {
-	// parse the incoming string - account,class,max_per_second,inc_by
+// <accountName>,<class>,<capacity>,<inc>[,<flags>]\n
+// where accountName that uniquely identifies each client, class is one of
+// the classes (e.g. l/w/q), capacity is the bucket capacity for that
+// class/accountName and inc is the amount that is being asked to be removed
+// from the bucket value. The optional flags can be "r" to ask for a rich response.
+//
+// Alternatively, a message can start with a verb:
+//
+//	ALLOW,<accountName>,<class>,<inc>[,<capacity>] - remove inc from a bucket
+//	PEEK,<accountName>,<class> - inspect a bucket without changing it
+//	REFUND,<accountName>,<class>,<inc> - add inc back to a bucket, up to its capacity
+//	ACQUIRE,<accountName>,<class>[,<capacity>] - acquire a lease, if fewer than capacity are held
+//	RELEASE,<accountName>,<class>,<lease> - release a lease
+//	BATCH[,<flags>];<accountName>,<class>,<inc>[,<capacity>];... - several ALLOWs at once
+func parseMessage(str string, classes []string) (*Message, error) {
+	// parse the incoming string - account,class,max_per_second,inc_by[,flags]
 	bits := strings.Split(str, ",")
-	if len(bits) != 4 {
-		return nil, errors.New("message string must contain 4 strings separated by commas")
+	if header, _, _ := strings.Cut(bits[0], ";"); header == verbBatch {
+		return parseBatch(str, classes)
+	}
+	if slices.Contains(verbs, bits[0]) {
+		return parseVerb(bits, classes)
+	}
+	if len(bits) != 4 && len(bits) != 5 {
+		return nil, errors.New("message string must contain 4 or 5 strings separated by commas")
+	}
+	rich := false
+	if len(bits) == 5 {
+		if bits[4] != richFlag {
+			return nil, errors.New("unknown message flags")
+		}
+		rich = true
 	}
 
 	// sanity checks
@@ -35,7 +92,7 @@ func parseMessage(str string) (*Message, error) {
 	if len(accountName) == 0 || len(class) == 0 || len(capacityStr) == 0 || len(incrementStr) == 0 {
 		return nil, errors.New("missing account/class/capacity/inc strings")
 	}
-	if !slices.Contains(classTypes, class) {
+	if !slices.Contains(classes, class) {
 		return nil, errors.New("class must be one of the valid classTypes")
 	}
 	capacity, err := strconv.Atoi(capacityStr)
@@ -53,11 +110,171 @@ func parseMessage(str string) (*Message, error) {
 		return nil, errors.New("inc must be positive")
 	}
 	message := Message{
+		verb:        verbAllow,
 		accountName: accountName,
 		class:       class,
 		capacity:    capacity,
 		inc:         inc,
+		rich:        rich,
+	}
+	return &message, nil
+
+}
+
+// parseVerb parses the fields of a message that starts with a verb
+func parseVerb(bits []string, classes []string) (*Message, error) {
+	verb := bits[0]
+	fields := 4
+	if verb == verbPeek || verb == verbAcquire {
+		fields = 3
+	}
+	// ALLOW and ACQUIRE messages have an optional capacity, which otherwise comes from the policy
+	optional := verb == verbAllow || verb == verbAcquire
+	if len(bits) != fields && !(optional && len(bits) == fields+1) {
+		return nil, fmt.Errorf("%s message must contain %d strings separated by commas", verb, fields)
+	}
+	accountName := bits[1]
+	class := bits[2]
+	if len(accountName) == 0 || len(class) == 0 {
+		return nil, errors.New("missing account/class strings")
+	}
+	if !slices.Contains(classes, class) {
+		return nil, errors.New("class must be one of the valid classTypes")
+	}
+	message := Message{
+		verb:        verb,
+		accountName: accountName,
+		class:       class,
+	}
+	switch verb {
+	case verbAllow, verbRefund:
+		inc, err := strconv.Atoi(bits[3])
+		if err != nil {
+			return nil, errors.New("cannot convert increment from string to integer")
+		}
+		if inc <= 0 {
+			return nil, errors.New("inc must be positive")
+		}
+		message.inc = inc
+		if len(bits) == 5 {
+			capacity, err := strconv.Atoi(bits[4])
+			if err != nil {
+				return nil, errors.New("cannot convert capacity from string to integer")
+			}
+			if capacity <= 0 {
+				return nil, errors.New("capacity must be positive")
+			}
+			message.capacity = capacity
+		}
+	case verbAcquire:
+		if len(bits) == 4 {
+			capacity, err := strconv.Atoi(bits[3])
+			if err != nil {
+				return nil, errors.New("cannot convert capacity from string to integer")
+			}
+			if capacity <= 0 {
+				return nil, errors.New("capacity must be positive")
+			}
+			message.capacity = capacity
+		}
+	case verbRelease:
+		if len(bits[3]) == 0 {
+			return nil, errors.New("missing lease string")
+		}
+		message.lease = bits[3]
 	}
 	return &message, nil
+}
 
+// parseBatch parses a BATCH message, which carries several requests separated by
+// semicolons, each of which is the fields of an ALLOW message. The optional flags
+// can be "r" to ask for rich responses and "all" to ask for all-or-nothing, where
+// nothing is removed from any bucket unless every request is permitted.
+func parseBatch(str string, classes []string) (*Message, error) {
+	parts := strings.Split(str, ";")
+	if len(parts) < 2 || len(parts) > maxBatch+1 {
+		return nil, fmt.Errorf("BATCH message must contain between 1 and %d requests", maxBatch)
+	}
+	message := Message{verb: verbBatch}
+	for _, flag := range strings.Split(parts[0], ",")[1:] {
+		switch flag {
+		case richFlag:
+			message.rich = true
+		case allFlag:
+			message.all = true
+		default:
+			return nil, errors.New("unknown message flags")
+		}
+	}
+	for _, part := range parts[1:] {
+		request, err := parseVerb(append([]string{verbAllow}, strings.Split(part, ",")...), classes)
+		if err != nil {
+			return nil, err
+		}
+		request.rich = message.rich
+		message.batch = append(message.batch, request)
+	}
+	return &message, nil
+}
+
+// validate checks the fields of a Message that didn't come from parseMessage,
+// e.g. one decoded from a binary frame
+func (m *Message) validate(classes []string) error {
+	if len(m.accountName) == 0 || len(m.class) == 0 {
+		return errors.New("missing account/class strings")
+	}
+	if !slices.Contains(classes, m.class) {
+		return errors.New("class must be one of the valid classTypes")
+	}
+	switch m.verb {
+	case verbAllow, verbRefund:
+		if m.inc <= 0 {
+			return errors.New("inc must be positive")
+		}
+	case verbAcquire:
+		if m.capacity < 0 {
+			return errors.New("capacity cannot be negative")
+		}
+	case verbRelease:
+		if len(m.lease) == 0 {
+			return errors.New("missing lease string")
+		}
+	}
+	return nil
+}
+
+// parseEnvelope works out which protocol version a message uses. Version 2 messages
+// look like
+//
+//	v2 <id> <VERB> <fields>...
+//
+// where id is chosen by the client and echoed in the reply, so that it can match
+// replies to requests. The verb and its fields are returned as a comma separated
+// message for parseMessage. Messages without an envelope are returned unchanged.
+func parseEnvelope(str string) (int, string, string, error) {
+	if !strings.HasPrefix(str, version2Prefix) {
+		return version1, "", str, nil
+	}
+	fields := strings.Fields(str)
+	if len(fields) < 3 {
+		id := ""
+		if len(fields) == 2 {
+			id = fields[1]
+		}
+		return version2, id, "", errors.New("v2 message must contain an id and a verb")
+	}
+	// the verb of a BATCH message can be followed directly by its first request
+	if verb, _, _ := strings.Cut(fields[2], ";"); !slices.Contains(verbs, verb) {
+		return version2, fields[1], "", errors.New("v2 message must contain a verb")
+	}
+	return version2, fields[1], strings.Join(fields[2:], ","), nil
+}
+
+// formatReply wraps a reply in the same protocol version as its message. Version 2
+// replies echo the request ID, with their fields separated by spaces.
+func formatReply(version int, id string, reply string) string {
+	if version != version2 {
+		return reply
+	}
+	return version2Prefix + id + " " + strings.ReplaceAll(reply, ",", " ")
 }
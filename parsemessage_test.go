@@ -1,16 +1,19 @@
 package main
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func Test_parsemessage_nocommas(t *testing.T) {
-	_, err := parseMessage("gibberish")
+	_, err := parseMessage("gibberish", classTypes)
 	if err == nil {
 		t.Error("Expected error for supplying gibberish message, got nil")
 	}
 }
 
 func Test_parsemessage_twocommas(t *testing.T) {
-	_, err := parseMessage("gibb,er,ish")
+	_, err := parseMessage("gibb,er,ish", classTypes)
 	if err == nil {
 		t.Error("Expected error for supplying insufficient components in message, got nil")
 	}
@@ -18,19 +21,19 @@ func Test_parsemessage_twocommas(t *testing.T) {
 
 func Test_parsemessage_threecommas_missing_data(t *testing.T) {
 	var err error
-	_, err = parseMessage(",l,10,1")
+	_, err = parseMessage(",l,10,1", classTypes)
 	if err == nil {
 		t.Error("Expected error for missing name component in message, got nil")
 	}
-	_, err = parseMessage("gb,,10,1")
+	_, err = parseMessage("gb,,10,1", classTypes)
 	if err == nil {
 		t.Error("Expected error for missing class component in message, got nil")
 	}
-	_, err = parseMessage("gb,l,,1")
+	_, err = parseMessage("gb,l,,1", classTypes)
 	if err == nil {
 		t.Error("Expected error for missing capacity component in message, got nil")
 	}
-	_, err = parseMessage("gb,l,10,")
+	_, err = parseMessage("gb,l,10,", classTypes)
 	if err == nil {
 		t.Error("Expected error for missing inc component in message, got nil")
 	}
@@ -38,7 +41,7 @@ func Test_parsemessage_threecommas_missing_data(t *testing.T) {
 
 func Test_parsemessage_invalid_class(t *testing.T) {
 	var err error
-	_, err = parseMessage("gb,x,10,1")
+	_, err = parseMessage("gb,x,10,1", classTypes)
 	if err == nil {
 		t.Error("Expected error for invalid class component in message, got nil")
 	}
@@ -46,7 +49,7 @@ func Test_parsemessage_invalid_class(t *testing.T) {
 
 func Test_parsemessage_invalid_capacity(t *testing.T) {
 	var err error
-	_, err = parseMessage("gb,w,ten,1")
+	_, err = parseMessage("gb,w,ten,1", classTypes)
 	if err == nil {
 		t.Error("Expected error for invalid capacity component in message, got nil")
 	}
@@ -54,7 +57,7 @@ func Test_parsemessage_invalid_capacity(t *testing.T) {
 
 func Test_parsemessage_negative_capacity(t *testing.T) {
 	var err error
-	_, err = parseMessage("gb,w,-10,1")
+	_, err = parseMessage("gb,w,-10,1", classTypes)
 	if err == nil {
 		t.Error("Expected error for invalid capacity component in message, got nil")
 	}
@@ -62,7 +65,7 @@ func Test_parsemessage_negative_capacity(t *testing.T) {
 
 func Test_parsemessage_invalid_inc(t *testing.T) {
 	var err error
-	_, err = parseMessage("gb,w,10,one")
+	_, err = parseMessage("gb,w,10,one", classTypes)
 	if err == nil {
 		t.Error("Expected error for invalid inc component in message, got nil")
 	}
@@ -70,14 +73,14 @@ func Test_parsemessage_invalid_inc(t *testing.T) {
 
 func Test_parsemessage_negative_inc(t *testing.T) {
 	var err error
-	_, err = parseMessage("gb,w,10,-1")
+	_, err = parseMessage("gb,w,10,-1", classTypes)
 	if err == nil {
 		t.Error("Expected error for negative inc component in message, got nil")
 	}
 }
 
 func Test_parsemessage_success_lookup(t *testing.T) {
-	message, err := parseMessage("gb,l,10,1")
+	message, err := parseMessage("gb,l,10,1", classTypes)
 	if err != nil {
 		t.Errorf("Expected no error for valid message, got %v", err)
 	}
@@ -96,7 +99,7 @@ func Test_parsemessage_success_lookup(t *testing.T) {
 }
 
 func Test_parsemessage_success_write(t *testing.T) {
-	message, err := parseMessage("gb,w,10,1")
+	message, err := parseMessage("gb,w,10,1", classTypes)
 	if err != nil {
 		t.Errorf("Expected no error for valid message, got %v", err)
 	}
@@ -115,7 +118,7 @@ func Test_parsemessage_success_write(t *testing.T) {
 }
 
 func Test_parsemessage_success_query(t *testing.T) {
-	message, err := parseMessage("gb,q,10,1")
+	message, err := parseMessage("gb,q,10,1", classTypes)
 	if err != nil {
 		t.Errorf("Expected no error for valid message, got %v", err)
 	}
@@ -132,3 +135,172 @@ func Test_parsemessage_success_query(t *testing.T) {
 		t.Errorf("Expected inc to be %v, got %v", 1, message.inc)
 	}
 }
+
+func Test_parsemessage_configured_classes(t *testing.T) {
+	classes := []string{"search", "upload"}
+	message, err := parseMessage("gb,search,10,1", classes)
+	if err != nil {
+		t.Errorf("Expected no error for configured class, got %v", err)
+	}
+	if message.class != "search" {
+		t.Errorf("Expected class to be %v, got %v", "search", message.class)
+	}
+	_, err = parseMessage("gb,l,10,1", classes)
+	if err == nil {
+		t.Error("Expected error for class that isn't configured, got nil")
+	}
+}
+
+func Test_parsemessage_rich_flag(t *testing.T) {
+	message, err := parseMessage("gb,l,10,1", classTypes)
+	if err != nil {
+		t.Errorf("Expected no error for valid message, got %v", err)
+	}
+	if message.rich {
+		t.Errorf("Expected rich to be %v, got %v", false, message.rich)
+	}
+	message, err = parseMessage("gb,l,10,1,r", classTypes)
+	if err != nil {
+		t.Errorf("Expected no error for rich message, got %v", err)
+	}
+	if !message.rich {
+		t.Errorf("Expected rich to be %v, got %v", true, message.rich)
+	}
+	if message.inc != 1 {
+		t.Errorf("Expected inc to be %v, got %v", 1, message.inc)
+	}
+	_, err = parseMessage("gb,l,10,1,x", classTypes)
+	if err == nil {
+		t.Error("Expected error for unknown flag, got nil")
+	}
+}
+
+func Test_parsemessage_peek(t *testing.T) {
+	message, err := parseMessage("PEEK,gb,l", classTypes)
+	if err != nil {
+		t.Errorf("Expected no error for peek message, got %v", err)
+	}
+	if message.verb != verbPeek {
+		t.Errorf("Expected verb to be %v, got %v", verbPeek, message.verb)
+	}
+	if message.accountName != "gb" {
+		t.Errorf("Expected accountName to be %v, got %v", "gb", message.accountName)
+	}
+	if message.class != "l" {
+		t.Errorf("Expected class to be %v, got %v", "l", message.class)
+	}
+	message, _ = parseMessage("gb,l,10,1", classTypes)
+	if message.verb != verbAllow {
+		t.Errorf("Expected verb to be %v, got %v", verbAllow, message.verb)
+	}
+	for _, str := range []string{"PEEK,gb", "PEEK,gb,l,10", "PEEK,,l", "PEEK,gb,x", "REFUND,gb,l", "ACQUIRE,gb,l,0", "RELEASE,gb,l,"} {
+		if _, err := parseMessage(str, classTypes); err == nil {
+			t.Errorf("Expected error for %v, got nil", str)
+		}
+	}
+}
+
+func Test_parsemessage_acquire_release(t *testing.T) {
+	message, err := parseMessage("ACQUIRE,gb,l,5", classTypes)
+	if err != nil {
+		t.Errorf("Expected no error for acquire message, got %v", err)
+	}
+	if message.verb != verbAcquire || message.capacity != 5 {
+		t.Errorf("Expected acquire with capacity %v, got %v %v", 5, message.verb, message.capacity)
+	}
+	// the capacity is optional, as it can come from the policy
+	message, err = parseMessage("ACQUIRE,gb,l", classTypes)
+	if err != nil {
+		t.Errorf("Expected no error for acquire message without a capacity, got %v", err)
+	}
+	if message.verb != verbAcquire || message.capacity != 0 {
+		t.Errorf("Expected acquire with capacity %v, got %v %v", 0, message.verb, message.capacity)
+	}
+	message, err = parseMessage("RELEASE,gb,l,abc123", classTypes)
+	if err != nil {
+		t.Errorf("Expected no error for release message, got %v", err)
+	}
+	if message.verb != verbRelease || message.lease != "abc123" {
+		t.Errorf("Expected release of lease %v, got %v %v", "abc123", message.verb, message.lease)
+	}
+}
+
+func Test_parsemessage_allow(t *testing.T) {
+	message, err := parseMessage("ALLOW,gb,l,2", classTypes)
+	if err != nil {
+		t.Errorf("Expected no error for allow message, got %v", err)
+	}
+	if message.verb != verbAllow || message.inc != 2 || message.capacity != 0 {
+		t.Errorf("Expected allow of %v without capacity, got %v %v %v", 2, message.verb, message.inc, message.capacity)
+	}
+	message, err = parseMessage("ALLOW,gb,l,2,10", classTypes)
+	if err != nil {
+		t.Errorf("Expected no error for allow message with capacity, got %v", err)
+	}
+	if message.capacity != 10 {
+		t.Errorf("Expected capacity to be %v, got %v", 10, message.capacity)
+	}
+	for _, str := range []string{"ALLOW,gb,l", "ALLOW,gb,l,2,10,r", "ALLOW,gb,l,2,0", "ALLOW,gb,l,x"} {
+		if _, err := parseMessage(str, classTypes); err == nil {
+			t.Errorf("Expected error for %v, got nil", str)
+		}
+	}
+}
+
+func Test_parsemessage_envelope(t *testing.T) {
+	version, id, body, err := parseEnvelope("gb,l,10,1")
+	if err != nil || version != version1 || id != "" || body != "gb,l,10,1" {
+		t.Errorf("Expected legacy message to be unchanged, got %v %v %v %v", version, id, body, err)
+	}
+	version, id, body, err = parseEnvelope("v2 42 ALLOW gb l 1")
+	if err != nil || version != version2 || id != "42" || body != "ALLOW,gb,l,1" {
+		t.Errorf("Expected v2 message to be unwrapped, got %v %v %v %v", version, id, body, err)
+	}
+	_, id, _, err = parseEnvelope("v2 42")
+	if err == nil || id != "42" {
+		t.Errorf("Expected error with id for v2 message without a verb, got %v %v", id, err)
+	}
+	_, _, _, err = parseEnvelope("v2 42 gb l 10 1")
+	if err == nil {
+		t.Error("Expected error for v2 message with an unknown verb, got nil")
+	}
+	if reply := formatReply(version2, "42", "p,9,10,0"); reply != "v2 42 p 9 10 0" {
+		t.Errorf("Expected reply to be %v, got %v", "v2 42 p 9 10 0", reply)
+	}
+	if reply := formatReply(version1, "", "p"); reply != "p" {
+		t.Errorf("Expected reply to be %v, got %v", "p", reply)
+	}
+}
+
+func Test_parsemessage_batch(t *testing.T) {
+	message, err := parseMessage("BATCH;gb,l,1,10;gb,w,2", classTypes)
+	if err != nil {
+		t.Fatalf("Expected no error for batch message, got %v", err)
+	}
+	if message.verb != verbBatch || message.all || message.rich || len(message.batch) != 2 {
+		t.Fatalf("Expected batch of 2, got %v %v %v %v", message.verb, message.all, message.rich, len(message.batch))
+	}
+	first := message.batch[0]
+	if first.verb != verbAllow || first.accountName != "gb" || first.class != "l" || first.inc != 1 || first.capacity != 10 {
+		t.Errorf("Expected first request to be gb,l,1,10, got %v", first)
+	}
+	if message.batch[1].class != "w" || message.batch[1].inc != 2 || message.batch[1].capacity != 0 {
+		t.Errorf("Expected second request to be gb,w,2, got %v", message.batch[1])
+	}
+	message, err = parseMessage("BATCH,all,r;gb,l,1,10", classTypes)
+	if err != nil {
+		t.Fatalf("Expected no error for batch message with flags, got %v", err)
+	}
+	if !message.all || !message.rich || !message.batch[0].rich {
+		t.Errorf("Expected all and rich flags, got %v %v %v", message.all, message.rich, message.batch[0].rich)
+	}
+	for _, str := range []string{"BATCH", "BATCH;", "BATCH,x;gb,l,1", "BATCH;gb,l,1;gb,x,1", "BATCH;" + strings.Repeat("gb,l,1;", maxBatch) + "gb,l,1"} {
+		if _, err := parseMessage(str, classTypes); err == nil {
+			t.Errorf("Expected error for %v, got nil", str)
+		}
+	}
+	_, _, body, err := parseEnvelope("v2 7 BATCH all;gb l 1 10;gb w 1 5")
+	if err != nil || body != "BATCH,all;gb,l,1,10;gb,w,1,5" {
+		t.Errorf("Expected v2 batch to be unwrapped, got %v %v", body, err)
+	}
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// there are four capacity modes, deciding what happens to the capacity
+// supplied by the client in each message:
+//
+//	trust  - the client's capacity is used as-is (the original behaviour)
+//	ignore - the client's capacity is ignored and the policy's capacity is used
+//	clamp  - the client's capacity is used, but never exceeds the policy's capacity
+//	reject - messages whose capacity exceeds the policy's capacity are rejected
+const (
+	modeTrust  = "trust"
+	modeIgnore = "ignore"
+	modeClamp  = "clamp"
+	modeReject = "reject"
+)
+
+var capacityModes = []string{modeTrust, modeIgnore, modeClamp, modeReject}
+
+// there are four algorithms a bucket can use:
+//
+//	fixed   - the bucket is filled to its capacity every refreshInterval
+//	token   - the bucket is continuously topped up at a rate of tokens per second,
+//	          up to its capacity (the burst size)
+//	gcra    - the generic cell rate algorithm, permitting rate requests per second
+//	          with bursts of up to capacity, without keeping a count
+//	sliding - a sliding window counter, permitting capacity requests in any window,
+//	          estimated from the counts of the current and previous windows
+const (
+	algorithmFixed   = "fixed"
+	algorithmToken   = "token"
+	algorithmGCRA    = "gcra"
+	algorithmSliding = "sliding"
+)
+
+// selfRefilling algorithms top themselves up, rather than needing a Reset every refreshInterval
+var selfRefilling = []string{algorithmToken, algorithmGCRA, algorithmSliding}
+
+// Duration is a time.Duration that is written in JSON as a string, e.g. "10s" or "1m"
+type Duration time.Duration
+
+// UnmarshalJSON parses a Duration from a JSON string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(str)
+	if err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// MarshalJSON returns a Duration as a JSON string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// ClassPolicy is the server-side quota for a single class. The Rate is only used
+// by token and GCRA buckets and defaults to Capacity tokens per second. The Window
+// is only used by sliding window buckets and defaults to the refreshInterval.
+// The Concurrency is how many leases an account can hold on the class at once, which
+// is separate from its Capacity, so a class can have either or both. The TTL is only
+// used by concurrency limits, for how long a lease lasts if it isn't released, and
+// defaults to the defaultLeaseTTL.
+// A ClassPolicy can stack further Limits on top of its own, e.g. per minute and
+// per day, in which case a request is only permitted if every limit permits it.
+type ClassPolicy struct {
+	Algorithm   string        `json:"algorithm,omitempty"`
+	Capacity    int           `json:"capacity"`
+	Concurrency int           `json:"concurrency,omitempty"`
+	Rate        float64       `json:"rate,omitempty"`
+	Window      Duration      `json:"window,omitempty"`
+	TTL         Duration      `json:"ttl,omitempty"`
+	Limits      []ClassPolicy `json:"limits,omitempty"`
+}
+
+// stack returns the ClassPolicy's own limit followed by its stacked Limits
+func (cp ClassPolicy) stack() []ClassPolicy {
+	own := cp
+	own.Limits = nil
+	return append([]ClassPolicy{own}, cp.Limits...)
+}
+
+// limiterAlgorithm is the algorithm of the Limiter that enforces the ClassPolicy
+func (cp ClassPolicy) limiterAlgorithm() string {
+	if len(cp.Limits) > 0 {
+		return algorithmStacked
+	}
+	return cp.Algorithm
+}
+
+// Policy is the server-side quota configuration, loaded from a JSON file at
+// startup. It declares the classes that messages may use, which default to
+// the classTypes, and has a default ClassPolicy per class and optional
+// per-account overrides. The algorithm applies to any ClassPolicy that doesn't
+// choose its own, e.g.
+//
+//	{
+//	  "mode": "ignore",
+//	  "algorithm": "fixed",
+//	  "classes": [ "l", "w", "q" ],
+//	  "default": { "l": { "capacity": 100 }, "w": { "capacity": 50 }, "q": { "capacity": 5 } },
+//	  "accounts": { "bob": { "l": { "capacity": 1000 } } }
+//	}
+//
+// The Descriptors map the requests of the Envoy rate limit service to accounts
+// and classes, Signing has the secrets that clients sign messages with, and the
+// ACL limits which callers can use which accounts. Refunds decides whether clients
+// can refund their buckets, which defaults to whether the policy trusts them.
+type Policy struct {
+	Mode        string                            `json:"mode"`
+	Algorithm   string                            `json:"algorithm"`
+	Classes     []string                          `json:"classes"`
+	Default     map[string]ClassPolicy            `json:"default"`
+	Accounts    map[string]map[string]ClassPolicy `json:"accounts"`
+	Descriptors []DescriptorRule                  `json:"descriptors,omitempty"`
+	Signing     *SigningPolicy                    `json:"signing,omitempty"`
+	ACL         []ACLRule                         `json:"acl,omitempty"`
+	Refunds     *bool                             `json:"refunds,omitempty"`
+}
+
+// DescriptorRule maps an Envoy rate limit descriptor to an account and class. The
+// account is the value of the descriptor's entry with the AccountKey, and the class
+// is either the value of its entry with the ClassKey, or the fixed Class. A rule with
+// a Domain only matches requests for that domain, e.g.
+//
+//	{ "domain": "edge", "accountKey": "api_key", "class": "l" }
+type DescriptorRule struct {
+	Domain     string `json:"domain,omitempty"`
+	AccountKey string `json:"accountKey"`
+	ClassKey   string `json:"classKey,omitempty"`
+	Class      string `json:"class,omitempty"`
+}
+
+// NewPolicy creates the policy used when no policy file is supplied, which
+// trusts the capacity supplied by the client.
+func NewPolicy() *Policy {
+	p := Policy{
+		Mode:      modeTrust,
+		Algorithm: algorithmFixed,
+		Classes:   slices.Clone(classTypes),
+		Default:   map[string]ClassPolicy{},
+		Accounts:  map[string]map[string]ClassPolicy{},
+	}
+	return &p
+}
+
+// LoadPolicy reads and validates a JSON policy file. If the file doesn't
+// specify a mode, the client's capacity is ignored, if it doesn't specify
+// an algorithm, fixed window buckets are used, and if it doesn't specify
+// its classes, the classTypes are used.
+func LoadPolicy(filename string) (*Policy, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("cannot parse policy file: %w", err)
+	}
+	if p.Mode == "" {
+		p.Mode = modeIgnore
+	}
+	if p.Algorithm == "" {
+		p.Algorithm = algorithmFixed
+	}
+	if p.Classes == nil {
+		p.Classes = slices.Clone(classTypes)
+	}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// validate checks that the policy's mode and algorithm are known, that its
+// classes can be written in a message, that every class mentioned is one
+// of its classes with a positive capacity or concurrency, and that its
+// Descriptors, Signing and ACL are valid
+func (p *Policy) validate() error {
+	if !slices.Contains(capacityModes, p.Mode) {
+		return fmt.Errorf("unknown mode %q", p.Mode)
+	}
+	if _, ok := limiterFactories[p.Algorithm]; !ok {
+		return fmt.Errorf("unknown algorithm %q", p.Algorithm)
+	}
+	for _, class := range p.Classes {
+		if class == "" || strings.ContainsAny(class, ",; \t\r\n") {
+			return fmt.Errorf("invalid class name %q", class)
+		}
+	}
+	check := func(classes map[string]ClassPolicy) error {
+		for class, cp := range classes {
+			if !slices.Contains(p.Classes, class) {
+				return fmt.Errorf("unknown class %q", class)
+			}
+			for i, limit := range cp.stack() {
+				if err := limit.validate(p.Algorithm, i > 0); err != nil {
+					return fmt.Errorf("class %q: %w", class, err)
+				}
+			}
+		}
+		return nil
+	}
+	if err := check(p.Default); err != nil {
+		return fmt.Errorf("default: %w", err)
+	}
+	for accountName, classes := range p.Accounts {
+		if err := check(classes); err != nil {
+			return fmt.Errorf("account %q: %w", accountName, err)
+		}
+	}
+	for i, rule := range p.Descriptors {
+		if err := rule.validate(p.Classes); err != nil {
+			return fmt.Errorf("descriptor %d: %w", i, err)
+		}
+	}
+	if p.Signing != nil {
+		if err := p.Signing.validate(); err != nil {
+			return fmt.Errorf("signing: %w", err)
+		}
+	}
+	for i := range p.ACL {
+		if err := p.ACL[i].validate(); err != nil {
+			return fmt.Errorf("acl %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// validate checks that a DescriptorRule has an account key and exactly one of a
+// class key or one of the classes
+func (rule DescriptorRule) validate(classes []string) error {
+	if rule.AccountKey == "" {
+		return errors.New("missing accountKey")
+	}
+	if (rule.ClassKey == "") == (rule.Class == "") {
+		return errors.New("must have one of classKey or class")
+	}
+	if rule.Class != "" && !slices.Contains(classes, rule.Class) {
+		return fmt.Errorf("unknown class %q", rule.Class)
+	}
+	return nil
+}
+
+// descriptor maps the entries of an Envoy rate limit descriptor to an account
+// and class using the first DescriptorRule that matches, returning false if none do
+func (p *Policy) descriptor(domain string, entries map[string]string) (string, string, bool) {
+	for _, rule := range p.Descriptors {
+		if rule.Domain != "" && rule.Domain != domain {
+			continue
+		}
+		accountName, ok := entries[rule.AccountKey]
+		if !ok {
+			continue
+		}
+		class := rule.Class
+		if rule.ClassKey != "" {
+			if class, ok = entries[rule.ClassKey]; !ok {
+				continue
+			}
+		}
+		return accountName, class, true
+	}
+	return "", "", false
+}
+
+// validate checks that a ClassPolicy's algorithm is known, or is the policy's
+// algorithm if it doesn't choose one, that it has a positive capacity or concurrency,
+// and that only sliding windows have a window. Limits that are stacked can't stack
+// any further limits, and are only rate limits. As they are usually longer than a
+// second, they can't be fixed windows, which are reset every second, and token and
+// GCRA limits need their own rate, rather than the default of their capacity per second,
+// and sliding windows need their own window, rather than the default of a second.
+func (cp ClassPolicy) validate(algorithm string, stacked bool) error {
+	if _, ok := limiterFactories[cp.Algorithm]; cp.Algorithm != "" && !ok {
+		return fmt.Errorf("unknown algorithm %q", cp.Algorithm)
+	}
+	if cp.Algorithm != "" {
+		algorithm = cp.Algorithm
+	}
+	if cp.Capacity < 0 {
+		return errors.New("capacity cannot be negative")
+	}
+	if cp.Concurrency < 0 {
+		return errors.New("concurrency cannot be negative")
+	}
+	if cp.Capacity == 0 && cp.Concurrency == 0 {
+		return errors.New("capacity or concurrency must be positive")
+	}
+	if cp.Rate < 0 {
+		return errors.New("rate cannot be negative")
+	}
+	if cp.Window < 0 {
+		return errors.New("window cannot be negative")
+	}
+	if cp.TTL < 0 {
+		return errors.New("ttl cannot be negative")
+	}
+	if cp.Window != 0 && algorithm != algorithmSliding {
+		return fmt.Errorf("window is only used by the %q algorithm", algorithmSliding)
+	}
+	if !stacked {
+		return nil
+	}
+	if len(cp.Limits) > 0 {
+		return errors.New("stacked limits cannot have limits of their own")
+	}
+	if cp.Capacity == 0 || cp.Concurrency != 0 {
+		return errors.New("stacked limits must have a capacity and no concurrency")
+	}
+	if algorithm == algorithmFixed {
+		return fmt.Errorf("stacked limits cannot use the %q algorithm", algorithmFixed)
+	}
+	if (algorithm == algorithmToken || algorithm == algorithmGCRA) && cp.Rate == 0 {
+		return fmt.Errorf("stacked %q limits must have a rate", algorithm)
+	}
+	if algorithm == algorithmSliding && cp.Window == 0 {
+		return fmt.Errorf("stacked %q limits must have a window", algorithm)
+	}
+	return nil
+}
+
+// lookup finds the ClassPolicy for an account and class, preferring the
+// account's own override to the default.
+func (p *Policy) lookup(accountName string, class string) (ClassPolicy, bool) {
+	if classes, ok := p.Accounts[accountName]; ok {
+		if cp, ok := classes[class]; ok {
+			return cp, true
+		}
+	}
+	cp, ok := p.Default[class]
+	return cp, ok
+}
+
+// trusts reports whether the policy leaves a class's limit entirely to the client,
+// because it trusts clients and has no ClassPolicy for the class
+func (p *Policy) trusts(accountName string, class string) bool {
+	_, ok := p.lookup(accountName, class)
+	return p.Mode == modeTrust && !ok
+}
+
+// errRefundsOff is the error for REFUND messages when the policy doesn't allow them
+var errRefundsOff = errors.New("refunds are turned off")
+
+// refunds reports whether the policy lets clients refund their buckets. Unless it
+// says otherwise, only policies that trust clients' capacities do, as a client that
+// refunds what it was permitted can be permitted as much as it likes.
+func (p *Policy) refunds() bool {
+	if p.Refunds != nil {
+		return *p.Refunds
+	}
+	return p.Mode == modeTrust
+}
+
+// resolve decides the ClassPolicy to use for an account and class, given the
+// capacity requested by the client. The capacity is chosen according to the
+// policy's mode, and the algorithm, rate and window of it and any stacked limits
+// are filled in with their defaults. A requested capacity of 0 means the client
+// didn't supply one, so the policy's capacity is requested instead.
+func (p *Policy) resolve(accountName string, class string, requested int) (ClassPolicy, error) {
+	cp, ok := p.lookup(accountName, class)
+	if !ok && p.Mode != modeTrust {
+		return cp, errors.New("no policy for account and class")
+	}
+	if ok && cp.Capacity == 0 && p.Mode != modeTrust {
+		return cp, errors.New("no rate limit for account and class")
+	}
+	capacity, err := p.capacity(requested, cp.Capacity)
+	if err != nil {
+		return cp, err
+	}
+	cp.Capacity = capacity
+	limits := make([]ClassPolicy, len(cp.Limits))
+	for i, limit := range cp.Limits {
+		limits[i] = p.defaults(limit)
+	}
+	cp = p.defaults(cp)
+	cp.Limits = limits
+	return cp, nil
+}
+
+// resolveMessage decides the ClassPolicy of the limit an ALLOW message uses. Clients
+// that are trusted with a class can also choose its rate, with CL.THROTTLE or the unit
+// of an Envoy descriptor's limit, which uses the generic cell rate algorithm.
+func (p *Policy) resolveMessage(message *Message) (ClassPolicy, error) {
+	cp, err := p.resolve(message.accountName, message.class, message.capacity)
+	if err != nil {
+		return cp, err
+	}
+	if message.rate > 0 && p.trusts(message.accountName, message.class) {
+		cp.Algorithm = algorithmGCRA
+		cp.Rate = message.rate
+		cp.Window = 0
+	}
+	return cp, nil
+}
+
+// resolveConcurrency decides the ClassPolicy of the concurrency limit for an account
+// and class, given the capacity requested by the client. Its capacity is the policy's
+// concurrency, chosen according to the policy's mode, as in resolve.
+func (p *Policy) resolveConcurrency(accountName string, class string, requested int) (ClassPolicy, error) {
+	cp, _ := p.lookup(accountName, class)
+	if cp.Concurrency == 0 && p.Mode != modeTrust {
+		return cp, errors.New("no concurrency limit for account and class")
+	}
+	capacity, err := p.capacity(requested, cp.Concurrency)
+	if err != nil {
+		return cp, err
+	}
+	return ClassPolicy{Algorithm: algorithmConcurrency, Capacity: capacity, TTL: cp.TTL}, nil
+}
+
+// capacity chooses a capacity according to the policy's mode, given the capacity
+// requested by the client and the policy's own. A requested capacity of 0 means the
+// client didn't supply one, so the policy's capacity is requested instead.
+func (p *Policy) capacity(requested int, capacity int) (int, error) {
+	if requested == 0 {
+		requested = capacity
+	}
+	if requested <= 0 {
+		return 0, errors.New("capacity must be positive")
+	}
+	switch p.Mode {
+	case modeTrust:
+		return requested, nil
+	case modeClamp:
+		return min(requested, capacity), nil
+	case modeReject:
+		if requested > capacity {
+			return 0, errors.New("capacity exceeds policy")
+		}
+		return requested, nil
+	}
+	return capacity, nil
+}
+
+// defaults fills in the algorithm, rate and window of a ClassPolicy with their defaults
+func (p *Policy) defaults(cp ClassPolicy) ClassPolicy {
+	if cp.Algorithm == "" {
+		cp.Algorithm = p.Algorithm
+	}
+	switch cp.Algorithm {
+	case algorithmToken, algorithmGCRA:
+		if cp.Rate == 0 {
+			cp.Rate = float64(cp.Capacity)
+		}
+		cp.Window = 0
+	case algorithmSliding:
+		if cp.Window == 0 {
+			cp.Window = Duration(refreshInterval)
+		}
+		cp.Rate = 0
+	case algorithmFixed:
+		cp.Rate = 0
+		cp.Window = 0
+	}
+	return cp
+}
+
+// resets reports whether any limiter may use an algorithm that isn't self-refilling,
+// such as the fixed window algorithm, and so needs resetting every refreshInterval
+func (p *Policy) resets() bool {
+	// classes without a policy are only used in trust mode
+	if p.Mode == modeTrust && !slices.Contains(selfRefilling, p.Algorithm) {
+		return true
+	}
+	fixed := func(classes map[string]ClassPolicy) bool {
+		for _, cp := range classes {
+			for _, limit := range cp.stack() {
+				if !slices.Contains(selfRefilling, p.defaults(limit).Algorithm) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	if fixed(p.Default) {
+		return true
+	}
+	for _, classes := range p.Accounts {
+		if fixed(classes) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// writePolicyFile writes a policy file to a temporary directory and returns its path
+func writePolicyFile(t *testing.T, content string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatalf("Cannot write policy file: %v", err)
+	}
+	return filename
+}
+
+func Test_policy_new(t *testing.T) {
+	p := NewPolicy()
+	if p.Mode != modeTrust {
+		t.Errorf("Expected mode to be %v, got %v", modeTrust, p.Mode)
+	}
+	cp, err := p.resolve("bob", "l", 1000)
+	if err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if cp.Capacity != 1000 {
+		t.Errorf("Expected capacity to be %v, got %v", 1000, cp.Capacity)
+	}
+	if cp.Algorithm != algorithmFixed {
+		t.Errorf("Expected algorithm to be %v, got %v", algorithmFixed, cp.Algorithm)
+	}
+}
+
+func Test_policy_load(t *testing.T) {
+	filename := writePolicyFile(t, `{
+		"default": { "l": { "capacity": 100 }, "w": { "capacity": 50 } },
+		"accounts": { "bob": { "l": { "capacity": 1000 } } }
+	}`)
+	p, err := LoadPolicy(filename)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if p.Mode != modeIgnore {
+		t.Errorf("Expected mode to default to %v, got %v", modeIgnore, p.Mode)
+	}
+	cp, ok := p.lookup("bob", "l")
+	if !ok || cp.Capacity != 1000 {
+		t.Errorf("Expected bob's l capacity to be %v, got %v", 1000, cp.Capacity)
+	}
+	cp, ok = p.lookup("bob", "w")
+	if !ok || cp.Capacity != 50 {
+		t.Errorf("Expected bob's w capacity to be %v, got %v", 50, cp.Capacity)
+	}
+	cp, ok = p.lookup("rita", "l")
+	if !ok || cp.Capacity != 100 {
+		t.Errorf("Expected rita's l capacity to be %v, got %v", 100, cp.Capacity)
+	}
+	_, ok = p.lookup("rita", "q")
+	if ok {
+		t.Error("Expected no policy for rita's q class")
+	}
+}
+
+func Test_policy_load_missing_file(t *testing.T) {
+	_, err := LoadPolicy(filepath.Join(t.TempDir(), "missing.json"))
+	if err == nil {
+		t.Error("Expected error for missing policy file, got nil")
+	}
+}
+
+func Test_policy_load_invalid(t *testing.T) {
+	invalid := []string{
+		`gibberish`,
+		`{ "mode": "sometimes" }`,
+		`{ "algorithm": "magic" }`,
+		`{ "default": { "l": { "algorithm": "magic", "capacity": 100 } } }`,
+		`{ "default": { "l": { "algorithm": "token", "capacity": 100, "rate": -1 } } }`,
+		`{ "default": { "x": { "capacity": 100 } } }`,
+		`{ "default": { "l": { "capacity": 0 } } }`,
+		`{ "accounts": { "bob": { "l": { "capacity": -1 } } } }`,
+		`{ "classes": [ "search", "up,load" ] }`,
+		`{ "classes": [ "search", "up;load" ] }`,
+		`{ "classes": [ "" ] }`,
+		`{ "classes": [ "search" ], "default": { "l": { "capacity": 100 } } }`,
+		`{ "default": { "l": { "capacity": 100, "limits": [ { "capacity": 0 } ] } } }`,
+		`{ "default": { "l": { "capacity": 100, "limits": [ { "capacity": 10, "limits": [ { "capacity": 1 } ] } ] } } }`,
+		`{ "default": { "l": { "capacity": 10, "ttl": "-1s" } } }`,
+		`{ "default": { "l": { "capacity": 10, "concurrency": -1 } } }`,
+		`{ "default": { "l": { "capacity": 100, "limits": [ { "algorithm": "sliding", "concurrency": 5 } ] } } }`,
+		`{ "default": { "l": { "capacity": 10, "window": "1m" } } }`,
+		`{ "default": { "l": { "algorithm": "token", "capacity": 10, "window": "1m" } } }`,
+		`{ "default": { "l": { "capacity": 100, "limits": [ { "capacity": 5000, "window": "1m" } ] } } }`,
+		`{ "default": { "l": { "capacity": 100, "limits": [ { "algorithm": "fixed", "capacity": 5000 } ] } } }`,
+		`{ "algorithm": "sliding", "default": { "l": { "capacity": 100, "limits": [ { "algorithm": "token", "capacity": 5000 } ] } } }`,
+		`{ "algorithm": "gcra", "default": { "l": { "capacity": 100, "limits": [ { "capacity": 5000 } ] } } }`,
+		`{ "default": { "l": { "capacity": 100, "limits": [ { "algorithm": "sliding", "capacity": 5000 } ] } } }`,
+		`{ "algorithm": "sliding", "default": { "l": { "capacity": 100, "limits": [ { "capacity": 5000 } ] } } }`,
+		`{ "descriptors": [ { "class": "l" } ] }`,
+		`{ "descriptors": [ { "accountKey": "api_key" } ] }`,
+		`{ "descriptors": [ { "accountKey": "api_key", "classKey": "path", "class": "l" } ] }`,
+		`{ "descriptors": [ { "accountKey": "api_key", "class": "x" } ] }`,
+		`{ "signing": { "required": true, "keys": {} } }`,
+		`{ "signing": { "keys": { "k 1": "secret" } } }`,
+		`{ "signing": { "keys": { "k1": "" } } }`,
+		`{ "signing": { "window": "-1s", "keys": { "k1": "secret" } } }`,
+		`{ "acl": [ { "cidr": "10.0.0.0/33", "accounts": [ "*" ] } ] }`,
+		`{ "acl": [ { "cidr": "10.0.0.0/8" } ] }`,
+		`{ "acl": [ { "accounts": [ "*" ], "verbs": [ "BATCH" ] } ] }`,
+	}
+	for _, content := range invalid {
+		_, err := LoadPolicy(writePolicyFile(t, content))
+		if err == nil {
+			t.Errorf("Expected error for invalid policy %v, got nil", content)
+		}
+	}
+}
+
+func Test_policy_capacity_modes(t *testing.T) {
+	p := NewPolicy()
+	p.Default["l"] = ClassPolicy{Capacity: 100}
+
+	// ignore - the requested capacity makes no difference
+	p.Mode = modeIgnore
+	cp, err := p.resolve("bob", "l", 1000)
+	if err != nil || cp.Capacity != 100 {
+		t.Errorf("Expected ignore mode capacity to be %v, got %v (%v)", 100, cp.Capacity, err)
+	}
+
+	// clamp - the requested capacity is used up to the policy's capacity
+	p.Mode = modeClamp
+	cp, err = p.resolve("bob", "l", 1000)
+	if err != nil || cp.Capacity != 100 {
+		t.Errorf("Expected clamp mode capacity to be %v, got %v (%v)", 100, cp.Capacity, err)
+	}
+	cp, err = p.resolve("bob", "l", 10)
+	if err != nil || cp.Capacity != 10 {
+		t.Errorf("Expected clamp mode capacity to be %v, got %v (%v)", 10, cp.Capacity, err)
+	}
+
+	// reject - requesting more than the policy's capacity is an error
+	p.Mode = modeReject
+	_, err = p.resolve("bob", "l", 1000)
+	if err == nil {
+		t.Error("Expected error for capacity exceeding policy, got nil")
+	}
+	cp, err = p.resolve("bob", "l", 10)
+	if err != nil || cp.Capacity != 10 {
+		t.Errorf("Expected reject mode capacity to be %v, got %v (%v)", 10, cp.Capacity, err)
+	}
+
+	// a class without a policy is an error
+	_, err = p.resolve("bob", "w", 10)
+	if err == nil {
+		t.Error("Expected error for class without a policy, got nil")
+	}
+}
+
+func Test_policy_resolve_algorithm(t *testing.T) {
+	p := NewPolicy()
+	p.Mode = modeIgnore
+	p.Default["l"] = ClassPolicy{Capacity: 100}
+	p.Default["w"] = ClassPolicy{Algorithm: algorithmToken, Capacity: 50}
+	p.Default["q"] = ClassPolicy{Algorithm: algorithmToken, Capacity: 5, Rate: 0.5}
+
+	cp, _ := p.resolve("bob", "l", 1)
+	if cp.Algorithm != algorithmFixed || cp.Rate != 0 {
+		t.Errorf("Expected l to be a fixed window, got %v with rate %v", cp.Algorithm, cp.Rate)
+	}
+	// the rate defaults to the capacity per second
+	cp, _ = p.resolve("bob", "w", 1)
+	if cp.Algorithm != algorithmToken || cp.Rate != 50 {
+		t.Errorf("Expected w to be a token bucket with rate %v, got %v with rate %v", 50, cp.Algorithm, cp.Rate)
+	}
+	cp, _ = p.resolve("bob", "q", 1)
+	if cp.Algorithm != algorithmToken || cp.Rate != 0.5 {
+		t.Errorf("Expected q to be a token bucket with rate %v, got %v with rate %v", 0.5, cp.Algorithm, cp.Rate)
+	}
+
+	// the policy's algorithm applies to classes that don't choose their own
+	p.Algorithm = algorithmToken
+	cp, _ = p.resolve("bob", "l", 1)
+	if cp.Algorithm != algorithmToken || cp.Rate != 100 {
+		t.Errorf("Expected l to be a token bucket with rate %v, got %v with rate %v", 100, cp.Algorithm, cp.Rate)
+	}
+}
+
+func Test_policy_resets(t *testing.T) {
+	p := NewPolicy()
+	if !p.resets() {
+		t.Error("Expected trust mode fixed window policy to need resets")
+	}
+	p.Mode = modeIgnore
+	p.Default["l"] = ClassPolicy{Algorithm: algorithmGCRA, Capacity: 100}
+	p.Default["w"] = ClassPolicy{Algorithm: algorithmToken, Capacity: 50}
+	if p.resets() {
+		t.Error("Expected policy without fixed windows not to need resets")
+	}
+	p.Accounts["bob"] = map[string]ClassPolicy{"q": {Capacity: 5}}
+	if !p.resets() {
+		t.Error("Expected policy with a fixed window account to need resets")
+	}
+}
+
+func Test_policy_load_window(t *testing.T) {
+	filename := writePolicyFile(t, `{
+		"default": { "l": { "algorithm": "sliding", "capacity": 100, "window": "1m" }, "w": { "algorithm": "sliding", "capacity": 50 } }
+	}`)
+	p, err := LoadPolicy(filename)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	cp, _ := p.resolve("bob", "l", 1)
+	if time.Duration(cp.Window) != time.Minute {
+		t.Errorf("Expected l window to be %v, got %v", time.Minute, time.Duration(cp.Window))
+	}
+	// the window defaults to the refreshInterval
+	cp, _ = p.resolve("bob", "w", 1)
+	if time.Duration(cp.Window) != refreshInterval {
+		t.Errorf("Expected w window to be %v, got %v", refreshInterval, time.Duration(cp.Window))
+	}
+
+	_, err = LoadPolicy(writePolicyFile(t, `{ "default": { "l": { "algorithm": "sliding", "capacity": 100, "window": "soon" } } }`))
+	if err == nil {
+		t.Error("Expected error for invalid window, got nil")
+	}
+}
+
+func Test_policy_load_classes(t *testing.T) {
+	p, err := LoadPolicy(writePolicyFile(t, `{
+		"classes": [ "search", "upload", "export" ],
+		"default": { "search": { "capacity": 100 }, "upload": { "capacity": 5 } }
+	}`))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(p.Classes) != 3 {
+		t.Errorf("Expected %v classes, got %v", 3, p.Classes)
+	}
+	cp, _ := p.resolve("bob", "upload", 1)
+	if cp.Capacity != 5 {
+		t.Errorf("Expected upload capacity to be %v, got %v", 5, cp.Capacity)
+	}
+
+	// the classes default to the classTypes
+	p, _ = LoadPolicy(writePolicyFile(t, `{}`))
+	if !slices.Equal(p.Classes, classTypes) {
+		t.Errorf("Expected classes to default to %v, got %v", classTypes, p.Classes)
+	}
+}
+
+func Test_policy_load_stacked_limits(t *testing.T) {
+	p, err := LoadPolicy(writePolicyFile(t, `{
+		"algorithm": "token",
+		"default": { "l": { "capacity": 100, "limits": [
+			{ "algorithm": "sliding", "capacity": 5000, "window": "1m" },
+			{ "algorithm": "sliding", "capacity": 1000000, "window": "24h" }
+		] } }
+	}`))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	cp, _ := p.resolve("bob", "l", 1)
+	if cp.limiterAlgorithm() != algorithmStacked || len(cp.Limits) != 2 {
+		t.Fatalf("Expected 2 stacked limits, got %+v", cp)
+	}
+	if cp.Algorithm != algorithmToken || cp.Rate != 100 {
+		t.Errorf("Expected the class's own limit to be a token bucket with rate %v, got %+v", 100, cp)
+	}
+	if time.Duration(cp.Limits[1].Window) != 24*time.Hour || cp.Limits[1].Capacity != 1000000 {
+		t.Errorf("Expected a daily limit of %v, got %+v", 1000000, cp.Limits[1])
+	}
+	// the policy itself isn't changed by resolving its defaults
+	if p.Default["l"].Limits[0].Rate != 0 {
+		t.Errorf("Expected the policy's limits not to be changed, got %+v", p.Default["l"].Limits[0])
+	}
+}
+
+func Test_policy_load_stacked_daily_limit(t *testing.T) {
+	p, err := LoadPolicy(writePolicyFile(t, `{
+		"default": { "l": { "algorithm": "token", "capacity": 1000, "rate": 1000, "limits": [
+			{ "algorithm": "token", "capacity": 1000, "rate": 0.011574074 }
+		] } }
+	}`))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	cp, _ := p.resolve("bob", "l", 1)
+	limiter, err := NewLimiter(cp)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	sl := limiter.(*StackedLimiter)
+	perSecond, perDay := sl.limiters[0].(*TokenBucket), sl.limiters[1].(*TokenBucket)
+	if d := sl.Allow(1000); !d.Permitted {
+		t.Fatal("Expected the first 1000 to be permitted, got false")
+	}
+
+	// an hour later, the daily limit has only refilled by a 24th of its capacity
+	perSecond.updated = perSecond.updated.Add(-time.Hour)
+	perDay.updated = perDay.updated.Add(-time.Hour)
+	permitted := 0
+	for sl.Allow(1).Permitted {
+		permitted++
+	}
+	if permitted != 41 {
+		t.Errorf("Expected %v permitted an hour later, got %v", 41, permitted)
+	}
+}
+
+func Test_policy_resolve_concurrency(t *testing.T) {
+	p := NewPolicy()
+	p.Mode = modeClamp
+	p.Default["l"] = ClassPolicy{Capacity: 100, Concurrency: 2, TTL: Duration(time.Minute)}
+	p.Default["w"] = ClassPolicy{Capacity: 100}
+	p.Default["q"] = ClassPolicy{Concurrency: 5}
+
+	// the concurrency limit is separate from the rate limit
+	cp, err := p.resolveConcurrency("bob", "l", 10)
+	if err != nil || cp.Capacity != 2 || time.Duration(cp.TTL) != time.Minute {
+		t.Errorf("Expected a concurrency of %v, got %+v (%v)", 2, cp, err)
+	}
+	if cp, err := p.resolve("bob", "l", 0); err != nil || cp.Capacity != 100 {
+		t.Errorf("Expected a capacity of %v, got %+v (%v)", 100, cp, err)
+	}
+
+	// classes only have the limits the policy gives them
+	if _, err := p.resolveConcurrency("bob", "w", 1); err == nil {
+		t.Error("Expected error for a class without a concurrency limit, got nil")
+	}
+	if _, err := p.resolve("bob", "q", 1); err == nil {
+		t.Error("Expected error for a class without a rate limit, got nil")
+	}
+	if cp, err := p.resolveConcurrency("bob", "q", 0); err != nil || cp.Capacity != 5 {
+		t.Errorf("Expected a concurrency of %v, got %+v (%v)", 5, cp, err)
+	}
+}
+
+func Test_policy_resolve_without_capacity(t *testing.T) {
+	p := NewPolicy()
+	// trusting the client needs the client to supply a capacity
+	if _, err := p.resolve("bob", "l", 0); err == nil {
+		t.Error("Expected error resolving without a capacity or policy, got nil")
+	}
+	p.Default["l"] = ClassPolicy{Capacity: 100}
+	for _, mode := range capacityModes {
+		p.Mode = mode
+		cp, err := p.resolve("bob", "l", 0)
+		if err != nil || cp.Capacity != 100 {
+			t.Errorf("Expected %v mode capacity to be %v, got %v (%v)", mode, 100, cp.Capacity, err)
+		}
+	}
+}
+
+func Test_policy_descriptor(t *testing.T) {
+	p, err := LoadPolicy(writePolicyFile(t, `{
+		"descriptors": [
+			{ "domain": "edge", "accountKey": "api_key", "class": "w" },
+			{ "accountKey": "api_key", "classKey": "class" },
+			{ "accountKey": "remote_address", "class": "l" }
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	tests := []struct {
+		domain  string
+		entries map[string]string
+		account string
+		class   string
+		ok      bool
+	}{
+		{"edge", map[string]string{"api_key": "bob"}, "bob", "w", true},
+		{"internal", map[string]string{"api_key": "bob", "class": "q"}, "bob", "q", true},
+		{"internal", map[string]string{"api_key": "bob", "remote_address": "10.0.0.1"}, "10.0.0.1", "l", true},
+		{"internal", map[string]string{"path": "/"}, "", "", false},
+	}
+	for _, test := range tests {
+		account, class, ok := p.descriptor(test.domain, test.entries)
+		if account != test.account || class != test.class || ok != test.ok {
+			t.Errorf("Expected %v %v to map to %v,%v,%v, got %v,%v,%v", test.domain, test.entries,
+				test.account, test.class, test.ok, account, class, ok)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The RESP listener speaks enough of the Redis protocol for redis-cli and Redis client
+// libraries to use the limiter. Keys are <account>:<class>, split at the last colon,
+// so that keys like user:123:search work. The commands are:
+//
+//	PING [message]
+//	QUIT
+//	COMMAND                - replies with an empty array, for clients that ask on connect
+//	CL.THROTTLE key max_burst count_per_period period [quantity]
+//	GET key                - the bucket's value, or nil if it has no capacity
+//	MGET key [key ...]     - the values of several buckets
+//
+// CL.THROTTLE follows redis-cell, replying with an array of
+//
+//	limited      0 if the request is permitted, 1 if it isn't
+//	limit        the bucket's capacity
+//	remaining    the bucket's value
+//	retry after  seconds until the request would be permitted, or -1 if it was
+//	reset after  the same as retry after, or 0 if it was permitted
+//
+// where the bucket's capacity is max_burst+1, as in redis-cell. count_per_period and
+// period must be positive, and are only used as the rate if the policy trusts the
+// client with the class, as respThrottle explains.
+const (
+	respMaxArgs  = maxBatch + 1
+	respMaxBulk  = maxDatagram
+	respKeySplit = ":"
+)
+
+// errRESPProtocol is returned when a client doesn't speak RESP, after which the
+// connection is closed
+var errRESPProtocol = errors.New("protocol error")
+
+// errRESPUnknownCommand is returned for a command that the server doesn't know
+var errRESPUnknownCommand = errors.New("unknown command")
+
+// respReasons are the errors that the messagesErrored metric counts RESP errors
+// wrapping them by, as the rest of their text can be the client's own
+var respReasons = []error{errRESPProtocol, errRESPUnknownCommand}
+
+// listenRESPServer creates a TCP listener on the server's RESP port
+func (s *Server) listenRESPServer() (net.Listener, error) {
+	return net.Listen("tcp", fmt.Sprintf(":%v", s.respPort))
+}
+
+// runRESPServer executes the RESP server. Like the TCP server, it has a go-routine
+// per socket, and each socket times out after a period of inactivity.
+func (s *Server) runRESPServer(ctx context.Context, ln net.Listener) {
+	defer s.wg.Done()
+
+	// Stop accepting new connections when context is canceled
+	go func() {
+		<-ctx.Done()
+		slog.Info("Closing RESP server")
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				slog.Info("RESP server closed")
+				return // graceful shutdown
+			}
+			slog.Error("RESP accept error", "error", err)
+			continue
+		}
+
+		// one go routine per connection
+		go func() {
+			defer conn.Close()
+			defer s.met.socketsGauge.Dec()
+			s.met.socketsGauge.Inc()
+			s.serveRESP(conn, 30*time.Second)
+		}()
+	}
+}
+
+// serveRESP reads commands from a connection and writes their replies, until the
+// client quits, the connection is idle for idleTimeout, or the client breaks the protocol.
+// Replies to pipelined commands are flushed together.
+func (s *Server) serveRESP(conn net.Conn, idleTimeout time.Duration) {
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	caller := Caller{Addr: conn.RemoteAddr()}
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		args, err := readRESPCommand(reader)
+		if err != nil {
+			if errors.Is(err, errRESPProtocol) {
+				s.respError(writer, err)
+				writer.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		timer := prometheus.NewTimer(s.met.respRequestDuration)
+		quit := s.handleRESPCommand(writer, caller, args)
+		timer.ObserveDuration()
+		if reader.Buffered() == 0 || quit {
+			if err := writer.Flush(); err != nil {
+				slog.Error("RESP failed to send response", "error", err)
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// handleRESPCommand writes the reply to a command, returning true if the client quit
+func (s *Server) handleRESPCommand(w *bufio.Writer, caller Caller, args []string) bool {
+	s.met.messagesProcessed.WithLabelValues("RESP").Inc()
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		if len(args) > 1 {
+			writeRESPBulk(w, args[1])
+		} else {
+			w.WriteString("+PONG\r\n")
+		}
+	case "QUIT":
+		w.WriteString("+OK\r\n")
+		return true
+	case "COMMAND":
+		w.WriteString("*0\r\n")
+	case "CL.THROTTLE":
+		s.respThrottle(w, caller, args[1:])
+	case "GET":
+		if len(args) != 2 {
+			s.respError(w, errors.New("wrong number of arguments for 'get' command"))
+			return false
+		}
+		s.respGet(w, caller, args[1:], false)
+	case "MGET":
+		if len(args) < 2 {
+			s.respError(w, errors.New("wrong number of arguments for 'mget' command"))
+			return false
+		}
+		s.respGet(w, caller, args[1:], true)
+	default:
+		s.respError(w, fmt.Errorf("%w '%s'", errRESPUnknownCommand, args[0]))
+	}
+	return false
+}
+
+// respThrottle handles CL.THROTTLE key max_burst count_per_period period [quantity].
+// If the policy trusts the client with the class, the bucket permits count_per_period
+// requests every period seconds, with bursts of up to max_burst + 1, as redis-cell's
+// do. Otherwise the class's policy decides its capacity and rate. A quantity of 0
+// peeks at the bucket, so that clients can check the limit without using any of it.
+// As in redis-cell, reset_after is how long until the bucket is full again.
+func (s *Server) respThrottle(w *bufio.Writer, caller Caller, args []string) {
+	if len(args) != 4 && len(args) != 5 {
+		s.respError(w, errors.New("wrong number of arguments for 'cl.throttle' command"))
+		return
+	}
+	if len(args) == 4 {
+		args = append(args, "1")
+	}
+	numbers := make([]int, 4)
+	for i, arg := range args[1:] {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 0 || n >= maxFrameInt {
+			s.respError(w, errors.New("value is not an integer or out of range"))
+			return
+		}
+		numbers[i] = n
+	}
+	maxBurst, countPerPeriod, period, quantity := numbers[0], numbers[1], numbers[2], numbers[3]
+	if countPerPeriod <= 0 || period <= 0 {
+		s.respError(w, errors.New("count_per_period and period must be positive"))
+		return
+	}
+
+	message, err := respMessage(args[0])
+	if err != nil {
+		s.respError(w, err)
+		return
+	}
+	message.verb = verbAllow
+	message.inc = quantity
+	message.capacity = maxBurst + 1
+	message.rate = float64(countPerPeriod) / float64(period)
+	if quantity == 0 {
+		message = &Message{verb: verbPeek, accountName: message.accountName, class: message.class}
+	}
+	reply, ok := s.respHandle(w, caller, message)
+	if !ok {
+		return
+	}
+	if message.verb == verbPeek {
+		// a bucket that doesn't exist yet, and that the policy doesn't give a capacity
+		// to, will be full when it is first used, as it trusts the client's capacity
+		if reply.Capacity == 0 && s.policy.Load().Mode == modeTrust {
+			reply.Remaining = maxBurst + 1
+			reply.Capacity = maxBurst + 1
+		}
+		reply.Permitted = true
+	}
+
+	// reset_after is how long until the bucket is full again, which a fixed window
+	// doesn't know, but is at least until a denied request can be retried
+	limited, retryAfter := 0, int64(-1)
+	resetAfter := int64(math.Ceil(reply.ResetAfter.Seconds()))
+	if !reply.Permitted {
+		limited = 1
+		retryAfter = int64(math.Ceil(reply.RetryAfter.Seconds()))
+		resetAfter = max(resetAfter, retryAfter)
+	}
+	fmt.Fprintf(w, "*5\r\n:%d\r\n:%d\r\n:%d\r\n:%d\r\n:%d\r\n", limited, reply.Capacity, reply.Remaining, retryAfter, resetAfter)
+}
+
+// respGet handles GET and MGET, replying with the value of each key's bucket, or nil
+// if the bucket has no capacity, e.g. because it doesn't exist yet and has no policy.
+// MGET's values are an array.
+func (s *Server) respGet(w *bufio.Writer, caller Caller, keys []string, array bool) {
+	values := make([]*int, len(keys))
+	for i, key := range keys {
+		message, err := respMessage(key)
+		if err != nil {
+			s.respError(w, err)
+			return
+		}
+		message.verb = verbPeek
+		reply, ok := s.respHandle(w, caller, message)
+		if !ok {
+			return
+		}
+		if reply.Capacity > 0 {
+			values[i] = &reply.Remaining
+		}
+	}
+
+	if array {
+		fmt.Fprintf(w, "*%d\r\n", len(values))
+	}
+	for _, value := range values {
+		if value == nil {
+			w.WriteString("$-1\r\n")
+			continue
+		}
+		writeRESPBulk(w, strconv.Itoa(*value))
+	}
+}
+
+// respHandle validates a Message and handles it in the same way as a message from
+// any other protocol. If the Message is invalid, or handling it errors, an error is
+// written and false is returned. Messages that the ACL forbids get a NOPERM error.
+func (s *Server) respHandle(w *bufio.Writer, caller Caller, message *Message) (Reply, bool) {
+	policy := s.policy.Load()
+	if err := message.validate(policy.Classes); err != nil {
+		s.respError(w, err)
+		return Reply{}, false
+	}
+	reply := s.handle("RESP", caller, policy, message)
+	if reply.Forbidden {
+		w.WriteString("-NOPERM " + errForbidden.Error() + "\r\n")
+		return reply, false
+	}
+	if reply.Err != nil {
+		writeRESPError(w, reply.Err)
+		return reply, false
+	}
+	return reply, true
+}
+
+// respMessage splits a key into the account and class of a Message
+func respMessage(key string) (*Message, error) {
+	i := strings.LastIndex(key, respKeySplit)
+	if i < 0 {
+		return nil, errors.New("key must be <account>:<class>")
+	}
+	return &Message{accountName: key[:i], class: key[i+1:]}, nil
+}
+
+// readRESPCommand reads a command, which is either an array of bulk strings, as sent
+// by Redis clients, or an inline command separated by spaces, as typed into telnet.
+// An empty inline command returns no arguments.
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readRESPLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	count, err := strconv.Atoi(line[1:])
+	if err != nil || count < 0 || count > respMaxArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errRESPProtocol)
+	}
+	args := make([]string, count)
+	for i := range args {
+		line, err := readRESPLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, fmt.Errorf("%w: expected '$', got '%.1s'", errRESPProtocol, line)
+		}
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 || length > respMaxBulk {
+			return nil, fmt.Errorf("%w: invalid bulk length", errRESPProtocol)
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		if string(data[length:]) != "\r\n" {
+			return nil, fmt.Errorf("%w: bulk string isn't terminated", errRESPProtocol)
+		}
+		args[i] = string(data[:length])
+	}
+	return args, nil
+}
+
+// readRESPLine reads a line terminated by \r\n, or just \n for inline commands
+func readRESPLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", fmt.Errorf("%w: line is too long", errRESPProtocol)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(line), "\n"), "\r"), nil
+}
+
+// writeRESPBulk writes a bulk string
+func writeRESPBulk(w *bufio.Writer, s string) {
+	fmt.Fprintf(w, "$%d\r\n%s\r\n", len(s), s)
+}
+
+// respErrorReplacer removes line breaks from errors, which can contain the client's
+// own text, so that they can't end the error's line and inject replies of their own
+var respErrorReplacer = strings.NewReplacer("\r", " ", "\n", " ")
+
+// writeRESPError writes an error
+func writeRESPError(w *bufio.Writer, err error) {
+	w.WriteString("-ERR " + respErrorReplacer.Replace(err.Error()) + "\r\n")
+}
+
+// respError counts, logs and writes an error. Errors wrapping one of the respReasons
+// are counted by it, so that a client can't create a metric series for every error.
+func (s *Server) respError(w *bufio.Writer, err error) {
+	reason := err
+	for _, r := range respReasons {
+		if errors.Is(err, r) {
+			reason = r
+		}
+	}
+	s.errored("RESP", reason)
+	writeRESPError(w, err)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// respClient serves RESP on one end of a pipe, returning a function that sends a raw
+// command to the other end and returns the raw reply. An empty command just reads
+// the next reply.
+func respClient(t *testing.T, server *Server) func(command string) string {
+	t.Helper()
+	client, conn := net.Pipe()
+	go server.serveRESP(conn, time.Minute)
+	t.Cleanup(func() { client.Close() })
+	reader := bufio.NewReader(client)
+	return func(command string) string {
+		t.Helper()
+		if command != "" {
+			if _, err := client.Write([]byte(command)); err != nil {
+				t.Fatalf("Cannot send %q: %v", command, err)
+			}
+		}
+		return readRESPReply(t, reader)
+	}
+}
+
+// readRESPReply reads a whole reply, including the elements of an array
+func readRESPReply(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatalf("Cannot read reply: %v", err)
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	switch line[0] {
+	case '*':
+		for range n {
+			line += readRESPReply(t, r)
+		}
+	case '$':
+		if n >= 0 {
+			data := make([]byte, n+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				t.Fatalf("Cannot read bulk string: %v", err)
+			}
+			line += string(data)
+		}
+	}
+	return line
+}
+
+// respArray encodes a command as an array of bulk strings, as Redis clients send it
+func respArray(args ...string) string {
+	command := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, arg := range args {
+		command += "$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"
+	}
+	return command
+}
+
+func Test_resp_throttle(t *testing.T) {
+	met := NewMetrics()
+	server := NewServer(8888, met)
+	server.nextReset.Store(time.Now().Add(refreshInterval).UnixNano())
+	do := respClient(t, server)
+
+	if reply := do("PING\r\n"); reply != "+PONG\r\n" {
+		t.Errorf("Expected PONG to an inline PING, got %q", reply)
+	}
+	// max_burst 1 is a capacity of 2, as in redis-cell
+	throttle := respArray("CL.THROTTLE", "user:1:l", "1", "10", "60")
+	// 10 per 60 seconds is one every 6 seconds, so the bucket is full again 6s after each
+	if reply := do(throttle); reply != "*5\r\n:0\r\n:2\r\n:1\r\n:-1\r\n:6\r\n" {
+		t.Errorf("Expected permitted 1/2, got %q", reply)
+	}
+	if reply := do(throttle); reply != "*5\r\n:0\r\n:2\r\n:0\r\n:-1\r\n:12\r\n" {
+		t.Errorf("Expected permitted 0/2, got %q", reply)
+	}
+	if reply := do(throttle); reply != "*5\r\n:1\r\n:2\r\n:0\r\n:6\r\n:12\r\n" {
+		t.Errorf("Expected limited with a retry after of 6s, got %q", reply)
+	}
+
+	// the key is split at its last colon, and shares buckets with the text protocol
+	if server.handleMessage("test", "PEEK,user:1,l") != "0,2" {
+		t.Error("Expected the text protocol to see the RESP bucket")
+	}
+
+	// a quantity of 0 checks the limit without using any of it
+	if reply := do(respArray("CL.THROTTLE", "user:1:l", "1", "10", "60", "0")); reply != "*5\r\n:0\r\n:2\r\n:0\r\n:-1\r\n:0\r\n" {
+		t.Errorf("Expected 0/2 without being limited, got %q", reply)
+	}
+	if reply := do(respArray("CL.THROTTLE", "user:2:l", "1", "10", "60", "0")); reply != "*5\r\n:0\r\n:2\r\n:2\r\n:-1\r\n:0\r\n" {
+		t.Errorf("Expected a new bucket to be 2/2, got %q", reply)
+	}
+	if _, ok := server.accounts.Load("user:2"); ok {
+		t.Error("Expected a quantity of 0 not to create the account")
+	}
+
+	invalid := []string{
+		respArray("CL.THROTTLE", "user:1:l", "1", "10"),
+		respArray("CL.THROTTLE", "user:1:l", "x", "10", "60"),
+		respArray("CL.THROTTLE", "user:1:l", "1", "0", "60"),
+		respArray("CL.THROTTLE", "user:1:x", "1", "10", "60"),
+		respArray("CL.THROTTLE", "user", "1", "10", "60"),
+		respArray("FLUSHALL"),
+	}
+	for _, command := range invalid {
+		if reply := do(command); !strings.HasPrefix(reply, "-ERR ") {
+			t.Errorf("Expected an error for %q, got %q", command, reply)
+		}
+	}
+}
+
+func Test_resp_throttle_rate(t *testing.T) {
+	met := NewMetrics()
+	server := NewServer(8888, met)
+	do := respClient(t, server)
+
+	// 30 per minute, with bursts of 16, is a GCRA bucket, rather than 16 per second
+	throttle := respArray("CL.THROTTLE", "gb:l", "15", "30", "60")
+	for i := range 16 {
+		if reply := do(throttle); !strings.HasPrefix(reply, "*5\r\n:0\r\n:16\r\n") {
+			t.Fatalf("Expected request %v to be permitted, got %q", i+1, reply)
+		}
+	}
+	if reply := do(throttle); !strings.HasPrefix(reply, "*5\r\n:1\r\n:16\r\n:0\r\n:2\r\n") {
+		t.Errorf("Expected limited with a retry after of 2s, got %q", reply)
+	}
+	if state, _ := server.accounts.accounts["gb"].state("l"); state.Algorithm != algorithmGCRA {
+		t.Errorf("Expected a %v bucket, got %v", algorithmGCRA, state.Algorithm)
+	}
+
+	// a class with a policy keeps the policy's algorithm and rate
+	p := NewPolicy()
+	p.Default["w"] = ClassPolicy{Capacity: 10}
+	server.SetPolicy(p)
+	do(respArray("CL.THROTTLE", "gb:w", "15", "30", "60"))
+	if state, _ := server.accounts.accounts["gb"].state("w"); state.Algorithm != algorithmFixed || state.Capacity != 16 {
+		t.Errorf("Expected a fixed bucket of 16, got %+v", state)
+	}
+}
+
+func Test_resp_get(t *testing.T) {
+	met := NewMetrics()
+	server := NewServer(8888, met)
+	do := respClient(t, server)
+
+	if reply := do(respArray("GET", "gb:l")); reply != "$-1\r\n" {
+		t.Errorf("Expected nil for a bucket that doesn't exist, got %q", reply)
+	}
+	server.handleMessage("test", "gb,l,10,3")
+	if reply := do(respArray("GET", "gb:l")); reply != "$1\r\n7\r\n" {
+		t.Errorf("Expected 7, got %q", reply)
+	}
+	if reply := do(respArray("MGET", "gb:l", "gb:w")); reply != "*2\r\n$1\r\n7\r\n$-1\r\n" {
+		t.Errorf("Expected 7 and nil, got %q", reply)
+	}
+	if reply := do(respArray("MGET", "gb:l")); reply != "*1\r\n$1\r\n7\r\n" {
+		t.Errorf("Expected an array of 7, got %q", reply)
+	}
+}
+
+func Test_resp_protocol_error(t *testing.T) {
+	met := NewMetrics()
+	server := NewServer(8888, met)
+	do := respClient(t, server)
+
+	// pipelined commands are all replied to
+	if reply := do(respArray("PING", "a") + respArray("PING", "b")); reply != "$1\r\na\r\n" {
+		t.Errorf("Expected the first PING's reply, got %q", reply)
+	}
+	// a client that doesn't send bulk strings gets an error before it is disconnected
+	if reply := do("*1\r\n+PING\r\n"); reply != "$1\r\nb\r\n" {
+		t.Errorf("Expected the second PING's reply, got %q", reply)
+	}
+	if reply := do(""); !strings.HasPrefix(reply, "-ERR protocol error") {
+		t.Errorf("Expected a protocol error, got %q", reply)
+	}
+}
+
+func Test_resp_unknown_command(t *testing.T) {
+	met := NewMetrics()
+	server := NewServer(8888, met)
+	do := respClient(t, server)
+	before := testutil.ToFloat64(met.messagesErrored.WithLabelValues(errRESPUnknownCommand.Error()))
+
+	// line breaks in the command can't inject a reply of their own
+	if reply := do(respArray("x\r\n+OK")); reply != "-ERR unknown command 'x  +OK'\r\n" {
+		t.Errorf("Expected an unknown command error on one line, got %q", reply)
+	}
+	if reply := do(respArray("PING")); reply != "+PONG\r\n" {
+		t.Errorf("Expected %q, got %q", "+PONG\r\n", reply)
+	}
+
+	// every unknown command is counted by the same reason, without a series of its own
+	series := testutil.CollectAndCount(met.messagesErrored)
+	do(respArray("NOPE"))
+	after := testutil.ToFloat64(met.messagesErrored.WithLabelValues(errRESPUnknownCommand.Error()))
+	if after != before+2 {
+		t.Errorf("Expected %v unknown commands to be counted, got %v", 2, after-before)
+	}
+	if n := testutil.CollectAndCount(met.messagesErrored); n != series {
+		t.Errorf("Expected %v error series, got %v", series, n)
+	}
+}
@@ -2,26 +2,50 @@ package main
 
 import (
 	"context"
+	"errors"
+	"io/fs"
 	"log/slog"
 	"net"
+	"os"
+	"os/signal"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 // refreshInterval is how frequently the account's buckets are refreshed (topped up)
 const refreshInterval = 1 * time.Second
 
-// responses
-const permitResponse = "p"
-const denyResponse = "d"
-
 // Server is a data structure that holds information about our UDP server, including which
 // port it listens on and a map of Account structs, one for each user account
 type Server struct {
-	port     int
-	accounts *AccountMap
-	wg       sync.WaitGroup
-	met      *metrics
+	port       int
+	accounts   *AccountMap
+	wg         sync.WaitGroup
+	met        *metrics
+	policy     atomic.Pointer[Policy]
+	policyFile string
+	nextReset  atomic.Int64
+	httpPort   int
+	grpcPort   int
+	respPort   int
+
+	// unix sockets, for when the server is deployed as a sidecar
+	unixPath     string
+	unixgramPath string
+	socketMode   fs.FileMode
+
+	// TLS for the TCP listener, and whether client identities are account names
+	tls              *certReloader
+	identityAccounts bool
+
+	// the nonces of signed messages, so that they can't be replayed
+	nonces nonceCache
+
+	// the admin API, which needs its token as a bearer token
+	adminPort  int
+	adminToken string
 }
 
 // NewServer creates a new server struct, given the port
@@ -29,23 +53,140 @@ func NewServer(port int, met *metrics) *Server {
 
 	accountsPtr := NewAccountMap()
 	server := Server{
-		port:     port,
-		accounts: accountsPtr,
-		met:      met,
+		port:       port,
+		accounts:   accountsPtr,
+		met:        met,
+		socketMode: defaultSocketMode,
 	}
+	server.policy.Store(NewPolicy())
 	return &server
 }
 
-// RunTimer resets the accountMap's buckets every second
+// SetHTTPPort turns on the HTTP API, listening on the port
+func (s *Server) SetHTTPPort(port int) {
+	s.httpPort = port
+}
+
+// SetGRPCPort turns on the Envoy rate limit gRPC service, listening on the port
+func (s *Server) SetGRPCPort(port int) {
+	s.grpcPort = port
+}
+
+// SetRESPPort turns on the Redis protocol listener, listening on the port
+func (s *Server) SetRESPPort(port int) {
+	s.respPort = port
+}
+
+// SetAdmin turns on the admin API, listening on the port, which only serves
+// requests that have the token as their bearer token
+func (s *Server) SetAdmin(port int, token string) error {
+	if token == "" {
+		return errors.New("admin API needs a token")
+	}
+	s.adminPort = port
+	s.adminToken = token
+	return nil
+}
+
+// SetUnixSockets turns on the unix stream and datagram socket listeners, at their
+// paths, if they aren't empty. The socket files are given the permissions in mode.
+func (s *Server) SetUnixSockets(streamPath string, datagramPath string, mode fs.FileMode) {
+	s.unixPath = streamPath
+	s.unixgramPath = datagramPath
+	s.socketMode = mode
+}
+
+// SetTLS turns on TLS for the TCP listener, using the certificate and key files. If
+// there is a client CA file, clients must present a certificate signed by one of its
+// CAs, and if identityAccounts is true, the identity of a client's certificate is used
+// as the account name of its messages, which needs a client CA file, as otherwise
+// clients never present a certificate. The files are reloaded when they change.
+func (s *Server) SetTLS(certFile string, keyFile string, caFile string, identityAccounts bool) error {
+	if identityAccounts && caFile == "" {
+		return errors.New("identity accounts need a client CA file")
+	}
+	cr, err := newCertReloader(certFile, keyFile, caFile)
+	if err != nil {
+		return err
+	}
+	s.tls = cr
+	s.identityAccounts = identityAccounts
+	return nil
+}
+
+// SetPolicy atomically replaces the server's quota policy and applies its
+// capacities to the existing accounts, without resetting their buckets.
+func (s *Server) SetPolicy(p *Policy) {
+	s.policy.Store(p)
+	s.accounts.ApplyPolicy(p)
+}
+
+// LoadPolicyFile loads the server's quota policy from a file, remembering the
+// filename so that the policy can be reloaded later.
+func (s *Server) LoadPolicyFile(filename string) error {
+	p, err := LoadPolicy(filename)
+	if err != nil {
+		return err
+	}
+	s.policyFile = filename
+	s.SetPolicy(p)
+	return nil
+}
+
+// ReloadPolicy re-reads the policy file. If the new policy is invalid, an
+// error is returned and the previous policy stays in place.
+func (s *Server) ReloadPolicy() error {
+	if s.policyFile == "" {
+		return errors.New("no policy file to reload")
+	}
+	p, err := LoadPolicy(s.policyFile)
+	if err != nil {
+		s.met.policyReloads.WithLabelValues("error").Inc()
+		return err
+	}
+	s.SetPolicy(p)
+	s.met.policyReloads.WithLabelValues("success").Inc()
+	return nil
+}
+
+// RunReloader reloads the policy file whenever the process receives a SIGHUP
+func (s *Server) RunReloader(ctx context.Context) {
+	defer s.wg.Done()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	// loop until the context is done, i.e. the application is ready to quit
+	for {
+		select {
+		case <-hup:
+			if err := s.ReloadPolicy(); err != nil {
+				slog.Error("Cannot reload policy", "error", err)
+				continue
+			}
+			slog.Info("Reloaded policy", "file", s.policyFile, "mode", s.policy.Load().Mode)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// RunTimer resets the accountMap's buckets every second, unless the policy
+// only uses buckets that top themselves up
 func (s *Server) RunTimer(ctx context.Context) {
 	defer s.wg.Done()
 	ticker := time.NewTicker(refreshInterval)
 	defer ticker.Stop()
+	s.nextReset.Store(time.Now().Add(refreshInterval).UnixNano())
 
 	// loop until the context is done, i.e. the application is ready to quit
 	for {
 		select {
-		case <-ticker.C:
+		case now := <-ticker.C:
+			s.nextReset.Store(now.Add(refreshInterval).UnixNano())
+			if !s.policy.Load().resets() {
+				continue
+			}
 			s.accounts.Reset()
 			slog.Debug("Reset")
 		case <-ctx.Done():
@@ -58,13 +199,20 @@ func (s *Server) RunTimer(ctx context.Context) {
 // dispatching incoming messages to its own goroutine. Another goroutine
 // resets each Account's buckets periodically.
 func (s *Server) Run(ctx context.Context) {
-	var udpConn *net.UDPConn
+	var udpConn net.PacketConn
 	var tcpListener net.Listener
 
-	// we have four goroutines to wait for:
+	// we have up to eleven goroutines to wait for:
 	//   - TCP server
 	//   - UDP server
+	//   - unix stream socket server, if it is turned on
+	//   - unix datagram socket server, if it is turned on
+	//   - HTTP API server, if it is turned on
+	//   - gRPC rate limit server, if it is turned on
+	//   - RESP server, if it is turned on
+	//   - admin API server, if it is turned on
 	//   - reset timer
+	//   - policy reloader
 	//   - prometheus metrics server
 
 	// start prometheus metrics
@@ -79,7 +227,7 @@ func (s *Server) Run(ctx context.Context) {
 		if err != nil {
 			slog.Error("UDP listen error", "error", err)
 		}
-		s.runUDPServer(ctx, udpConn)
+		s.runPacketServer(ctx, "UDP", udpConn)
 	}()
 
 	// run the TCP server
@@ -90,48 +238,79 @@ func (s *Server) Run(ctx context.Context) {
 		if err != nil {
 			slog.Error("TCP listen error", "error", err)
 		}
-		s.runTCPServer(ctx, tcpListener)
+		s.runStreamServer(ctx, "TCP", tcpListener)
 	}()
 
+	// run the unix socket servers, which speak the same protocols as TCP and UDP
+	if s.unixPath != "" {
+		ln, err := s.listenUnixServer()
+		if err != nil {
+			slog.Error("Unix socket listen error", "error", err)
+		} else {
+			slog.Info("Listening on", "unix", s.unixPath)
+			s.wg.Add(1)
+			go s.runStreamServer(ctx, "UNIX", ln)
+		}
+	}
+	if s.unixgramPath != "" {
+		conn, err := s.listenUnixgramServer()
+		if err != nil {
+			slog.Error("Unixgram socket listen error", "error", err)
+		} else {
+			slog.Info("Listening on", "unixgram", s.unixgramPath)
+			s.wg.Add(1)
+			go s.runPacketServer(ctx, "UNIXGRAM", conn)
+		}
+	}
+
+	// run the HTTP API server
+	if s.httpPort != 0 {
+		s.wg.Add(1)
+		go s.runHTTPServer(ctx)
+	}
+
+	// run the Envoy rate limit gRPC server
+	if s.grpcPort != 0 {
+		s.wg.Add(1)
+		go s.runGRPCServer(ctx)
+	}
+
+	// run the admin API server
+	if s.adminPort != 0 {
+		s.wg.Add(1)
+		go s.runAdminServer(ctx)
+	}
+
+	// run the Redis protocol server
+	if s.respPort != 0 {
+		ln, err := s.listenRESPServer()
+		if err != nil {
+			slog.Error("RESP listen error", "error", err)
+		} else {
+			s.wg.Add(1)
+			go s.runRESPServer(ctx, ln)
+		}
+	}
+
 	// reset the accounts every second
 	s.wg.Add(1)
 	go s.RunTimer(ctx)
 
+	// reload the policy on SIGHUP
+	s.wg.Add(1)
+	go s.RunReloader(ctx)
+
 	// wait for all goroutines to finish
 	s.wg.Wait()
 	slog.Info("goroutines stopped")
 }
 
-// handle is run as a goroutine to handle a single incoming message
-func (s *Server) handleMessage(protocol string, str string) string {
-	permitted := false
-	var err error
-
-	// parse the incoming message
-	s.met.messagesProcessed.WithLabelValues(protocol).Inc()
-	message, err := parseMessage(str)
-	if err != nil {
-		s.met.messagesErrored.WithLabelValues(err.Error()).Inc()
-		slog.Error("Error handling message", "protocol", protocol, "error", err)
-		return denyResponse
-	}
-
-	// locate the account in the sync map (or create a new one if it's not there already)
-	acc, newAccountCreated := s.accounts.LoadOrStore(message.accountName)
-	if newAccountCreated {
-		s.met.accountGauge.Inc()
-	}
-
-	// get a decision on whether there is enough Value left in the bucket to decrement it by "inc"
-	permitted = acc.Buckets[message.class].dec(message.inc, message.capacity)
-
-	// permit or deny reply
-	slog.Info("Message", "protocol", protocol, "message", str, "permitted", permitted)
-	if permitted {
-		s.met.messagesHandled.WithLabelValues(message.class, permitResponse).Inc()
-		return permitResponse
-	} else {
-		s.met.messagesHandled.WithLabelValues(message.class, denyResponse).Inc()
-		return denyResponse
+// untilReset is how long until the RunTimer next resets the fixed window buckets,
+// or zero if it isn't running
+func (s *Server) untilReset() time.Duration {
+	nextReset := s.nextReset.Load()
+	if nextReset == 0 {
+		return 0
 	}
+	return max(time.Until(time.Unix(0, nextReset)), 0)
 }
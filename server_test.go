@@ -1,8 +1,14 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"strings"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 // setup tests
@@ -127,3 +133,451 @@ func Test_server_permit_deny_count_parallel(t *testing.T) {
 		t.Errorf("Expected deny count to be %v, got %v", 100000, denyCount)
 	}
 }
+
+func Test_server_policy_ignores_client_capacity(t *testing.T) {
+	port := 8888
+	met := NewMetrics()
+	server := NewServer(port, met)
+	policy := NewPolicy()
+	policy.Mode = modeIgnore
+	policy.Default["l"] = ClassPolicy{Capacity: 10}
+	server.SetPolicy(policy)
+	permitCount := 0
+	// the client claims a capacity of 1000 but the policy only allows 10
+	for i := 0; i < 100; i++ {
+		if server.handleMessage("test", "gb,l,1000,1") == permitResponse {
+			permitCount++
+		}
+	}
+	if permitCount != 10 {
+		t.Errorf("Expected permit count to be %v, got %v", 10, permitCount)
+	}
+	// a class with no policy is denied
+	if server.handleMessage("test", "gb,w,1000,1") != denyResponse {
+		t.Error("Expected class without a policy to be denied")
+	}
+}
+
+func Test_server_reload_policy(t *testing.T) {
+	port := 8888
+	met := NewMetrics()
+	server := NewServer(port, met)
+	if server.ReloadPolicy() == nil {
+		t.Error("Expected error reloading without a policy file, got nil")
+	}
+	filename := writePolicyFile(t, `{ "default": { "l": { "capacity": 10 } } }`)
+	if err := server.LoadPolicyFile(filename); err != nil {
+		t.Fatalf("Expected no error loading policy, got %v", err)
+	}
+	server.handleMessage("test", "gb,l,1000,1")
+
+	// a valid policy replaces the old one, keeping the bucket's value
+	os.WriteFile(filename, []byte(`{ "default": { "l": { "capacity": 20 } } }`), 0600)
+	if err := server.ReloadPolicy(); err != nil {
+		t.Fatalf("Expected no error reloading policy, got %v", err)
+	}
+	acc, _ := server.accounts.LoadOrStore("gb")
+	state := acc.Buckets["l"].State()
+	if state.Capacity != 20 || state.Value != 9 {
+		t.Errorf("Expected l bucket to be 9/20, got %v/%v", state.Value, state.Capacity)
+	}
+
+	// an invalid policy is rejected, keeping the old one
+	os.WriteFile(filename, []byte(`{ "default": { "l": { "capacity": -1 } } }`), 0600)
+	if server.ReloadPolicy() == nil {
+		t.Error("Expected error reloading invalid policy, got nil")
+	}
+	if cp, _ := server.policy.Load().lookup("gb", "l"); cp.Capacity != 20 {
+		t.Errorf("Expected previous policy to remain, got capacity %v", cp.Capacity)
+	}
+}
+
+func Test_server_policy_classes(t *testing.T) {
+	port := 8888
+	met := NewMetrics()
+	server := NewServer(port, met)
+	policy := NewPolicy()
+	policy.Classes = []string{"search", "export"}
+	server.SetPolicy(policy)
+	if server.handleMessage("test", "gb,search,2,1") != permitResponse {
+		t.Error("Expected configured class to be permitted")
+	}
+	if server.handleMessage("test", "gb,l,2,1") != denyResponse {
+		t.Error("Expected class that isn't configured to be denied")
+	}
+	acc, _ := server.accounts.LoadOrStore("gb")
+	if len(acc.Buckets) != 1 {
+		t.Errorf("Expected only the used class to have a bucket, got %v", len(acc.Buckets))
+	}
+}
+
+func Test_server_stacked_limits(t *testing.T) {
+	port := 8888
+	met := NewMetrics()
+	server := NewServer(port, met)
+	policy := NewPolicy()
+	policy.Mode = modeIgnore
+	policy.Default["l"] = ClassPolicy{
+		Capacity: 10,
+		Limits:   []ClassPolicy{{Algorithm: algorithmSliding, Capacity: 15, Window: Duration(time.Minute)}},
+	}
+	server.SetPolicy(policy)
+	permitCount := 0
+	// the fixed window is reset three times, but the per minute limit only permits 15
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 20; j++ {
+			if server.handleMessage("test", "gb,l,10,1") == permitResponse {
+				permitCount++
+			}
+		}
+		server.accounts.Reset()
+	}
+	if permitCount != 15 {
+		t.Errorf("Expected permit count to be %v, got %v", 15, permitCount)
+	}
+}
+
+func Test_server_rich_response(t *testing.T) {
+	met := NewMetrics()
+	server := NewServer(8888, met)
+	response := server.handleMessage("test", "gb,l,2,1,r")
+	if response != "p,1,2,0" {
+		t.Errorf("Expected response to be %v, got %v", "p,1,2,0", response)
+	}
+	response = server.handleMessage("test", "gb,l,2,1")
+	if response != permitResponse {
+		t.Errorf("Expected response to be %v, got %v", permitResponse, response)
+	}
+	// without the timer running, a fixed window doesn't know when it will be reset
+	response = server.handleMessage("test", "gb,l,2,1,r")
+	if response != "d,0,2,0" {
+		t.Errorf("Expected response to be %v, got %v", "d,0,2,0", response)
+	}
+	server.nextReset.Store(time.Now().Add(500 * time.Millisecond).UnixNano())
+	response = server.handleMessage("test", "gb,l,2,1,r")
+	if !strings.HasPrefix(response, "d,0,2,") || response == "d,0,2,0" {
+		t.Errorf("Expected response to include time until reset, got %v", response)
+	}
+	// a message that can't be parsed gets the plain reply
+	response = server.handleMessage("test", "gb,x,2,1,r")
+	if response != denyResponse {
+		t.Errorf("Expected response to be %v, got %v", denyResponse, response)
+	}
+	policy := NewPolicy()
+	policy.Mode = modeReject
+	server.SetPolicy(policy)
+	response = server.handleMessage("test", "gb,l,2,1,r")
+	if response != "d,0,0,0" {
+		t.Errorf("Expected response to be %v, got %v", "d,0,0,0", response)
+	}
+}
+
+func Test_server_retry_after_reset(t *testing.T) {
+	met := NewMetrics()
+	server := NewServer(8888, met)
+	server.nextReset.Store(time.Now().Add(500 * time.Millisecond).UnixNano())
+	message := &Message{verb: verbAllow, accountName: "gb", class: "l", inc: 1}
+
+	// a fixed window's denial is lifted when it is next reset
+	fixed := NewFixedWindow(ClassPolicy{Capacity: 1})
+	fixed.Allow(1)
+	decision := fixed.Allow(1)
+	server.decided("test", message, &decision)
+	if decision.RetryAfter <= 0 {
+		t.Errorf("Expected a fixed window denial to be retried at the reset, got %v", decision.RetryAfter)
+	}
+
+	// but a token bucket that never refills won't permit it then
+	token := NewTokenBucket(ClassPolicy{Capacity: 1})
+	token.Allow(1)
+	decision = token.Allow(1)
+	server.decided("test", message, &decision)
+	if decision.RetryAfter != 0 {
+		t.Errorf("Expected a token bucket denial not to be retried at the reset, got %v", decision.RetryAfter)
+	}
+}
+
+func Test_server_rich_response_token(t *testing.T) {
+	met := NewMetrics()
+	server := NewServer(8888, met)
+	policy := NewPolicy()
+	policy.Algorithm = algorithmToken
+	server.SetPolicy(policy)
+	server.handleMessage("test", "gb,l,1,1,r")
+	response := server.handleMessage("test", "gb,l,1,1,r")
+	bits := strings.Split(response, ",")
+	if len(bits) != 4 || bits[0] != denyResponse || bits[3] == "0" {
+		t.Errorf("Expected denial with a retry after, got %v", response)
+	}
+}
+
+func Test_server_peek(t *testing.T) {
+	met := NewMetrics()
+	server := NewServer(8888, met)
+	// peeking doesn't create accounts
+	response := server.handleMessage("test", "PEEK,gb,l")
+	if response != "0,0" {
+		t.Errorf("Expected response to be %v, got %v", "0,0", response)
+	}
+	if len(server.accounts.accounts) != 0 {
+		t.Errorf("Expected server account map to %v length, got %v", 0, len(server.accounts.accounts))
+	}
+	server.handleMessage("test", "gb,l,10,3")
+	for i := 0; i < 2; i++ {
+		response = server.handleMessage("test", "PEEK,gb,l")
+		if response != "7,10" {
+			t.Errorf("Expected response to be %v, got %v", "7,10", response)
+		}
+	}
+	response = server.handleMessage("test", "PEEK,gb,w")
+	if response != "0,0" {
+		t.Errorf("Expected response to be %v, got %v", "0,0", response)
+	}
+
+	// unused buckets with a policy are full
+	policy := NewPolicy()
+	policy.Mode = modeIgnore
+	policy.Default["w"] = ClassPolicy{Capacity: 5}
+	server.SetPolicy(policy)
+	response = server.handleMessage("test", "PEEK,other,w")
+	if response != "5,5" {
+		t.Errorf("Expected response to be %v, got %v", "5,5", response)
+	}
+	if len(server.accounts.accounts) != 1 {
+		t.Errorf("Expected server account map to %v length, got %v", 1, len(server.accounts.accounts))
+	}
+}
+
+func Test_server_refund(t *testing.T) {
+	met := NewMetrics()
+	server := NewServer(8888, met)
+	// refunding doesn't create accounts
+	response := server.handleMessage("test", "REFUND,gb,l,5")
+	if response != "0,0" {
+		t.Errorf("Expected response to be %v, got %v", "0,0", response)
+	}
+	if len(server.accounts.accounts) != 0 {
+		t.Errorf("Expected server account map to %v length, got %v", 0, len(server.accounts.accounts))
+	}
+	server.handleMessage("test", "gb,l,10,8")
+	response = server.handleMessage("test", "REFUND,gb,l,5")
+	if response != "7,10" {
+		t.Errorf("Expected response to be %v, got %v", "7,10", response)
+	}
+	// refunds are capped at the capacity
+	response = server.handleMessage("test", "REFUND,gb,l,5")
+	if response != "10,10" {
+		t.Errorf("Expected response to be %v, got %v", "10,10", response)
+	}
+	if server.handleMessage("test", "REFUND,gb,l,0") != denyResponse {
+		t.Error("Expected invalid refund to be denied")
+	}
+}
+
+func Test_server_refund_turned_off(t *testing.T) {
+	server := NewServer(8888, NewMetrics())
+	p := NewPolicy()
+	p.Mode = modeIgnore
+	p.Default["l"] = ClassPolicy{Capacity: 10}
+	server.SetPolicy(p)
+	server.handleMessage("test", "gb,l,10,8")
+
+	// policies that don't trust clients' capacities don't trust them with refunds
+	before := testutil.ToFloat64(server.met.messagesErrored.WithLabelValues(errRefundsOff.Error()))
+	if response := server.handleMessage("test", "REFUND,gb,l,5"); response != denyResponse {
+		t.Errorf("Expected response to be %v, got %v", denyResponse, response)
+	}
+	if after := testutil.ToFloat64(server.met.messagesErrored.WithLabelValues(errRefundsOff.Error())); after != before+1 {
+		t.Errorf("Expected %v refunds to be errored, got %v", 1, after-before)
+	}
+	if response := server.handleMessage("test", "PEEK,gb,l"); response != "2,10" {
+		t.Errorf("Expected response to be %v, got %v", "2,10", response)
+	}
+
+	// unless the policy turns refunds on
+	refunds := true
+	p.Refunds = &refunds
+	if response := server.handleMessage("test", "REFUND,gb,l,5"); response != "7,10" {
+		t.Errorf("Expected response to be %v, got %v", "7,10", response)
+	}
+	// and policies that trust clients can turn them off
+	refunds = false
+	p.Mode = modeTrust
+	if response := server.handleMessage("test", "REFUND,gb,l,5"); response != denyResponse {
+		t.Errorf("Expected response to be %v, got %v", denyResponse, response)
+	}
+}
+
+func Test_server_acquire_release(t *testing.T) {
+	met := NewMetrics()
+	server := NewServer(8888, met)
+	// releasing doesn't create accounts
+	if server.handleMessage("test", "RELEASE,gb,l,abc123") != denyResponse {
+		t.Error("Expected release of unknown lease to be denied")
+	}
+	if len(server.accounts.accounts) != 0 {
+		t.Errorf("Expected server account map to %v length, got %v", 0, len(server.accounts.accounts))
+	}
+	response := server.handleMessage("test", "ACQUIRE,gb,l,1")
+	lease, found := strings.CutPrefix(response, permitResponse+",")
+	if !found || lease == "" {
+		t.Fatalf("Expected acquire to be permitted with a lease, got %v", response)
+	}
+	if server.handleMessage("test", "ACQUIRE,gb,l,1") != denyResponse {
+		t.Error("Expected acquire beyond capacity to be denied")
+	}
+	// leases are separate from the bucket for the same class
+	if server.handleMessage("test", "gb,l,1,1") != permitResponse {
+		t.Error("Expected bucket to be unaffected by leases")
+	}
+	if server.handleMessage("test", "RELEASE,gb,l,"+lease) != permitResponse {
+		t.Error("Expected release of lease to be permitted")
+	}
+	if server.handleMessage("test", "ACQUIRE,gb,l,1") == denyResponse {
+		t.Error("Expected acquire after release to be permitted")
+	}
+
+	// with a policy, the capacity is optional
+	policy := NewPolicy()
+	policy.Mode = modeIgnore
+	policy.Default["w"] = ClassPolicy{Concurrency: 1}
+	server.SetPolicy(policy)
+	if server.handleMessage("test", "ACQUIRE,gb,w") == denyResponse {
+		t.Error("Expected acquire without a capacity to be permitted")
+	}
+	if server.handleMessage("test", "ACQUIRE,gb,w") != denyResponse {
+		t.Error("Expected acquire beyond the policy's concurrency to be denied")
+	}
+}
+
+func Test_server_v2(t *testing.T) {
+	met := NewMetrics()
+	server := NewServer(8888, met)
+	// the replies depend on the messages before them, so they are checked in order
+	exchanges := [][2]string{
+		{"v2 1 ALLOW gb l 1 2", "v2 1 p 1 2 0"},
+		{"v2 2 PEEK gb l", "v2 2 1 2"},
+		{"v2 3 REFUND gb l 1", "v2 3 2 2"},
+		{"v2 4 RELEASE gb l none", "v2 4 d"},
+		// without a policy, the capacity must be supplied
+		{"v2 5 ALLOW gb l 1", "v2 5 d 0 0 0"},
+		{"v2 6 gb l 2 1", "v2 6 d"},
+		{"v2 7", "v2 7 d"},
+		// the legacy format still works alongside
+		{"gb,l,2,1", permitResponse},
+	}
+	for _, exchange := range exchanges {
+		if response := server.handleMessage("test", exchange[0]); response != exchange[1] {
+			t.Errorf("Expected response to %v to be %v, got %v", exchange[0], exchange[1], response)
+		}
+	}
+
+	// with a policy, the capacity is optional
+	policy := NewPolicy()
+	policy.Mode = modeIgnore
+	policy.Default["w"] = ClassPolicy{Capacity: 5}
+	server.SetPolicy(policy)
+	if response := server.handleMessage("test", "v2 abc ALLOW gb w 2"); response != "v2 abc p 3 5 0" {
+		t.Errorf("Expected response to be %v, got %v", "v2 abc p 3 5 0", response)
+	}
+}
+
+func Test_server_batch(t *testing.T) {
+	met := NewMetrics()
+	server := NewServer(8888, met)
+	response := server.handleMessage("test", "BATCH;gb,l,1,2;gb,w,3,2")
+	if response != "p;d" {
+		t.Errorf("Expected response to be %v, got %v", "p;d", response)
+	}
+	response = server.handleMessage("test", "BATCH,r;gb,l,1,2;gb,w,2,2")
+	if response != "p,0,2,0;p,0,2,0" {
+		t.Errorf("Expected response to be %v, got %v", "p,0,2,0;p,0,2,0", response)
+	}
+	response = server.handleMessage("test", "v2 9 BATCH r;gb q 1 2")
+	if response != "v2 9 p 1 2 0" {
+		t.Errorf("Expected response to be %v, got %v", "v2 9 p 1 2 0", response)
+	}
+	// version 2 batches are rich without asking
+	response = server.handleMessage("test", "v2 10 BATCH;gb q 1 2;gb q 2 2")
+	if response != "v2 10 p 0 2 0;d 0 2 0" {
+		t.Errorf("Expected response to be %v, got %v", "v2 10 p 0 2 0;d 0 2 0", response)
+	}
+}
+
+func Test_server_batch_all_or_nothing(t *testing.T) {
+	met := NewMetrics()
+	server := NewServer(8888, met)
+	server.handleMessage("test", "gb,w,2,2")
+	// the write is denied, so the lookups aren't taken
+	response := server.handleMessage("test", "BATCH,all,r;gb,l,1,5;gb,l,1,5;gb,w,1,2;gb,q,1,5")
+	if response != "d,5,5,0;d,5,5,0;d,0,2,0;d,5,5,0" {
+		t.Errorf("Expected response to be %v, got %v", "d,5,5,0;d,5,5,0;d,0,2,0;d,5,5,0", response)
+	}
+	if response := server.handleMessage("test", "PEEK,gb,l"); response != "5,5" {
+		t.Errorf("Expected lookups to be refunded to %v, got %v", "5,5", response)
+	}
+	server.accounts.Reset()
+	response = server.handleMessage("test", "BATCH,all;gb,l,1,5;gb,w,1,2")
+	if response != "p;p" {
+		t.Errorf("Expected response to be %v, got %v", "p;p", response)
+	}
+	if response := server.handleMessage("test", "PEEK,gb,l"); response != "4,5" {
+		t.Errorf("Expected lookup to be taken, leaving %v, got %v", "4,5", response)
+	}
+
+	// a request without a policy leaves no accounts behind for the ones before it
+	server = NewServer(8888, met)
+	policy := NewPolicy()
+	policy.Mode = modeIgnore
+	policy.Default["l"] = ClassPolicy{Capacity: 5}
+	server.SetPolicy(policy)
+	response = server.handleMessage("test", "BATCH,all;rita,l,1;gb,w,1")
+	if response != "d;d" {
+		t.Errorf("Expected response to be %v, got %v", "d;d", response)
+	}
+	if len(server.accounts.accounts) != 0 {
+		t.Errorf("Expected server account map to %v length, got %v", 0, len(server.accounts.accounts))
+	}
+}
+
+func Test_server_batch_all_or_nothing_parallel(t *testing.T) {
+	port := 8888
+	met := NewMetrics()
+	server := NewServer(port, met)
+	batchCount := 0
+	singleCount := 0
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	// batches take one write and one query, listing them in either order, while
+	// single messages compete for the same writes
+	f := func(message string, count *int) {
+		defer wg.Done()
+		for i := 0; i < 2000; i++ {
+			if strings.HasPrefix(server.handleMessage("test", message), permitResponse) {
+				mu.Lock()
+				*count++
+				mu.Unlock()
+			}
+		}
+	}
+	wg.Add(6)
+	go f("BATCH,all;gb,w,1,5000;gb,q,1,5000", &batchCount)
+	go f("BATCH,all;gb,q,1,5000;gb,w,1,5000", &batchCount)
+	go f("BATCH,all;gb,w,1,5000;gb,q,1,5000", &batchCount)
+	go f("BATCH,all;gb,q,1,5000;gb,w,1,5000", &batchCount)
+	go f("gb,w,5000,1", &singleCount)
+	go f("gb,w,5000,1", &singleCount)
+	wg.Wait()
+
+	if batchCount+singleCount != 5000 {
+		t.Errorf("Expected permit count to be %v, got %v", 5000, batchCount+singleCount)
+	}
+	// a query is only ever taken along with a write
+	expected := fmt.Sprintf("%d,5000", 5000-batchCount)
+	if response := server.handleMessage("test", "PEEK,gb,q"); response != expected {
+		t.Errorf("Expected queries to be %v, got %v", expected, response)
+	}
+	if response := server.handleMessage("test", "PEEK,gb,w"); response != "0,5000" {
+		t.Errorf("Expected writes to be %v, got %v", "0,5000", response)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// SlidingWindow is a Limiter using a sliding window counter. It counts the requests in
+// the current window (which started at start) and the previous window, estimating the
+// requests in the sliding window ending now by weighting the previous window's count by
+// how much of it the sliding window still overlaps. Unlike a fixed window, this avoids
+// permitting a double burst either side of a window boundary.
+type SlidingWindow struct {
+	count    int
+	previous int
+	capacity int
+	window   time.Duration
+	start    time.Time
+	mu       sync.Mutex
+}
+
+// NewSlidingWindow creates an empty SlidingWindow with the ClassPolicy's capacity
+// and window, which defaults to the refreshInterval
+func NewSlidingWindow(cp ClassPolicy) Limiter {
+	window := time.Duration(cp.Window)
+	if window <= 0 {
+		window = refreshInterval
+	}
+	return &SlidingWindow{
+		capacity: cp.Capacity,
+		window:   window,
+		start:    time.Now(),
+	}
+}
+
+// Allow counts n requests, if the estimated count leaves room for them
+func (sw *SlidingWindow) Allow(n int) Decision {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.allowLocked(n)
+}
+
+// Peek returns the Decision that Allow would make, without counting anything
+func (sw *SlidingWindow) Peek(n int) Decision {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	return sw.peekLocked(n)
+}
+
+// lock and unlock hold the window's lock for a transaction
+func (sw *SlidingWindow) lock()   { sw.mu.Lock() }
+func (sw *SlidingWindow) unlock() { sw.mu.Unlock() }
+
+// peekLocked is Peek, for when the lock is already held
+func (sw *SlidingWindow) peekLocked(n int) Decision {
+	now := time.Now()
+	sw.slide(now)
+	return sw.decide(n, now)
+}
+
+// allowLocked is Allow, for when the lock is already held
+func (sw *SlidingWindow) allowLocked(n int) Decision {
+	now := time.Now()
+	sw.slide(now)
+	d := sw.decide(n, now)
+	if d.Permitted {
+		sw.count += n
+		d.Remaining = sw.remaining(now)
+	}
+	return d
+}
+
+// decide works out whether the estimated count leaves room for n, and if not,
+// how long until it will. It must be called with the lock held, after sliding.
+func (sw *SlidingWindow) decide(n int, now time.Time) Decision {
+	d := Decision{
+		Remaining: sw.remaining(now),
+		Capacity:  sw.capacity,
+	}
+	if n <= 0 || n > sw.capacity {
+		return d
+	}
+	if sw.estimate(now)+float64(n) <= float64(sw.capacity) {
+		d.Permitted = true
+		return d
+	}
+
+	// work out how far into a window the previous window's weighted count
+	// becomes small enough to leave room for the request
+	elapsed := now.Sub(sw.start)
+	previous, count, wait := sw.previous, sw.count, time.Duration(0)
+	if count+n > sw.capacity {
+		// not until the next window, when this window becomes the previous one
+		previous, count, wait = count, 0, sw.window-elapsed
+		elapsed = 0
+	}
+	overlap := float64(sw.capacity-count-n) / float64(previous)
+	at := time.Duration((1 - overlap) * float64(sw.window))
+	d.RetryAfter = wait + max(at-elapsed, 0)
+	return d
+}
+
+// slide moves the current window on to the window that now is in, keeping the
+// count of the previous window if it is the one just before. It must be called
+// with the lock held.
+func (sw *SlidingWindow) slide(now time.Time) {
+	elapsed := now.Sub(sw.start)
+	if elapsed < sw.window {
+		return
+	}
+	windows := elapsed / sw.window
+	sw.previous = 0
+	if windows == 1 {
+		sw.previous = sw.count
+	}
+	sw.count = 0
+	sw.start = sw.start.Add(windows * sw.window)
+}
+
+// estimate is the number of requests made in the sliding window ending now,
+// assuming the previous window's requests were spread evenly across it. It
+// must be called with the lock held, after sliding.
+func (sw *SlidingWindow) estimate(now time.Time) float64 {
+	overlap := 1 - now.Sub(sw.start).Seconds()/sw.window.Seconds()
+	return float64(sw.previous)*overlap + float64(sw.count)
+}
+
+// remaining is the number of requests that would be permitted now. It must
+// be called with the lock held, after sliding.
+func (sw *SlidingWindow) remaining(now time.Time) int {
+	return max(sw.capacity-int(math.Ceil(sw.estimate(now))), 0)
+}
+
+// Refund uncounts n requests, from the current window first and then the previous one
+func (sw *SlidingWindow) Refund(n int) int {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	if n <= 0 {
+		return 0
+	}
+	now := time.Now()
+	sw.slide(now)
+	before := sw.remaining(now)
+	fromCount := min(n, sw.count)
+	sw.count -= fromCount
+	sw.previous = max(sw.previous-(n-fromCount), 0)
+	return sw.remaining(now) - before
+}
+
+// Reset does nothing, as old requests slide out of the window by themselves
+func (sw *SlidingWindow) Reset() {}
+
+// set sets the count so that value requests would be permitted now
+func (sw *SlidingWindow) set(value int, capacity int) error {
+	if value < 0 || capacity < 0 {
+		return errors.New("cannot accept negative value or capacity")
+	}
+	if value > capacity {
+		return errors.New("value cannot exceed capacity")
+	}
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.slide(time.Now())
+	sw.count = capacity - value
+	sw.previous = 0
+	sw.capacity = capacity
+	return nil
+}
+
+// SetLimit changes the capacity and window, keeping the counts so far
+func (sw *SlidingWindow) SetLimit(cp ClassPolicy) {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	sw.slide(time.Now())
+	sw.capacity = cp.Capacity
+	if cp.Window > 0 {
+		sw.window = time.Duration(cp.Window)
+	}
+}
+
+// State returns the number of requests that would be permitted now, and the capacity
+func (sw *SlidingWindow) State() LimiterState {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	now := time.Now()
+	sw.slide(now)
+	return LimiterState{
+		Algorithm: algorithmSliding,
+		Value:     sw.remaining(now),
+		Capacity:  sw.capacity,
+	}
+}
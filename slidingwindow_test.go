@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_sliding_window_allow(t *testing.T) {
+	sw := NewSlidingWindow(ClassPolicy{Algorithm: algorithmSliding, Capacity: 10, Window: Duration(10 * time.Second)}).(*SlidingWindow)
+	for i := 0; i < 10; i++ {
+		if d := sw.Allow(1); !d.Permitted {
+			t.Errorf("Expected allow %d to be permitted, got false", i)
+		}
+	}
+	d := sw.Allow(1)
+	if d.Permitted {
+		t.Error("Expected allow beyond capacity to be denied, got true")
+	}
+	// the whole window's count must slide out of the way, a tenth of the window into the next one
+	if d.RetryAfter < 10*time.Second || d.RetryAfter > 11*time.Second {
+		t.Errorf("Expected RetryAfter to be between 10s and 11s, got %v", d.RetryAfter)
+	}
+
+	// sliding windows are not reset
+	sw.Reset()
+	if sw.State().Value != 0 {
+		t.Errorf("Expected Value to remain 0 after reset, got %d", sw.State().Value)
+	}
+
+	// half way through the next window, half of the previous window's count remains
+	sw.start = sw.start.Add(-15 * time.Second)
+	if sw.State().Value != 5 {
+		t.Errorf("Expected Value to be 5, got %d", sw.State().Value)
+	}
+	if d := sw.Allow(5); !d.Permitted {
+		t.Error("Expected allow of half the capacity to be permitted, got false")
+	}
+	if d := sw.Allow(1); d.Permitted {
+		t.Error("Expected allow beyond the estimated count to be denied, got true")
+	}
+
+	// two windows later, everything has slid out of the window
+	sw.start = sw.start.Add(-20 * time.Second)
+	if sw.State().Value != 10 {
+		t.Errorf("Expected Value to be 10, got %d", sw.State().Value)
+	}
+}
+
+func Test_sliding_window_boundary_burst(t *testing.T) {
+	// a client spends its whole capacity just before a window boundary, then
+	// tries again just after. A fixed window would permit double the capacity.
+	fixed := NewFixedWindow(ClassPolicy{Algorithm: algorithmFixed, Capacity: 10})
+	sw := NewSlidingWindow(ClassPolicy{Algorithm: algorithmSliding, Capacity: 10, Window: Duration(time.Second)}).(*SlidingWindow)
+	fixedCount, slidingCount := 0, 0
+	for i := 0; i < 20; i++ {
+		if fixed.Allow(1).Permitted {
+			fixedCount++
+		}
+		if sw.Allow(1).Permitted {
+			slidingCount++
+		}
+	}
+
+	// cross the window boundary by 10ms
+	fixed.Reset()
+	sw.start = sw.start.Add(-1010 * time.Millisecond)
+	for i := 0; i < 20; i++ {
+		if fixed.Allow(1).Permitted {
+			fixedCount++
+		}
+		if sw.Allow(1).Permitted {
+			slidingCount++
+		}
+	}
+	if fixedCount != 20 {
+		t.Errorf("Expected fixed window to permit %v across the boundary, got %v", 20, fixedCount)
+	}
+	if slidingCount > 10 {
+		t.Errorf("Expected sliding window to permit no more than %v across the boundary, got %v", 10, slidingCount)
+	}
+}
+
+func Test_sliding_window_refund(t *testing.T) {
+	sw := NewSlidingWindow(ClassPolicy{Algorithm: algorithmSliding, Capacity: 10, Window: Duration(time.Hour)}).(*SlidingWindow)
+	sw.Allow(6)
+	if refunded := sw.Refund(2); refunded != 2 {
+		t.Errorf("Expected refunded to be %v, got %v", 2, refunded)
+	}
+	if sw.count != 4 {
+		t.Errorf("Expected count to be %v, got %v", 4, sw.count)
+	}
+	if refunded := sw.Refund(100); refunded != 4 {
+		t.Errorf("Expected refunded to be %v, got %v", 4, refunded)
+	}
+	if sw.count != 0 || sw.previous != 0 {
+		t.Errorf("Expected counts to be 0/0, got %v/%v", sw.count, sw.previous)
+	}
+}
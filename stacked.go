@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// algorithmStacked is reported by a StackedLimiter. It can't be chosen in the policy;
+// instead, a ClassPolicy with stacked Limits is enforced by a StackedLimiter.
+const algorithmStacked = "stacked"
+
+// StackedLimiter is a Limiter made of several limiters, e.g. per second, per minute
+// and per day, which only permits a request if every one of them does. Its limiters
+// are only ever used through the StackedLimiter, so holding its lock while checking
+// every limiter and then consuming from all of them makes the two steps atomic.
+type StackedLimiter struct {
+	limiters []Limiter
+	mu       sync.Mutex
+}
+
+// NewStackedLimiter creates a StackedLimiter with a Limiter for the ClassPolicy's
+// own limit, followed by one for each of its stacked Limits
+func NewStackedLimiter(cp ClassPolicy) (*StackedLimiter, error) {
+	sl := StackedLimiter{}
+	for _, limit := range cp.stack() {
+		l, err := NewLimiter(limit)
+		if err != nil {
+			return nil, err
+		}
+		sl.limiters = append(sl.limiters, l)
+	}
+	return &sl, nil
+}
+
+// Allow removes n from every limiter, but only if every limiter permits it
+func (sl *StackedLimiter) Allow(n int) Decision {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	return sl.allowLocked(n)
+}
+
+// Peek returns the Decision that Allow would make, without removing anything
+func (sl *StackedLimiter) Peek(n int) Decision {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	return sl.peekLocked(n)
+}
+
+// lock and unlock hold the StackedLimiter's lock for a transaction
+func (sl *StackedLimiter) lock()   { sl.mu.Lock() }
+func (sl *StackedLimiter) unlock() { sl.mu.Unlock() }
+
+// allowLocked is Allow, for when the lock is already held
+func (sl *StackedLimiter) allowLocked(n int) Decision {
+	d := sl.peekLocked(n)
+	if !d.Permitted {
+		return d
+	}
+	decisions := make([]Decision, len(sl.limiters))
+	for i, l := range sl.limiters {
+		decisions[i] = l.Allow(n)
+	}
+	return combine(decisions)
+}
+
+// peekLocked is Peek, for when the lock is already held
+func (sl *StackedLimiter) peekLocked(n int) Decision {
+	decisions := make([]Decision, len(sl.limiters))
+	for i, l := range sl.limiters {
+		decisions[i] = l.Peek(n)
+	}
+	return combine(decisions)
+}
+
+// combine makes one Decision from the decisions of several limiters. It is only
+// permitted if they all are, and its Remaining and Capacity come from the limiter
+// with the least remaining. The RetryAfter is the longest of any limiter that
+// didn't permit it, and it only resets if all of their denials do. The ResetAfter
+// is the longest of any limiter.
+func combine(decisions []Decision) Decision {
+	d := decisions[0]
+	d.Permitted = true
+	d.RetryAfter = 0
+	d.resets = true
+	for _, other := range decisions {
+		d.ResetAfter = max(d.ResetAfter, other.ResetAfter)
+		if other.Remaining < d.Remaining {
+			d.Remaining = other.Remaining
+			d.Capacity = other.Capacity
+		}
+		if !other.Permitted {
+			d.Permitted = false
+			d.RetryAfter = max(d.RetryAfter, other.RetryAfter)
+			d.resets = d.resets && other.resets
+		}
+	}
+	d.resets = d.resets && !d.Permitted
+	return d
+}
+
+// Refund adds n back to every limiter, returning how much was added to the
+// StackedLimiter's own limit
+func (sl *StackedLimiter) Refund(n int) int {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	refunded := 0
+	for i, l := range sl.limiters {
+		r := l.Refund(n)
+		if i == 0 {
+			refunded = r
+		}
+	}
+	return refunded
+}
+
+// Reset resets every limiter
+func (sl *StackedLimiter) Reset() {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	for _, l := range sl.limiters {
+		l.Reset()
+	}
+}
+
+// set sets the value and capacity of the StackedLimiter's own limit
+func (sl *StackedLimiter) set(value int, capacity int) error {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	s, ok := sl.limiters[0].(setter)
+	if !ok {
+		return errors.New("limiter cannot be set")
+	}
+	return s.set(value, capacity)
+}
+
+// SetLimit applies the ClassPolicy's own limit and its stacked Limits to each of
+// the limiters in turn. If a limit uses a different algorithm to the existing
+// limiter, or there are more limits than limiters, new limiters are created.
+func (sl *StackedLimiter) SetLimit(cp ClassPolicy) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	stack := cp.stack()
+	limiters := make([]Limiter, len(stack))
+	for i, limit := range stack {
+		if i < len(sl.limiters) && sl.limiters[i].State().Algorithm == limit.limiterAlgorithm() {
+			limiters[i] = sl.limiters[i]
+			continue
+		}
+		l, err := NewLimiter(limit)
+		if err != nil {
+			// the policy has been validated, so this shouldn't happen, but if
+			// it does, keep the limits as they were
+			return
+		}
+		limiters[i] = l
+	}
+	for i, l := range limiters {
+		l.SetLimit(stack[i])
+	}
+	sl.limiters = limiters
+}
+
+// State returns the State of the limiter with the least remaining, along with
+// the State of every limiter
+func (sl *StackedLimiter) State() LimiterState {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	state := LimiterState{Algorithm: algorithmStacked}
+	for i, l := range sl.limiters {
+		limitState := l.State()
+		if i == 0 || limitState.Value < state.Value {
+			state.Value = limitState.Value
+			state.Capacity = limitState.Capacity
+		}
+		state.Limits = append(state.Limits, limitState)
+	}
+	return state
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// perSecondPerMinute is 5 per second, but only 8 per minute
+var perSecondPerMinute = ClassPolicy{
+	Algorithm: algorithmToken,
+	Capacity:  5,
+	Rate:      5,
+	Limits: []ClassPolicy{
+		{Algorithm: algorithmSliding, Capacity: 8, Window: Duration(time.Minute)},
+	},
+}
+
+func Test_stacked_allow(t *testing.T) {
+	sl, err := NewStackedLimiter(perSecondPerMinute)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	perSecond := sl.limiters[0].(*TokenBucket)
+
+	// the per second limit permits 5
+	for i := 0; i < 5; i++ {
+		if d := sl.Allow(1); !d.Permitted {
+			t.Errorf("Expected allow %d to be permitted, got false", i)
+		}
+	}
+	d := sl.Allow(1)
+	if d.Permitted {
+		t.Error("Expected allow beyond the per second limit to be denied, got true")
+	}
+	if d.RetryAfter <= 0 || d.RetryAfter > 200*time.Millisecond {
+		t.Errorf("Expected RetryAfter to be up to 200ms, got %v", d.RetryAfter)
+	}
+
+	// a second later, the per minute limit only permits 3 more
+	perSecond.updated = perSecond.updated.Add(-time.Second)
+	for i := 0; i < 3; i++ {
+		if d := sl.Allow(1); !d.Permitted {
+			t.Errorf("Expected allow %d to be permitted, got false", i)
+		}
+	}
+	d = sl.Allow(1)
+	if d.Permitted {
+		t.Error("Expected allow beyond the per minute limit to be denied, got true")
+	}
+	if d.RetryAfter < 50*time.Second {
+		t.Errorf("Expected RetryAfter to wait for the per minute limit, got %v", d.RetryAfter)
+	}
+	if d.Remaining != 0 || d.Capacity != 8 {
+		t.Errorf("Expected the per minute limit to be 0/8, got %v/%v", d.Remaining, d.Capacity)
+	}
+
+	// nothing was taken from the per second limit when the per minute limit denied it
+	if perSecond.State().Value != 2 {
+		t.Errorf("Expected the per second limit to have 2 remaining, got %v", perSecond.State().Value)
+	}
+}
+
+func Test_stacked_state(t *testing.T) {
+	sl, _ := NewStackedLimiter(perSecondPerMinute)
+	sl.Allow(4)
+	state := sl.State()
+	if state.Algorithm != algorithmStacked || state.Value != 1 || state.Capacity != 5 {
+		t.Errorf("Expected stacked state to be 1/5, got %+v", state)
+	}
+	if len(state.Limits) != 2 || state.Limits[1].Value != 4 || state.Limits[1].Capacity != 8 {
+		t.Errorf("Expected the per minute limit to be 4/8, got %+v", state.Limits)
+	}
+}
+
+func Test_stacked_set_limit(t *testing.T) {
+	sl, _ := NewStackedLimiter(perSecondPerMinute)
+	sl.Allow(4)
+	perMinute := sl.limiters[1]
+
+	// the per minute limit keeps its count, and a per day limit is added
+	cp := perSecondPerMinute
+	cp.Limits = []ClassPolicy{
+		{Algorithm: algorithmSliding, Capacity: 10, Window: Duration(time.Minute)},
+		{Algorithm: algorithmSliding, Capacity: 100, Window: Duration(24 * time.Hour)},
+	}
+	sl.SetLimit(cp)
+	if len(sl.limiters) != 3 {
+		t.Fatalf("Expected 3 limiters, got %v", len(sl.limiters))
+	}
+	if sl.limiters[1] != perMinute || perMinute.State().Value != 6 {
+		t.Errorf("Expected the per minute limit to be kept with 6 remaining, got %+v", perMinute.State())
+	}
+	if sl.limiters[2].State().Value != 100 {
+		t.Errorf("Expected a new per day limit with 100 remaining, got %+v", sl.limiters[2].State())
+	}
+}
+
+func Test_stacked_refund(t *testing.T) {
+	sl, err := NewStackedLimiter(perSecondPerMinute)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	sl.Allow(4)
+	if refunded := sl.Refund(3); refunded != 3 {
+		t.Errorf("Expected refunded to be %v, got %v", 3, refunded)
+	}
+	state := sl.State()
+	if state.Limits[0].Value != 4 || state.Limits[1].Value != 7 {
+		t.Errorf("Expected the limits to be refunded to 4 and 7, got %v and %v", state.Limits[0].Value, state.Limits[1].Value)
+	}
+}
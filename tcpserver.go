@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -12,7 +13,15 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-// listenTCPServer creates a TCP listener on the server's port
+// maxLine is the longest line a stream client can send, which is the same as the
+// largest UDP message, so that a BATCH of maxBatch requests fits, even when signed
+const maxLine = maxDatagram
+
+// errLineTooLong is the error when a stream client sends a line longer than maxLine
+var errLineTooLong = fmt.Errorf("line longer than %d bytes", maxLine)
+
+// listenTCPServer creates a TCP listener on the server's port, which uses TLS if it
+// is turned on
 func (s *Server) listenTCPServer() (net.Listener, error) {
 
 	// listen on the server's port
@@ -21,20 +30,24 @@ func (s *Server) listenTCPServer() (net.Listener, error) {
 	if err != nil {
 		return nil, err
 	}
+	if s.tls != nil {
+		return tls.NewListener(ln, s.tls.tlsConfig()), nil
+	}
 	return ln, nil
 }
 
-// runTCPServer executes a TCP server. It takes an already-started network
-// listener. It accepts socket connections and sets up a go-routine per
-// socket to handle incoming messages. Each socket times out after a period
-// of inactivity.
-func (s *Server) runTCPServer(ctx context.Context, ln net.Listener) {
+// runStreamServer executes a stream server, for TCP or unix sockets. It takes an
+// already-started network listener. It accepts socket connections and sets up a
+// go-routine per socket to handle incoming messages. Each socket times out after
+// a period of inactivity. Lines that are too long are denied, and their connection
+// closed, as the rest of the line can't be told apart from the next.
+func (s *Server) runStreamServer(ctx context.Context, protocol string, ln net.Listener) {
 	defer s.wg.Done()
 
 	// Stop accepting new connections when context is canceled
 	go func() {
 		<-ctx.Done()
-		slog.Info("Closing TCP server")
+		slog.Info("Closing " + protocol + " server")
 		ln.Close()
 	}()
 
@@ -43,10 +56,10 @@ func (s *Server) runTCPServer(ctx context.Context, ln net.Listener) {
 		conn, err := ln.Accept()
 		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
-				slog.Info("TCP server closed")
+				slog.Info(protocol + " server closed")
 				return // graceful shutdown
 			}
-			slog.Error("TCP accept error", "error", err)
+			slog.Error(protocol+" accept error", "error", err)
 			continue
 		}
 
@@ -63,9 +76,16 @@ func (s *Server) runTCPServer(ctx context.Context, ln net.Listener) {
 
 			// create line reader
 			reader := bufio.NewScanner(conn)
-			reader.Buffer(make([]byte, 0, 1024), 1024)
+			reader.Buffer(make([]byte, 0, 1024), maxLine)
 			conn.SetDeadline(time.Now().Add(idleTimeout))
 
+			// TLS clients are identified by their certificate, if they have one
+			caller, err := connCaller(conn)
+			if err != nil {
+				slog.Error(protocol+" TLS handshake error", "addr", conn.RemoteAddr(), "error", err)
+				return
+			}
+
 			// read each line
 			for reader.Scan() {
 				timer := prometheus.NewTimer(s.met.tcpRequestDuration)
@@ -73,13 +93,34 @@ func (s *Server) runTCPServer(ctx context.Context, ln net.Listener) {
 				line := reader.Text()
 
 				// parse the message and reply back to the caller
-				response := s.handleMessage("TCP", line)
+				response := s.handleMessageFrom(protocol, caller, line)
 				_, err := conn.Write([]byte(response + "\n"))
 				timer.ObserveDuration()
 				if err != nil {
-					slog.Error("TCP failed to send response", "error", err)
+					slog.Error(protocol+" failed to send response", "error", err)
 				}
 			}
+			if errors.Is(reader.Err(), bufio.ErrTooLong) {
+				s.errored(protocol, errLineTooLong)
+				conn.Write([]byte(denyResponse + "\n"))
+			}
 		}()
 	}
 }
+
+// connCaller identifies the Caller on a connection, completing the TLS handshake
+// first if it is a TLS connection
+func connCaller(conn net.Conn) (Caller, error) {
+	caller := Caller{Addr: conn.RemoteAddr()}
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return caller, nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return caller, err
+	}
+	if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		caller.Identity = certIdentity(certs[0])
+	}
+	return caller, nil
+}
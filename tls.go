@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// certReloader loads the TCP listener's TLS certificate, key and client CA bundle,
+// reloading them when a handshake finds that their files have changed, so that
+// certificates can be renewed without a restart. If reloading fails, the files
+// that were loaded before are still used.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	mu       sync.Mutex
+	modTimes []time.Time
+	config   *tls.Config
+}
+
+// newCertReloader loads the certificate and key, and the client CA bundle if there is
+// one, in which case clients must present a certificate signed by one of its CAs
+func newCertReloader(certFile string, keyFile string, caFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	modTimes, err := cr.stat()
+	if err != nil {
+		return nil, err
+	}
+	config, err := cr.load()
+	if err != nil {
+		return nil, err
+	}
+	cr.modTimes = modTimes
+	cr.config = config
+	return cr, nil
+}
+
+// tlsConfig returns the config for a TLS listener, which uses the latest files
+func (cr *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: cr.configForClient,
+	}
+}
+
+// configForClient returns the config for a handshake, reloading the files first if
+// they have changed
+func (cr *certReloader) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	modTimes, err := cr.stat()
+	if err != nil {
+		slog.Error("Cannot check TLS files", "error", err)
+		return cr.config, nil
+	}
+	if slices.EqualFunc(modTimes, cr.modTimes, time.Time.Equal) {
+		return cr.config, nil
+	}
+	config, err := cr.load()
+	if err != nil {
+		slog.Error("Cannot reload TLS files", "error", err)
+		return cr.config, nil
+	}
+	cr.modTimes = modTimes
+	cr.config = config
+	slog.Info("Reloaded TLS files", "cert", cr.certFile)
+	return config, nil
+}
+
+// stat returns the modification times of the files
+func (cr *certReloader) stat() ([]time.Time, error) {
+	var modTimes []time.Time
+	for _, filename := range []string{cr.certFile, cr.keyFile, cr.caFile} {
+		if filename == "" {
+			continue
+		}
+		info, err := os.Stat(filename)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	return modTimes, nil
+}
+
+// load reads the files into a config
+func (cr *certReloader) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if cr.caFile != "" {
+		pem, err := os.ReadFile(cr.caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in client CA file")
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
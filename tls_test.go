@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and key generated for a test
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// issueCert generates a certificate from a template, signed by the issuer, or
+// self-signed if there is no issuer
+func issueCert(t *testing.T, template *x509.Certificate, issuer *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Cannot generate key: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	parent, signer := template, key
+	if issuer != nil {
+		parent, signer = issuer.cert, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("Cannot create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// testPKI generates a CA, and a server and client certificate that it has signed
+func testPKI(t *testing.T) (ca *testCert, server *testCert, client *testCert) {
+	t.Helper()
+	ca = issueCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	server = issueCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	client = issueCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "client-1"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	return ca, server, client
+}
+
+// writeFile writes a file to the directory, returning its path
+func writeFile(t *testing.T, dir string, name string, data []byte) string {
+	t.Helper()
+	filename := filepath.Join(dir, name)
+	if err := os.WriteFile(filename, data, 0600); err != nil {
+		t.Fatalf("Cannot write %v: %v", filename, err)
+	}
+	return filename
+}
+
+// runTLSServer runs the server's TCP listener with TLS on a random port, returning its address
+func runTLSServer(t *testing.T, server *Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	server.wg.Add(1)
+	go server.runStreamServer(ctx, "TCP", tls.NewListener(ln, server.tls.tlsConfig()))
+	t.Cleanup(func() {
+		cancel()
+		server.wg.Wait()
+	})
+	return ln.Addr().String()
+}
+
+// tlsSend connects to the server, sends a message and returns the response
+func tlsSend(addr string, config *tls.Config, message string) (string, error) {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(message + "\n")); err != nil {
+		return "", err
+	}
+	return bufio.NewReader(conn).ReadString('\n')
+}
+
+func Test_tls_mutual(t *testing.T) {
+	ca, serverCert, clientCert := testPKI(t)
+	dir := t.TempDir()
+	server := NewServer(8888, NewMetrics())
+	err := server.SetTLS(
+		writeFile(t, dir, "server.pem", serverCert.certPEM),
+		writeFile(t, dir, "server.key", serverCert.keyPEM),
+		writeFile(t, dir, "ca.pem", ca.certPEM),
+		true)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	addr := runTLSServer(t, server)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	keyPair, _ := tls.X509KeyPair(clientCert.certPEM, clientCert.keyPEM)
+	config := &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{keyPair}}
+
+	// the client's identity is used as the account name, whatever the message says
+	response, err := tlsSend(addr, config, "someone-else,l,10,1")
+	if err != nil || response != "p\n" {
+		t.Errorf("Expected %q, got %q (%v)", "p\n", response, err)
+	}
+	if server.handleMessage("test", "PEEK,client-1,l") != "9,10" {
+		t.Error("Expected the message to use the client's account")
+	}
+	if server.handleMessage("test", "PEEK,someone-else,l") != "0,0" {
+		t.Error("Expected the message not to use the account it named")
+	}
+
+	// clients without a certificate are turned away
+	if _, err := tlsSend(addr, &tls.Config{RootCAs: roots}, "gb,l,10,1"); err == nil {
+		t.Error("Expected error for a client without a certificate, got nil")
+	}
+}
+
+func Test_tls_identity_accounts_need_ca(t *testing.T) {
+	_, serverCert, _ := testPKI(t)
+	dir := t.TempDir()
+	server := NewServer(8888, NewMetrics())
+	err := server.SetTLS(
+		writeFile(t, dir, "server.pem", serverCert.certPEM),
+		writeFile(t, dir, "server.key", serverCert.keyPEM),
+		"",
+		true)
+	if err == nil {
+		t.Error("Expected error for identity accounts without a client CA file, got nil")
+	}
+	if server.tls != nil || server.identityAccounts {
+		t.Error("Expected TLS to stay off")
+	}
+}
+
+func Test_tls_reload(t *testing.T) {
+	ca, serverCert, _ := testPKI(t)
+	dir := t.TempDir()
+	certFile := writeFile(t, dir, "server.pem", serverCert.certPEM)
+	keyFile := writeFile(t, dir, "server.key", serverCert.keyPEM)
+	server := NewServer(8888, NewMetrics())
+	if err := server.SetTLS(certFile, keyFile, "", false); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	addr := runTLSServer(t, server)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	serverName := func() string {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots})
+		if err != nil {
+			t.Fatalf("Cannot connect: %v", err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	if name := serverName(); name != "localhost" {
+		t.Errorf("Expected certificate %v, got %v", "localhost", name)
+	}
+
+	// the renewed certificate is used without a restart
+	renewed := issueCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "renewed"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	writeFile(t, dir, "server.pem", renewed.certPEM)
+	writeFile(t, dir, "server.key", renewed.keyPEM)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	if name := serverName(); name != "renewed" {
+		t.Errorf("Expected certificate %v, got %v", "renewed", name)
+	}
+
+	// files that can't be loaded leave the previous certificate in place
+	writeFile(t, dir, "server.pem", []byte("gibberish"))
+	later = later.Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if name := serverName(); name != "renewed" {
+		t.Errorf("Expected certificate %v, got %v", "renewed", name)
+	}
+}
+
+func Test_tls_cert_identity(t *testing.T) {
+	spiffe, _ := url.Parse("spiffe://example.org/billing")
+	tests := []struct {
+		cert     *x509.Certificate
+		identity string
+	}{
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "bob"}, DNSNames: []string{"bob.example.org"}}, "bob"},
+		{&x509.Certificate{DNSNames: []string{"bob.example.org"}}, "bob.example.org"},
+		{&x509.Certificate{EmailAddresses: []string{"bob@example.org"}}, "bob@example.org"},
+		{&x509.Certificate{URIs: []*url.URL{spiffe}}, "spiffe://example.org/billing"},
+		{&x509.Certificate{}, ""},
+	}
+	for _, test := range tests {
+		if identity := certIdentity(test.cert); identity != test.identity {
+			t.Errorf("Expected identity %q, got %q", test.identity, identity)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// TokenBucket is a Limiter that is topped up continuously at rate tokens per second,
+// up to its capacity (the burst size). Rather than being reset, the tokens that have
+// accrued since it was last updated are added lazily, whenever it is used.
+type TokenBucket struct {
+	value    int
+	capacity int
+	rate     float64
+	updated  time.Time
+	mu       sync.Mutex
+}
+
+// NewTokenBucket creates a full TokenBucket with the ClassPolicy's capacity and rate
+func NewTokenBucket(cp ClassPolicy) Limiter {
+	return &TokenBucket{
+		value:    cp.Capacity,
+		capacity: cp.Capacity,
+		rate:     cp.Rate,
+		updated:  time.Now(),
+	}
+}
+
+// Allow removes n tokens from the bucket, if there are enough
+func (tb *TokenBucket) Allow(n int) Decision {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return tb.allowLocked(n)
+}
+
+// Peek returns the Decision that Allow would make, without removing any tokens
+func (tb *TokenBucket) Peek(n int) Decision {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return tb.peekLocked(n)
+}
+
+// lock and unlock hold the bucket's lock for a transaction
+func (tb *TokenBucket) lock()   { tb.mu.Lock() }
+func (tb *TokenBucket) unlock() { tb.mu.Unlock() }
+
+// peekLocked is Peek, for when the lock is already held
+func (tb *TokenBucket) peekLocked(n int) Decision {
+	now := time.Now()
+	tb.refill(now)
+	return tb.decide(n, now)
+}
+
+// allowLocked is Allow, for when the lock is already held
+func (tb *TokenBucket) allowLocked(n int) Decision {
+	now := time.Now()
+	tb.refill(now)
+	d := tb.decide(n, now)
+	if d.Permitted {
+		tb.value -= n
+		d.Remaining = tb.value
+		d.ResetAfter = tb.untilFull(now)
+	}
+	return d
+}
+
+// decide works out whether there are enough tokens for n, and if not, how long
+// until there will be. It must be called with the lock held.
+func (tb *TokenBucket) decide(n int, now time.Time) Decision {
+	d := Decision{
+		Permitted:  n > 0 && tb.value >= n,
+		Remaining:  tb.value,
+		Capacity:   tb.capacity,
+		ResetAfter: tb.untilFull(now),
+	}
+	if !d.Permitted && n > 0 && n <= tb.capacity && tb.rate > 0 {
+		wait := interval(n-tb.value, tb.rate) - now.Sub(tb.updated)
+		d.RetryAfter = max(wait, 0)
+	}
+	return d
+}
+
+// untilFull is how long until the bucket is full again, or zero if it is full or
+// never refills. It must be called with the lock held.
+func (tb *TokenBucket) untilFull(now time.Time) time.Duration {
+	if tb.value >= tb.capacity || tb.rate <= 0 {
+		return 0
+	}
+	return max(interval(tb.capacity-tb.value, tb.rate)-now.Sub(tb.updated), 0)
+}
+
+// refill tops up the bucket with the whole tokens that have accrued since
+// it was last updated. It must be called with the lock held.
+func (tb *TokenBucket) refill(now time.Time) {
+	if tb.rate <= 0 {
+		return
+	}
+	tokens := int(now.Sub(tb.updated).Seconds() * tb.rate)
+	if tokens > 0 {
+		tb.value = min(tb.value+tokens, tb.capacity)
+		// only use up the time needed to accrue the whole tokens
+		tb.updated = tb.updated.Add(interval(tokens, tb.rate))
+	}
+	// a full bucket doesn't accrue any more tokens
+	if tb.value >= tb.capacity {
+		tb.updated = now
+	}
+}
+
+// Refund adds n tokens back to the bucket, up to its capacity
+func (tb *TokenBucket) Refund(n int) int {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if n <= 0 {
+		return 0
+	}
+	now := time.Now()
+	tb.refill(now)
+	refunded := min(n, tb.capacity-tb.value)
+	tb.value += refunded
+	if tb.value >= tb.capacity {
+		tb.updated = now
+	}
+	return refunded
+}
+
+// Reset does nothing, as token buckets top themselves up
+func (tb *TokenBucket) Reset() {}
+
+// set sets the tokens and capacity of the bucket
+func (tb *TokenBucket) set(value int, capacity int) error {
+	if value < 0 || capacity < 0 {
+		return errors.New("cannot accept negative value or capacity")
+	}
+	if value > capacity {
+		return errors.New("value cannot exceed capacity")
+	}
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.value = value
+	tb.capacity = capacity
+	tb.updated = time.Now()
+	return nil
+}
+
+// SetLimit changes the capacity and rate of the bucket, keeping its current
+// tokens unless they exceed the new capacity
+func (tb *TokenBucket) SetLimit(cp ClassPolicy) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.refill(time.Now())
+	tb.capacity = cp.Capacity
+	tb.rate = cp.Rate
+	tb.value = min(tb.value, tb.capacity)
+}
+
+// State returns the bucket's tokens and capacity
+func (tb *TokenBucket) State() LimiterState {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.refill(time.Now())
+	return LimiterState{
+		Algorithm: algorithmToken,
+		Value:     tb.value,
+		Capacity:  tb.capacity,
+	}
+}
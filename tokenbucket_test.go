@@ -0,0 +1,83 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_token_bucket_allow(t *testing.T) {
+	tb := NewTokenBucket(ClassPolicy{Algorithm: algorithmToken, Capacity: 10, Rate: 10}).(*TokenBucket)
+	// a burst of 10 is permitted, then denied
+	for i := 0; i < 10; i++ {
+		if d := tb.Allow(1); !d.Permitted {
+			t.Errorf("Expected allow %d to be permitted, got false", i)
+		}
+	}
+	d := tb.Allow(1)
+	if d.Permitted {
+		t.Error("Expected allow beyond burst to be denied, got true")
+	}
+	if d.RetryAfter <= 0 || d.RetryAfter > 100*time.Millisecond {
+		t.Errorf("Expected RetryAfter to be up to 100ms, got %v", d.RetryAfter)
+	}
+	if d.ResetAfter <= 900*time.Millisecond || d.ResetAfter > time.Second {
+		t.Errorf("Expected ResetAfter to be up to 1s, got %v", d.ResetAfter)
+	}
+
+	// token buckets are not reset
+	tb.Reset()
+	if tb.State().Value != 0 {
+		t.Errorf("Expected bucket Value to remain 0 after reset, got %d", tb.State().Value)
+	}
+
+	// half a second later, 5 tokens have accrued
+	tb.updated = tb.updated.Add(-500 * time.Millisecond)
+	if d := tb.Peek(5); !d.Permitted || d.Remaining != 5 {
+		t.Errorf("Expected peek of accrued tokens to be permitted with 5 remaining, got %+v", d)
+	}
+	if d := tb.Allow(5); !d.Permitted {
+		t.Error("Expected allow of accrued tokens to be permitted, got false")
+	}
+	if d := tb.Allow(1); d.Permitted {
+		t.Error("Expected allow beyond accrued tokens to be denied, got true")
+	}
+
+	// a long time later, the bucket is only filled to its capacity
+	tb.updated = tb.updated.Add(-time.Hour)
+	d = tb.Allow(1)
+	if d.Remaining != 9 {
+		t.Errorf("Expected bucket Remaining to be 9, got %d", d.Remaining)
+	}
+}
+
+func Test_token_bucket_set_limit(t *testing.T) {
+	tb := NewTokenBucket(ClassPolicy{Algorithm: algorithmToken, Capacity: 10, Rate: 10})
+	tb.Allow(4)
+	tb.SetLimit(ClassPolicy{Algorithm: algorithmToken, Capacity: 20, Rate: 1})
+	state := tb.State()
+	if state.Value != 6 || state.Capacity != 20 {
+		t.Errorf("Expected state to be 6/20, got %+v", state)
+	}
+	tb.SetLimit(ClassPolicy{Algorithm: algorithmToken, Capacity: 3, Rate: 1})
+	state = tb.State()
+	if state.Value != 3 || state.Capacity != 3 {
+		t.Errorf("Expected state to be 3/3, got %+v", state)
+	}
+}
+
+func Test_token_bucket_refund(t *testing.T) {
+	tb := NewTokenBucket(ClassPolicy{Algorithm: algorithmToken, Capacity: 10, Rate: 1}).(*TokenBucket)
+	tb.Allow(6)
+	if refunded := tb.Refund(2); refunded != 2 {
+		t.Errorf("Expected refunded to be %v, got %v", 2, refunded)
+	}
+	if tb.State().Value != 6 {
+		t.Errorf("Expected value to be %v, got %v", 6, tb.State().Value)
+	}
+	if refunded := tb.Refund(100); refunded != 4 {
+		t.Errorf("Expected refunded to be %v, got %v", 4, refunded)
+	}
+	if tb.State().Value != 10 {
+		t.Errorf("Expected value to be %v, got %v", 10, tb.State().Value)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"maps"
+	"slices"
+)
+
+// transactor is implemented by limiters that can take part in a transaction, which
+// holds the lock of every limiter involved while checking and then consuming from them
+type transactor interface {
+	lock()
+	unlock()
+	peekLocked(n int) Decision
+	allowLocked(n int) Decision
+}
+
+// txRequest asks to remove n from a Limiter as part of a transaction. The key
+// identifies the Limiter, e.g. by its account and class, and decides the order
+// in which limiters are locked.
+type txRequest struct {
+	key     string
+	limiter Limiter
+	n       int
+}
+
+// transact removes n from the Limiter of every request, but only if every Limiter
+// permits it, returning a Decision for each request. The limiters
+// are locked in the order of their keys, so that concurrent transactions over the same
+// limiters can't deadlock, and requests with the same key are added together, so that
+// their Limiter is only locked and asked once. Limiters that aren't transactors are
+// checked and consumed from without being locked.
+func transact(requests []txRequest) []Decision {
+	totals := map[string]int{}
+	limiters := map[string]Limiter{}
+	for _, r := range requests {
+		totals[r.key] += r.n
+		limiters[r.key] = r.limiter
+	}
+	keys := slices.Sorted(maps.Keys(totals))
+	for _, key := range keys {
+		if t, ok := limiters[key].(transactor); ok {
+			t.lock()
+			defer t.unlock()
+		}
+	}
+
+	permitted := true
+	decisions := map[string]Decision{}
+	for _, key := range keys {
+		decisions[key] = peekLocked(limiters[key], totals[key])
+		permitted = permitted && decisions[key].Permitted
+	}
+	if permitted {
+		for _, key := range keys {
+			decisions[key] = allowLocked(limiters[key], totals[key])
+		}
+	}
+
+	results := make([]Decision, len(requests))
+	for i, r := range requests {
+		results[i] = decisions[r.key]
+		results[i].Permitted = permitted
+	}
+	return results
+}
+
+// peekLocked peeks at a Limiter that has been locked for a transaction
+func peekLocked(l Limiter, n int) Decision {
+	if t, ok := l.(transactor); ok {
+		return t.peekLocked(n)
+	}
+	return l.Peek(n)
+}
+
+// allowLocked removes n from a Limiter that has been locked for a transaction
+func allowLocked(l Limiter, n int) Decision {
+	if t, ok := l.(transactor); ok {
+		return t.allowLocked(n)
+	}
+	return l.Allow(n)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_transaction_all_or_nothing(t *testing.T) {
+	w := NewFixedWindow(ClassPolicy{Capacity: 10})
+	q := NewTokenBucket(ClassPolicy{Algorithm: algorithmToken, Capacity: 1, Rate: 0.001})
+	requests := []txRequest{
+		{key: "gb\x00w", limiter: w, n: 5},
+		{key: "gb\x00q", limiter: q, n: 1},
+	}
+	decisions := transact(requests)
+	if !decisions[0].Permitted || !decisions[1].Permitted {
+		t.Errorf("Expected both requests to be permitted, got %v", decisions)
+	}
+	if decisions[0].Remaining != 5 || decisions[1].Remaining != 0 {
+		t.Errorf("Expected 5 and 0 remaining, got %v and %v", decisions[0].Remaining, decisions[1].Remaining)
+	}
+
+	// q is empty, so nothing is taken from w
+	decisions = transact(requests)
+	if decisions[0].Permitted || decisions[1].Permitted {
+		t.Errorf("Expected both requests to be denied, got %v", decisions)
+	}
+	if w.State().Value != 5 {
+		t.Errorf("Expected w to be untouched at %v, got %v", 5, w.State().Value)
+	}
+}
+
+func Test_transaction_same_key(t *testing.T) {
+	w := NewFixedWindow(ClassPolicy{Capacity: 10})
+	// the same bucket twice is only permitted if it has room for both
+	requests := []txRequest{
+		{key: "gb\x00w", limiter: w, n: 6},
+		{key: "gb\x00w", limiter: w, n: 6},
+	}
+	decisions := transact(requests)
+	if decisions[0].Permitted || decisions[1].Permitted {
+		t.Errorf("Expected both requests to be denied, got %v", decisions)
+	}
+	requests[1].n = 4
+	decisions = transact(requests)
+	if !decisions[0].Permitted || !decisions[1].Permitted {
+		t.Errorf("Expected both requests to be permitted, got %v", decisions)
+	}
+	if w.State().Value != 0 {
+		t.Errorf("Expected w to be empty, got %v", w.State().Value)
+	}
+}
+
+func Test_transaction_parallel(t *testing.T) {
+	l := NewFixedWindow(ClassPolicy{Capacity: 1000})
+	w, err := NewLimiter(perSecondPerMinute)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	q := NewSlidingWindow(ClassPolicy{Algorithm: algorithmSliding, Capacity: 1000, Window: Duration(time.Minute)})
+	forwards := []txRequest{{"l", l, 1}, {"w", w, 1}, {"q", q, 1}}
+	backwards := []txRequest{{"q", q, 1}, {"w", w, 1}, {"l", l, 1}}
+
+	// transactions listing the limiters in different orders don't deadlock
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	permitCount := 0
+	for i := 0; i < 8; i++ {
+		requests := forwards
+		if i%2 == 1 {
+			requests = backwards
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if transact(requests)[0].Permitted {
+					mu.Lock()
+					permitCount++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// w only permits 5 per second and 8 per minute, and the others are only taken from with it
+	if permitCount < 5 || permitCount > 8 {
+		t.Errorf("Expected permit count to be between 5 and 8, got %v", permitCount)
+	}
+	if l.State().Value != 1000-permitCount {
+		t.Errorf("Expected l to have %v remaining, got %v", 1000-permitCount, l.State().Value)
+	}
+	if q.State().Value != 1000-permitCount {
+		t.Errorf("Expected q to have %v remaining, got %v", 1000-permitCount, q.State().Value)
+	}
+}
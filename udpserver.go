@@ -11,7 +11,11 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-func (s *Server) listenUDPServer() (*net.UDPConn, error) {
+// maxDatagram is the largest UDP payload
+const maxDatagram = 65535
+
+// listenUDPServer creates a UDP socket on the server's port
+func (s *Server) listenUDPServer() (net.PacketConn, error) {
 	// listen on the server's port
 	portStr := fmt.Sprintf(":%v", s.port)
 	address, err := net.ResolveUDPAddr("udp", portStr)
@@ -25,42 +29,49 @@ func (s *Server) listenUDPServer() (*net.UDPConn, error) {
 	return conn, nil
 }
 
-// runUDPServer executes a UDP server. It starts listening on the specified port,
-// dispatching incoming messages to its own goroutine.
-func (s *Server) runUDPServer(ctx context.Context, conn *net.UDPConn) {
+// runPacketServer executes a datagram server, for UDP or unixgram sockets. It reads
+// datagrams from an already-opened connection, dispatching each incoming message to
+// its own goroutine.
+func (s *Server) runPacketServer(ctx context.Context, protocol string, conn net.PacketConn) {
 	defer s.wg.Done()
 
 	// Stop waiting for incoming messages when the context is done
 	go func() {
 		<-ctx.Done()
-		slog.Info("Closing UDP server")
+		slog.Info("Closing " + protocol + " server")
 		conn.Close()
 	}()
 
-	// wait for messages of up to 128 bytes
-	buffer := make([]byte, 128)
+	// wait for messages of up to the largest UDP payload, so they are never truncated
+	buffer := make([]byte, maxDatagram)
 	for {
 
-		n, addr, err := conn.ReadFromUDP(buffer)
+		n, addr, err := conn.ReadFrom(buffer)
 		timer := prometheus.NewTimer(s.met.udpRequestDuration)
 		if err != nil {
 			if errors.Is(err, net.ErrClosed) {
-				slog.Info("UDP server closed")
+				slog.Info(protocol + " server closed")
 				return // graceful shutdown
 			}
-			slog.Error("UDP read error", "error", err)
+			slog.Error(protocol+" read error", "error", err)
 			continue
 		}
 
 		// clone buffer and send to goroutine to handle the message
 		data := make([]byte, n)
 		copy(data, buffer[:n])
-		go func(a *net.UDPAddr, t *prometheus.Timer) {
-			// parse the message and reply back to the caller
-			response := s.handleMessage("UDP", strings.TrimSpace(string(data)))
-			_, err := conn.WriteToUDP([]byte(response), a)
+		go func(a net.Addr, t *prometheus.Timer) {
+			// parse the message and reply back to the caller, in the protocol it used
+			caller := Caller{Addr: a}
+			var response []byte
+			if isBinary(data) {
+				response = s.handleBinary(protocol, caller, data)
+			} else {
+				response = []byte(s.handleMessageFrom(protocol, caller, strings.TrimSpace(string(data))))
+			}
+			_, err := conn.WriteTo(response, a)
 			if err != nil {
-				slog.Error("UDP failed to send response", "addr", a, "error", err)
+				slog.Error(protocol+" failed to send response", "addr", a, "error", err)
 			}
 			t.ObserveDuration()
 		}(addr, timer)
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// defaultSocketMode is the permissions of a unix socket file, if they aren't configured
+const defaultSocketMode fs.FileMode = 0660
+
+// listenUnixServer creates a unix stream socket at the server's unixPath. The socket
+// file is removed when the listener is closed.
+func (s *Server) listenUnixServer() (net.Listener, error) {
+	if err := removeStaleSocket("unix", s.unixPath); err != nil {
+		return nil, err
+	}
+	return bindSocket(s.unixPath, s.socketMode, func(path string) (net.Listener, error) {
+		ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+		if err != nil {
+			return nil, err
+		}
+		// the listener would remove the file at the private path, which is renamed
+		ln.SetUnlinkOnClose(false)
+		return &unlinkingListener{Listener: ln, path: s.unixPath}, nil
+	})
+}
+
+// listenUnixgramServer creates a unix datagram socket at the server's unixgramPath.
+// Clients must bind their own sockets to get replies. The socket file is removed
+// when the connection is closed.
+func (s *Server) listenUnixgramServer() (net.PacketConn, error) {
+	if err := removeStaleSocket("unixgram", s.unixgramPath); err != nil {
+		return nil, err
+	}
+	return bindSocket(s.unixgramPath, s.socketMode, func(path string) (net.PacketConn, error) {
+		conn, err := net.ListenPacket("unixgram", path)
+		if err != nil {
+			return nil, err
+		}
+		return &unlinkingConn{PacketConn: conn, path: s.unixgramPath}, nil
+	})
+}
+
+// bindSocket creates a socket file at path with the given mode. The socket is created
+// by listen in a private directory next to path, and only renamed into place once it
+// has its mode, so that it can never be connected to with looser permissions. The
+// socket that listen returns must remove the file at path, not its own, when closed.
+func bindSocket[T io.Closer](path string, mode fs.FileMode, listen func(string) (T, error)) (T, error) {
+	var socket T
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".sock")
+	if err != nil {
+		return socket, err
+	}
+	defer os.RemoveAll(dir)
+	private := filepath.Join(dir, filepath.Base(path))
+	socket, err = listen(private)
+	if err != nil {
+		return socket, err
+	}
+	if err := os.Chmod(private, mode); err != nil {
+		socket.Close()
+		return socket, err
+	}
+	if err := os.Rename(private, path); err != nil {
+		socket.Close()
+		return socket, err
+	}
+	return socket, nil
+}
+
+// unlinkingListener is a unix stream listener that removes its socket file, which
+// was renamed after it was created, when it is closed
+type unlinkingListener struct {
+	net.Listener
+	path string
+}
+
+// Close removes the listener's socket file and closes it
+func (l *unlinkingListener) Close() error {
+	os.Remove(l.path)
+	return l.Listener.Close()
+}
+
+// unlinkingConn is a unixgram connection that removes its socket file when it is
+// closed, as an unlinkingListener does
+type unlinkingConn struct {
+	net.PacketConn
+	path string
+}
+
+// Close removes the connection's socket file and closes it. The file is removed
+// first, so that it is gone by the time anything waiting on the connection returns.
+func (c *unlinkingConn) Close() error {
+	os.Remove(c.path)
+	return c.PacketConn.Close()
+}
+
+// removeStaleSocket removes a socket file left behind by a server that didn't shut
+// down cleanly. If the file isn't a socket, or another server is still listening
+// on it, an error is returned rather than removing it.
+func removeStaleSocket(network string, path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%s exists and isn't a socket", path)
+	}
+	if conn, err := net.DialTimeout(network, path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another server", path)
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_unix_stream(t *testing.T) {
+	met := NewMetrics()
+	server := NewServer(8888, met)
+	path := filepath.Join(t.TempDir(), "limiter.sock")
+	server.SetUnixSockets(path, "", 0600)
+	ln, err := server.listenUnixServer()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected socket permissions %v, got %v (%v)", fs.FileMode(0600), info.Mode().Perm(), err)
+	}
+	// the private directory the socket was created in is removed
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("Expected only the socket file to be left, got %v", entries)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	server.wg.Add(1)
+	go server.runStreamServer(ctx, "UNIX", ln)
+
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Cannot connect to unix socket: %v", err)
+	}
+	conn.Write([]byte("gb,l,10,1\n"))
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || reply != "p\n" {
+		t.Errorf("Expected %q, got %q (%v)", "p\n", reply, err)
+	}
+	conn.Close()
+
+	// the socket file is removed on shutdown
+	cancel()
+	server.wg.Wait()
+	if _, err := os.Lstat(path); err == nil {
+		t.Error("Expected the socket file to be removed")
+	}
+}
+
+func Test_unix_stream_long_lines(t *testing.T) {
+	server := signingServer(false)
+	path := filepath.Join(t.TempDir(), "limiter.sock")
+	server.SetUnixSockets(path, "", 0600)
+	ln, err := server.listenUnixServer()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	server.wg.Add(1)
+	go server.runStreamServer(ctx, "UNIX", ln)
+	t.Cleanup(func() {
+		cancel()
+		server.wg.Wait()
+	})
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("Cannot connect to unix socket: %v", err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	// a signed BATCH of maxBatch requests fits on a line
+	batch := "BATCH" + strings.Repeat(";account-with-a-long-name,l,1,1000", maxBatch)
+	conn.Write([]byte(signMessage("k1", "old secret", time.Now(), "n1", batch) + "\n"))
+	reply, err := reader.ReadString('\n')
+	if expected := strings.Repeat("p;", maxBatch-1) + "p\n"; err != nil || reply != expected {
+		t.Errorf("Expected %q, got %q (%v)", expected, reply, err)
+	}
+
+	// a line that is too long is denied, rather than dropped
+	conn.Write([]byte(strings.Repeat("x", maxLine+1) + "\n"))
+	reply, err = reader.ReadString('\n')
+	if err != nil || reply != "d\n" {
+		t.Errorf("Expected %q, got %q (%v)", "d\n", reply, err)
+	}
+}
+
+func Test_unix_datagram(t *testing.T) {
+	met := NewMetrics()
+	server := NewServer(8888, met)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "limiter.sock")
+	server.SetUnixSockets("", path, defaultSocketMode)
+	conn, err := server.listenUnixgramServer()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	server.wg.Add(1)
+	go server.runPacketServer(ctx, "UNIXGRAM", conn)
+
+	// the client binds its own socket, to get a reply
+	client, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, "client.sock"), Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("Cannot bind client socket: %v", err)
+	}
+	defer client.Close()
+	client.WriteTo([]byte("gb,l,10,1"), &net.UnixAddr{Name: path, Net: "unixgram"})
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buffer := make([]byte, 16)
+	n, _, err := client.ReadFrom(buffer)
+	if err != nil || string(buffer[:n]) != "p" {
+		t.Errorf("Expected %q, got %q (%v)", "p", buffer[:n], err)
+	}
+
+	// the unix sockets share accounts with the other protocols
+	if server.handleMessage("test", "PEEK,gb,l") != "9,10" {
+		t.Error("Expected the text protocol to see the unixgram socket's bucket")
+	}
+
+	cancel()
+	server.wg.Wait()
+	if _, err := os.Lstat(path); err == nil {
+		t.Error("Expected the socket file to be removed")
+	}
+}
+
+func Test_unix_stale_socket(t *testing.T) {
+	dir := t.TempDir()
+
+	// a socket left behind by a server that didn't shut down cleanly is removed
+	stale := filepath.Join(dir, "stale.sock")
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: stale, Net: "unix"})
+	if err != nil {
+		t.Fatalf("Cannot create socket: %v", err)
+	}
+	ln.SetUnlinkOnClose(false)
+	ln.Close()
+	if err := removeStaleSocket("unix", stale); err != nil {
+		t.Errorf("Expected stale socket to be removed, got %v", err)
+	}
+	if _, err := os.Lstat(stale); err == nil {
+		t.Error("Expected the stale socket file to be removed")
+	}
+
+	// a socket that a server is listening on isn't
+	live := filepath.Join(dir, "live.sock")
+	ln, err = net.ListenUnix("unix", &net.UnixAddr{Name: live, Net: "unix"})
+	if err != nil {
+		t.Fatalf("Cannot create socket: %v", err)
+	}
+	defer ln.Close()
+	if err := removeStaleSocket("unix", live); err == nil {
+		t.Error("Expected error for a socket in use, got nil")
+	}
+
+	// and nor is a file that isn't a socket
+	file := filepath.Join(dir, "file")
+	os.WriteFile(file, []byte("important"), 0600)
+	if err := removeStaleSocket("unix", file); err == nil {
+		t.Error("Expected error for a file that isn't a socket, got nil")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("Expected the file to be kept, got %v", err)
+	}
+}